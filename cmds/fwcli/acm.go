@@ -0,0 +1,128 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/flammit/fwtools/pkg/acm"
+	"github.com/flammit/fwtools/pkg/bootguard"
+	"github.com/flammit/fwtools/pkg/fit"
+	"github.com/flammit/fwtools/pkg/rom"
+)
+
+// foundAcm is a module at an offset of the ROM and where it was found: the
+// FIT and the regions holding it.
+type foundAcm struct {
+	acm     *acm.ACM
+	offset  uint32
+	sources []string
+	// the FIT entries point at startup ACMs
+	startup bool
+}
+
+// findAcms lists the modules referenced by the FIT and the ones detected
+// in the region tree, e.g. SINIT ACMs in FV files.
+func findAcms(romBytes []byte, region *rom.Region) []*foundAcm {
+	found := map[uint32]*foundAcm{}
+	add := func(offset uint32, a *acm.ACM, source string) {
+		f, ok := found[offset]
+		if !ok {
+			f = &foundAcm{acm: a, offset: offset}
+			found[offset] = f
+		}
+		f.sources = append(f.sources, source)
+		f.startup = f.startup || source == "FIT"
+	}
+
+	region.Walk(func(r *rom.Region) {
+		switch name := path.Base(r.Name); {
+		case r.Type == "fit_table":
+			table, err := fit.DecodeTableConfig(r.Raw)
+			if err != nil {
+				return
+			}
+			for _, entry := range table.Entries {
+				offset, ok := r.AddressMap().FlashOffset(uint64(entry.Address), 0)
+				if entry.Type != "startup_acm" || !ok || uint64(offset) >= uint64(len(romBytes)) {
+					continue
+				}
+				if a, err := acm.Parse(romBytes[offset:]); err == nil {
+					add(offset, a, "FIT")
+				}
+			}
+		case name == "startup_acm" || strings.HasPrefix(name, "acm_"):
+			if a, err := acm.Parse(r.Raw); err == nil {
+				add(r.Offset, a, path.Dir(r.Name))
+			}
+		}
+	})
+
+	list := []*foundAcm{}
+	for _, f := range found {
+		list = append(list, f)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].offset < list[j].offset })
+	return list
+}
+
+const acmUsage = "list <rom_path>"
+
+func acmCommand(args []string) {
+	if len(args) < 1 {
+		log.Fatalf("%v: acm usage: %v", os.Args[0], acmUsage)
+	}
+	switch args[0] {
+	case "list":
+		acmList(args[1:])
+	default:
+		log.Fatalf("%v: acm: invalid command: %v", os.Args[0], args[0])
+	}
+}
+
+func acmList(args []string) {
+	if len(args) != 1 {
+		log.Fatalf("%v: acm usage: %v", os.Args[0], acmUsage)
+	}
+	romBytes, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		log.Fatalf("acm: failed to read rom path '%v': err=%v", args[0], err)
+	}
+
+	region := detectRegions(romBytes)
+	list := findAcms(romBytes, region)
+	if len(list) == 0 {
+		log.Fatalf("acm: no ACMs found")
+	}
+
+	// the BPM holds the lowest startup ACM SVN allowed to verify it
+	minSvn := -1
+	if _, bpmOffset := findManifests(romBytes, region); bpmOffset != 0 {
+		if bpm, err := bootguard.ParseBootPolicyManifest(romBytes[bpmOffset:]); err == nil {
+			minSvn = int(bpm.Header.ACMSVN)
+			log.Printf("acm: BPM 0x%08x ACM SVN %d", bpmOffset, minSvn)
+		}
+	}
+
+	for _, f := range list {
+		a, h := f.acm, f.acm.Header
+		log.Printf("acm: 0x%08x %v version %v date %v svn %v txt_svn %v size 0x%x header %v rsa%d (%v)",
+			f.offset, a.Type(), a.Version(), h.DateString(), h.SeSvn, h.TxtSvn, len(a.Raw),
+			h.HeaderVersionString(), a.KeyBits(), strings.Join(f.sources, ", "))
+		if h.Debug() {
+			log.Printf("acm:   warning: debug signed, pre-production module")
+		}
+		if f.startup && int(h.SeSvn) < minSvn {
+			log.Printf("acm:   warning: SVN %d is below the BPM ACM SVN %d", h.SeSvn, minSvn)
+		}
+		for _, id := range a.ChipsetIDs {
+			log.Printf("acm:   chipset %v", id)
+		}
+		for _, id := range a.ProcessorIDs {
+			log.Printf("acm:   cpu %v", id)
+		}
+	}
+}
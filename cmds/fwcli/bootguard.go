@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/flammit/fwtools/pkg/bootguard"
+	"github.com/flammit/fwtools/pkg/fit"
+	"github.com/flammit/fwtools/pkg/rom"
+)
+
+const bootGuardUsage = "verify <rom_path>"
+
+func bootGuardCommand(args []string) {
+	if len(args) < 1 {
+		log.Fatalf("%v: bootguard usage: %v", os.Args[0], bootGuardUsage)
+	}
+	switch args[0] {
+	case "verify":
+		bootGuardVerify(args[1:])
+	default:
+		log.Fatalf("%v: bootguard: invalid command: %v", os.Args[0], args[0])
+	}
+}
+
+// findManifests returns the ROM offsets of the KM and BPM referenced by
+// the FIT, 0 when there is none.
+func findManifests(romBytes []byte, region *rom.Region) (kmOffset, bpmOffset uint32) {
+	region.Walk(func(r *rom.Region) {
+		if r.Type != "fit_table" {
+			return
+		}
+		table, err := fit.DecodeTableConfig(r.Raw)
+		if err != nil {
+			return
+		}
+		for _, entry := range table.Entries {
+			offset, ok := r.AddressMap().FlashOffset(uint64(entry.Address), 0)
+			if !ok || uint64(offset) >= uint64(len(romBytes)) {
+				continue
+			}
+			switch entry.Type {
+			case "key_manifest":
+				kmOffset = offset
+			case "boot_policy_manifest":
+				bpmOffset = offset
+			}
+		}
+	})
+	return kmOffset, bpmOffset
+}
+
+func bootGuardVerify(args []string) {
+	if len(args) != 1 {
+		log.Fatalf("%v: bootguard usage: %v", os.Args[0], bootGuardUsage)
+	}
+	romBytes, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		log.Fatalf("bootguard: failed to read rom path '%v': err=%v", args[0], err)
+	}
+
+	region := detectRegions(romBytes)
+	kmOffset, bpmOffset := findManifests(romBytes, region)
+	if kmOffset == 0 || bpmOffset == 0 {
+		log.Fatalf("bootguard: the FIT has no key manifest and boot policy manifest")
+	}
+	km, err := bootguard.ParseKeyManifest(romBytes[kmOffset:])
+	if err != nil {
+		log.Fatalf("bootguard: invalid key manifest at 0x%08x: err=%v", kmOffset, err)
+	}
+	bpm, err := bootguard.ParseBootPolicyManifest(romBytes[bpmOffset:])
+	if err != nil {
+		log.Fatalf("bootguard: invalid boot policy manifest at 0x%08x: err=%v", bpmOffset, err)
+	}
+
+	// the hash of the KM key is fused into the board, show it to compare
+	kmHashAlg := "sha256"
+	if km.Config.PubKeyHashAlg != "" {
+		kmHashAlg = km.Config.PubKeyHashAlg
+	}
+	if h, err := bootguard.KeyHash(km.Signature, kmHashAlg); err == nil {
+		log.Printf("bootguard: KM 0x%08x key %v %v:%v", kmOffset,
+			km.Metadata()["key"], kmHashAlg, hex.EncodeToString(h))
+	}
+	log.Printf("bootguard: BPM 0x%08x key %v", bpmOffset, bpm.Metadata()["key"])
+
+	addressMap := region.AddressMap()
+	read := func(address uint64, size uint32) ([]byte, error) {
+		offset, ok := addressMap.FlashOffset(address, size)
+		if !ok || uint64(offset)+uint64(size) > uint64(len(romBytes)) {
+			return nil, fmt.Errorf("not mapped from the ROM")
+		}
+		return romBytes[offset : offset+size], nil
+	}
+
+	errs := []error{}
+	if err := bootguard.VerifyKeyManifest(km, romBytes[kmOffset:]); err != nil {
+		errs = append(errs, err)
+	}
+	errs = append(errs, bootguard.VerifyBootPolicyManifest(bpm, romBytes[bpmOffset:], km, read)...)
+	for _, err := range errs {
+		log.Print(err)
+	}
+	if len(errs) != 0 {
+		log.Fatalf("bootguard: verification failed, the board won't boot this ROM with Boot Guard enabled")
+	}
+	log.Printf("bootguard: KM signature, BPM key and signature and IBB digests are valid")
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/flammit/fwtools/pkg/ifd"
+)
+
+func readDescriptor(command, romPath string) ([]byte, *ifd.Config) {
+	romBytes, err := ioutil.ReadFile(romPath)
+	if err != nil {
+		log.Fatalf("%v: failed to read rom path '%v': err=%v", command, romPath, err)
+	}
+	config, err := ifd.ReadConfig(romBytes)
+	if err != nil {
+		log.Fatalf("%v: failed to read descriptor: err=%v", command, err)
+	}
+	return romBytes, config
+}
+
+func writeDescriptor(command string, romBytes []byte, config *ifd.Config, romPath string) {
+	if err := ifd.WriteConfig(romBytes, config); err != nil {
+		log.Fatalf("%v: failed to encode descriptor: err=%v", command, err)
+	}
+	if err := ioutil.WriteFile(romPath, romBytes, os.ModePerm); err != nil {
+		log.Fatalf("%v: failed to write rom file: err=%v", command, err)
+	}
+}
+
+func ifdInfo(args []string) {
+	if len(args) != 1 {
+		log.Fatalf("%v: ifd usage: <rom_path>", os.Args[0])
+	}
+	_, config := readDescriptor("ifd", args[0])
+	log.Printf("ifd: IFDv%d", config.Version())
+	log.Printf("ifd: components %v", config.Components)
+	for _, region := range config.Regions {
+		if region.Base > region.Limit {
+			continue
+		}
+		log.Printf("ifd: region %-5v 0x%08x - 0x%08x", region.Name,
+			uint32(region.Base), uint32(region.Limit))
+	}
+	for _, master := range config.Masters {
+		log.Printf("ifd: master %v", master)
+	}
+	log.Printf("ifd: chipset %v", config.Chipset)
+	for _, strap := range config.Straps {
+		log.Printf("ifd: strap %-24v %-15v %v", strap.Name, strap.Location, strap.Value)
+	}
+}
+
+func ifdLock(command string, args []string) {
+	if len(args) != 2 {
+		log.Fatalf("%v: %v usage: <rom_path> <out_rom_path>", os.Args[0], command)
+	}
+	romBytes, config := readDescriptor(command, args[0])
+	var err error
+	if command == "lock" {
+		err = config.Lock()
+	} else {
+		err = config.Unlock()
+	}
+	if err != nil {
+		log.Fatalf("%v: %v", command, err)
+	}
+	for _, master := range config.Masters {
+		log.Printf("%v: master %v", command, master)
+	}
+	writeDescriptor(command, romBytes, config, args[1])
+}
+
+func ifdLayout(args []string) {
+	if len(args) < 1 || len(args) > 2 {
+		log.Fatalf("%v: layout usage: <rom_path> [layout_path]", os.Args[0])
+	}
+	_, config := readDescriptor("layout", args[0])
+	w := os.Stdout
+	if len(args) == 2 {
+		f, err := os.Create(args[1])
+		if err != nil {
+			log.Fatalf("layout: failed to create layout file: err=%v", err)
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := ifd.WriteLayout(w, config.Layout()); err != nil {
+		log.Fatalf("layout: failed to write layout: err=%v", err)
+	}
+}
+
+func ifdRelayout(args []string) {
+	if len(args) < 3 || len(args) > 4 {
+		log.Fatalf("%v: relayout usage: <rom_path> <layout_path> <out_rom_path> [new_size]", os.Args[0])
+	}
+	romPath, layoutPath, outPath := args[0], args[1], args[2]
+	romBytes, config := readDescriptor("relayout", romPath)
+
+	f, err := os.Open(layoutPath)
+	if err != nil {
+		log.Fatalf("relayout: failed to open layout file: err=%v", err)
+	}
+	entries, err := ifd.ParseLayout(f)
+	f.Close()
+	if err != nil {
+		log.Fatalf("relayout: %v", err)
+	}
+
+	newSize := uint32(len(romBytes))
+	if len(args) == 4 {
+		size, err := strconv.ParseUint(args[3], 0, 32)
+		if err != nil {
+			log.Fatalf("relayout: invalid size '%v': err=%v", args[3], err)
+		}
+		newSize = uint32(size)
+	}
+
+	newRomBytes, err := ifd.Relayout(romBytes, entries, newSize)
+	if err != nil {
+		log.Fatalf("relayout: %v", err)
+	}
+	if size := config.FlashSize(); size != newSize {
+		log.Printf("relayout: warning: components declare 0x%x bytes, image is 0x%x bytes",
+			size, newSize)
+	}
+	if err := ioutil.WriteFile(outPath, newRomBytes, os.ModePerm); err != nil {
+		log.Fatalf("relayout: failed to write rom file: err=%v", err)
+	}
+}
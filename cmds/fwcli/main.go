@@ -1,10 +1,12 @@
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 
+	"github.com/flammit/fwtools/pkg/acm"
 	"github.com/flammit/fwtools/pkg/cbfs"
 	"github.com/flammit/fwtools/pkg/fit"
 	"github.com/flammit/fwtools/pkg/ifd"
@@ -20,15 +22,43 @@ var (
 		cbfs.DetectFlashMap,
 		cbfs.DetectVolume,
 		uefi.DetectEFIVolume,
+		me.DetectBPDT,
 		fit.DetectFIT,
+		acm.DetectACM,
 	}
 )
 
+// huffmanEnv names a file with the ME Huffman dictionaries, see
+// me.LoadHuffmanDictionaries
+const huffmanEnv = "FWCLI_ME_HUFFMAN"
+
+func loadHuffmanDictionaries() {
+	path := os.Getenv(huffmanEnv)
+	if path == "" {
+		return
+	}
+	dicts, err := me.LoadHuffmanDictionaries(path)
+	if err != nil {
+		log.Fatalf("%v: failed to load %v: err=%v", os.Args[0], huffmanEnv, err)
+	}
+	me.SetHuffmanDictionaries(dicts)
+}
+
 func fatalUsage(message string) {
-	log.Fatalf("%v: %v\nusage: %v [extract|build] ...",
+	log.Fatalf("%v: %v\nusage: %v [extract|build|ifd|lock|unlock|layout|relayout|split|join|me|me-clean|microcode|bootguard|acm] ...",
 		os.Args[0], message, os.Args[0])
 }
 
+func detectRegions(romBytes []byte) *rom.Region {
+	return rom.DetectRegions(detectors, &rom.Region{
+		Raw:    romBytes,
+		Name:   "",
+		Type:   "unknown",
+		Offset: 0,
+		Size:   uint32(len(romBytes)),
+	})
+}
+
 func extract(args []string) {
 	log.Printf("extract: starting")
 	if len(args) != 2 {
@@ -40,12 +70,12 @@ func extract(args []string) {
 		log.Panicf("extract: failed to read rom path '%v': err=%v", romPath, err)
 	}
 
-	region := rom.DetectRegions(detectors, &rom.Region{
-		Raw:    romBytes,
-		Name:   "",
-		Type:   "unknown",
-		Offset: 0,
-		Size:   uint32(len(romBytes)),
+	region := detectRegions(romBytes)
+
+	region.Walk(func(r *rom.Region) {
+		for _, d := range r.Diagnostics {
+			log.Printf("extract: %v: %v", r.Name, d)
+		}
 	})
 
 	err = region.Save(layoutPath)
@@ -53,18 +83,55 @@ func extract(args []string) {
 		log.Panicf("extract: %v", err)
 	}
 
-	// rebuild to check
-	newRomBytes := make([]byte, len(romBytes))
-	for n := 0; n < len(newRomBytes); n++ {
-		newRomBytes[n] = 0xff
+	// rebuild from the saved layout to check every handler
+	if err := verifyLayout(romBytes, layoutPath); err != nil {
+		log.Fatalf("extract: %v", err)
+	}
+}
+
+func verifyLayout(romBytes []byte, layoutPath string) error {
+	region, err := rom.LoadRegion(layoutPath)
+	if err != nil {
+		return fmt.Errorf("failed to reload layout: err=%v", err)
 	}
+	if int(region.Size) != len(romBytes) {
+		return fmt.Errorf("rebuilt ROM size 0x%08x doesn't match 0x%08x",
+			region.Size, len(romBytes))
+	}
+	newRomBytes := rom.EmptyBytes(region.Size)
 	region.AddBytes(newRomBytes)
 	for n := 0; n < len(newRomBytes); n++ {
 		if newRomBytes[n] != romBytes[n] {
-			log.Fatalf("rebuilt ROM doesn't match at 0x%08x: expected 0x%02x got 0x%02x",
+			return fmt.Errorf("rebuilt ROM doesn't match at 0x%08x: expected 0x%02x got 0x%02x",
 				n, romBytes[n], newRomBytes[n])
 		}
 	}
+	return nil
+}
+
+// checkRom extracts a modified ROM like extract does, into layoutPath or a
+// temporary directory if it is empty, and checks the layout rebuilds it.
+func checkRom(command string, romBytes []byte, layoutPath string) {
+	if layoutPath == "" {
+		var err error
+		layoutPath, err = ioutil.TempDir("", command)
+		if err != nil {
+			log.Fatalf("%v: failed to create layout directory: err=%v", command, err)
+		}
+		defer os.RemoveAll(layoutPath)
+	}
+	region := detectRegions(romBytes)
+	region.Walk(func(r *rom.Region) {
+		for _, d := range r.Diagnostics {
+			log.Printf("%v: %v: %v", command, r.Name, d)
+		}
+	})
+	if err := region.Save(layoutPath); err != nil {
+		log.Fatalf("%v: %v", command, err)
+	}
+	if err := verifyLayout(romBytes, layoutPath); err != nil {
+		log.Fatalf("%v: %v", command, err)
+	}
 }
 
 func build(args []string) {
@@ -79,10 +146,7 @@ func build(args []string) {
 		log.Panicf("build: failed to load region: err=%v", err)
 	}
 	log.Printf("build: rom size is 0x%08x", region.Size)
-	newRomBytes := make([]byte, region.Size)
-	for n := 0; n < len(newRomBytes); n++ {
-		newRomBytes[n] = 0xff
-	}
+	newRomBytes := rom.EmptyBytes(region.Size)
 	region.AddBytes(newRomBytes)
 	err = ioutil.WriteFile(romPath, newRomBytes, os.ModePerm)
 	if err != nil {
@@ -94,12 +158,35 @@ func main() {
 	if len(os.Args) < 2 {
 		fatalUsage("missing command")
 	}
+	loadHuffmanDictionaries()
 	command := os.Args[1]
 	switch command {
 	case "extract":
 		extract(os.Args[2:])
 	case "build":
 		build(os.Args[2:])
+	case "ifd":
+		ifdInfo(os.Args[2:])
+	case "lock", "unlock":
+		ifdLock(command, os.Args[2:])
+	case "layout":
+		ifdLayout(os.Args[2:])
+	case "relayout":
+		ifdRelayout(os.Args[2:])
+	case "split":
+		split(os.Args[2:])
+	case "join":
+		join(os.Args[2:])
+	case "me":
+		meInfo(os.Args[2:])
+	case "me-clean":
+		meClean(os.Args[2:])
+	case "microcode":
+		microcodeCommand(os.Args[2:])
+	case "bootguard":
+		bootGuardCommand(os.Args[2:])
+	case "acm":
+		acmCommand(os.Args[2:])
 	default:
 		fatalUsage("invalid command: " + command)
 	}
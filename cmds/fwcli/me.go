@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/flammit/fwtools/pkg/ifd"
+	"github.com/flammit/fwtools/pkg/me"
+	"github.com/flammit/fwtools/pkg/rom"
+)
+
+func meInfo(args []string) {
+	if len(args) != 1 {
+		log.Fatalf("%v: me usage: <rom_path>", os.Args[0])
+	}
+	romBytes, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		log.Fatalf("me: failed to read rom path '%v': err=%v", args[0], err)
+	}
+
+	found := false
+	detectRegions(romBytes).Walk(func(r *rom.Region) {
+		if _, ok := r.Metadata["key_hash"]; !ok {
+			return
+		}
+		m, err := me.ParseManifest(r.Raw)
+		if err != nil {
+			return
+		}
+		found = true
+		log.Printf("me: %v", r.Name)
+		log.Printf("me:   version  %v", m.Header.Version())
+		log.Printf("me:   svn      %v", m.Header.SVN)
+		log.Printf("me:   vendor   0x%04x", m.Header.Vendor)
+		log.Printf("me:   date     %v", m.Header.DateString())
+		log.Printf("me:   key      %v-bit, exponent %v", len(m.Modulus)*8, r.Metadata["key_exponent"])
+		log.Printf("me:   modulus  %v", hex.EncodeToString(m.Modulus))
+		log.Printf("me:   key hash %v", m.KeyHash())
+	})
+	if !found {
+		log.Fatalf("me: no ME manifests found")
+	}
+}
+
+func meClean(args []string) {
+	relocate := len(args) > 0 && args[0] == "-relocate"
+	if relocate {
+		args = args[1:]
+	}
+	if len(args) < 2 || len(args) > 3 {
+		log.Fatalf("%v: me-clean usage: [-relocate] <rom_path> <out_rom_path> [layout_path]", os.Args[0])
+	}
+	romBytes, config := readDescriptor("me-clean", args[0])
+
+	var meRegion *ifd.RegionConfig
+	for n := range config.Regions {
+		if config.Regions[n].Name == "me" && config.Regions[n].Base <= config.Regions[n].Limit {
+			meRegion = &config.Regions[n]
+		}
+	}
+	if meRegion == nil || uint32(meRegion.Limit) >= uint32(len(romBytes)) {
+		log.Fatalf("me-clean: descriptor has no ME region inside the image")
+	}
+	base := uint32(meRegion.Base)
+	report, err := me.Clean(romBytes[base:meRegion.Limit+1], relocate)
+	if err != nil {
+		log.Fatalf("me-clean: %v", err)
+	}
+	log.Printf("me-clean: kept partitions %v", strings.Join(report.KeptPartitions, " "))
+	log.Printf("me-clean: removed partitions %v", strings.Join(report.RemovedPartitions, " "))
+	log.Printf("me-clean: kept modules %v", strings.Join(report.KeptModules, " "))
+	log.Printf("me-clean: removed modules %v", strings.Join(report.RemovedModules, " "))
+
+	log.Printf("me-clean: ME region 0x%08x - 0x%08x shrunk to 0x%08x - 0x%08x",
+		base, uint32(meRegion.Limit), base, base+report.Size-1)
+	meRegion.Limit = rom.Hex32(base + report.Size - 1)
+	if strap, err := config.DisableMe(); err != nil {
+		log.Printf("me-clean: can't disable the ME in the straps: %v", err)
+	} else {
+		log.Printf("me-clean: set strap %v", strap)
+	}
+	if err := ifd.WriteConfig(romBytes, config); err != nil {
+		log.Fatalf("me-clean: failed to encode descriptor: err=%v", err)
+	}
+
+	layoutPath := ""
+	if len(args) == 3 {
+		layoutPath = args[2]
+	}
+	checkRom("me-clean", romBytes, layoutPath)
+
+	if err := ioutil.WriteFile(args[1], romBytes, os.ModePerm); err != nil {
+		log.Fatalf("me-clean: failed to write rom file: err=%v", err)
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/flammit/fwtools/pkg/cbfs"
+	"github.com/flammit/fwtools/pkg/fit"
+	"github.com/flammit/fwtools/pkg/microcode"
+	"github.com/flammit/fwtools/pkg/rom"
+	"github.com/flammit/fwtools/pkg/uefi"
+)
+
+// foundMicrocode is an update at an offset of the ROM and where it was
+// found: the FIT and the regions holding it.
+type foundMicrocode struct {
+	update  *microcode.Update
+	offset  uint32
+	sources []string
+}
+
+// findMicrocode lists the updates referenced by the FIT and the ones stored
+// at the start of leaf regions, e.g. microcode blobs and FV files.
+func findMicrocode(romBytes []byte, region *rom.Region) []*foundMicrocode {
+	found := map[uint32]*foundMicrocode{}
+	add := func(offset uint32, u *microcode.Update, source string) {
+		if f, ok := found[offset]; ok {
+			f.sources = append(f.sources, source)
+			return
+		}
+		found[offset] = &foundMicrocode{update: u, offset: offset, sources: []string{source}}
+	}
+
+	region.Walk(func(r *rom.Region) {
+		switch {
+		case r.Type == "fit_table":
+			table, err := fit.DecodeTableConfig(r.Raw)
+			if err != nil {
+				return
+			}
+			for _, entry := range table.Entries {
+				offset, ok := r.AddressMap().FlashOffset(uint64(entry.Address), 0)
+				if entry.Type != "microcode" || !ok || uint64(offset) >= uint64(len(romBytes)) {
+					continue
+				}
+				if u, err := microcode.Parse(romBytes[offset:]); err == nil {
+					add(offset, u, "FIT")
+				}
+			}
+		case len(r.Children) == 0:
+			for _, u := range microcode.ParseAll(r.Raw) {
+				add(r.Offset+u.Offset, u.Update, r.Name)
+			}
+		}
+	})
+
+	list := []*foundMicrocode{}
+	for _, f := range found {
+		list = append(list, f)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].offset < list[j].offset })
+	return list
+}
+
+const microcodeUsage = "list <rom_path> | add|replace|remove <rom_path> <mcu_path> <out_rom_path>"
+
+func microcodeCommand(args []string) {
+	if len(args) < 1 {
+		log.Fatalf("%v: microcode usage: %v", os.Args[0], microcodeUsage)
+	}
+	switch args[0] {
+	case "list":
+		microcodeList(args[1:])
+	case "add", "replace", "remove":
+		microcodeEdit(args[0], args[1:])
+	default:
+		log.Fatalf("%v: microcode: invalid command: %v", os.Args[0], args[0])
+	}
+}
+
+func microcodeList(args []string) {
+	if len(args) != 1 {
+		log.Fatalf("%v: microcode usage: %v", os.Args[0], microcodeUsage)
+	}
+	romBytes, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		log.Fatalf("microcode: failed to read rom path '%v': err=%v", args[0], err)
+	}
+
+	list := findMicrocode(romBytes, detectRegions(romBytes))
+	if len(list) == 0 {
+		log.Fatalf("microcode: no microcode updates found")
+	}
+	for _, f := range list {
+		h := f.update.Header
+		checksum := "ok"
+		if !f.update.ChecksumValid || !f.update.ExtendedChecksumValid {
+			checksum = "INVALID"
+		}
+		log.Printf("microcode: 0x%08x revision 0x%08x date %v size 0x%x checksum %v (%v)",
+			f.offset, h.UpdateRevision, h.DateString(), len(f.update.Raw), checksum,
+			strings.Join(f.sources, ", "))
+		for _, p := range f.update.Processors() {
+			log.Printf("microcode:   cpu %v", p)
+		}
+	}
+}
+
+// microcodeArea is the data of a microcode container, or a leaf region,
+// holding updates one after another from offset.  size covers the updates
+// and the empty bytes after them, the space the updates can be repacked
+// into.
+type microcodeArea struct {
+	name    string
+	offset  uint32
+	updates []*microcode.Update
+	size    uint32
+}
+
+func newMicrocodeArea(name string, offset uint32, raw []byte) *microcodeArea {
+	area := &microcodeArea{name: name, offset: offset}
+	located := microcode.ParseAll(raw)
+	for _, u := range located {
+		area.updates = append(area.updates, u.Update)
+	}
+	if len(located) > 0 {
+		last := located[len(located)-1]
+		area.size = last.Offset + uint32(len(last.Raw))
+	}
+	for area.size < uint32(len(raw)) && raw[area.size] == 0xff {
+		area.size++
+	}
+	return area
+}
+
+// microcodeContainer returns where the data of the microcode FFS file of a
+// firmware volume or of a CBFS microcode file is in the region.
+func microcodeContainer(r *rom.Region) (uint32, uint32, bool) {
+	if len(r.Children) == 0 {
+		return 0, 0, false
+	}
+	header := r.Children[0]
+	switch header.Type {
+	case "ffs_header":
+		c, err := uefi.DecodeFileHeaderConfig(header.Raw)
+		if err != nil || c.GUID != uefi.MicrocodeFileGuid ||
+			uint64(c.Size) < uint64(header.Size) || uint64(c.Size) > uint64(r.Size) {
+			return 0, 0, false
+		}
+		return header.Size, uint32(c.Size) - header.Size, true
+	case "cbfs_header":
+		c, err := cbfs.DecodeFileHeaderConfig(header.Raw)
+		if err != nil || uint32(c.Type) != cbfs.FileComponentMicrocode ||
+			uint64(c.Offset)+uint64(c.Len) > uint64(r.Size) {
+			return 0, 0, false
+		}
+		return uint32(c.Offset), uint32(c.Len), true
+	}
+	return 0, 0, false
+}
+
+// findMicrocodeAreas lists the microcode containers, empty ones included,
+// and the leaf regions outside of them that hold updates, e.g. a blob only
+// referenced by the FIT.
+func findMicrocodeAreas(region *rom.Region) []*microcodeArea {
+	areas := []*microcodeArea{}
+	containers := []*rom.Region{}
+	inContainer := func(r *rom.Region) bool {
+		for _, c := range containers {
+			if c.Contains(r.Offset, r.Size) {
+				return true
+			}
+		}
+		return false
+	}
+	region.Walk(func(r *rom.Region) {
+		if offset, size, ok := microcodeContainer(r); ok {
+			containers = append(containers, r)
+			areas = append(areas, newMicrocodeArea(r.Name, r.Offset+offset, r.Raw[offset:offset+size]))
+			return
+		}
+		if len(r.Children) != 0 || r.Type == "fit_table" || inContainer(r) {
+			return
+		}
+		if len(microcode.ParseAll(r.Raw)) > 0 {
+			areas = append(areas, newMicrocodeArea(r.Name, r.Offset, r.Raw))
+		}
+	})
+	return areas
+}
+
+// sameProcessor is true when the updates apply to a common signature and
+// platform.
+func sameProcessor(a, b *microcode.Update) bool {
+	for _, p := range a.Processors() {
+		for _, q := range b.Processors() {
+			if p.Signature == q.Signature && (p.Flags&q.Flags != 0 || p.Flags == q.Flags) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// editMicrocode picks the area to change and returns its new list of
+// updates.  add refuses updates for processors that already have one,
+// replace swaps the first update for the same processors and drops the
+// others, remove drops all of them.
+func editMicrocode(command string, areas []*microcodeArea, u *microcode.Update) (*microcodeArea, []*microcode.Update, error) {
+	if command == "add" {
+		for _, area := range areas {
+			for _, old := range area.updates {
+				if sameProcessor(old, u) {
+					return nil, nil, fmt.Errorf("%v already has revision 0x%08x for cpu %v, use replace",
+						area.name, old.Header.UpdateRevision, old.Processors()[0])
+				}
+			}
+		}
+		for _, area := range areas {
+			updates := append(append([]*microcode.Update{}, area.updates...), u)
+			if packedSize(updates) <= area.size {
+				return area, updates, nil
+			}
+		}
+		return nil, nil, fmt.Errorf("not enough space for 0x%x bytes in %v microcode area(s)",
+			len(u.Raw), len(areas))
+	}
+
+	for _, area := range areas {
+		updates := []*microcode.Update{}
+		found := false
+		for _, old := range area.updates {
+			if !sameProcessor(old, u) {
+				updates = append(updates, old)
+				continue
+			}
+			log.Printf("microcode: %v revision 0x%08x at %v", command, old.Header.UpdateRevision, area.name)
+			if command == "replace" && !found {
+				updates = append(updates, u)
+			}
+			found = true
+		}
+		if found {
+			return area, updates, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("no update for cpu %v found", u.Processors()[0])
+}
+
+func packedSize(updates []*microcode.Update) uint32 {
+	size := uint64(0)
+	for _, u := range updates {
+		size = rom.AlignUp(size, microcode.Align) + uint64(len(u.Raw))
+	}
+	return uint32(size)
+}
+
+// packMicrocode stores updates aligned one after another and fills the rest
+// of the area.  It returns the offset of every update.
+func packMicrocode(updates []*microcode.Update, size uint32) ([]byte, []uint32, error) {
+	if packed := packedSize(updates); packed > size {
+		return nil, nil, fmt.Errorf("not enough space: 0x%x bytes of updates don't fit in 0x%x bytes",
+			packed, size)
+	}
+	raw := bytes.Repeat([]byte{0xff}, int(size))
+	offsets := []uint32{}
+	offset := uint64(0)
+	for _, u := range updates {
+		offset = rom.AlignUp(offset, microcode.Align)
+		copy(raw[offset:], u.Raw)
+		offsets = append(offsets, uint32(offset))
+		offset += uint64(len(u.Raw))
+	}
+	return raw, offsets, nil
+}
+
+func microcodeEdit(command string, args []string) {
+	if len(args) != 3 {
+		log.Fatalf("%v: microcode usage: %v", os.Args[0], microcodeUsage)
+	}
+	romBytes, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		log.Fatalf("microcode: failed to read rom path '%v': err=%v", args[0], err)
+	}
+	mcuBytes, err := ioutil.ReadFile(args[1])
+	if err != nil {
+		log.Fatalf("microcode: failed to read update path '%v': err=%v", args[1], err)
+	}
+	u, err := microcode.Parse(mcuBytes)
+	if err != nil {
+		log.Fatalf("microcode: %v: %v", args[1], err)
+	}
+	if !u.ChecksumValid || !u.ExtendedChecksumValid {
+		log.Fatalf("microcode: %v: update checksum is invalid", args[1])
+	}
+
+	region := detectRegions(romBytes)
+	areas := findMicrocodeAreas(region)
+	if len(areas) == 0 {
+		log.Fatalf("microcode: no microcode area found")
+	}
+	area, updates, err := editMicrocode(command, areas, u)
+	if err != nil {
+		log.Fatalf("microcode: %v: %v", command, err)
+	}
+	raw, offsets, err := packMicrocode(updates, area.size)
+	if err != nil {
+		log.Fatalf("microcode: %v: %v: %v", command, area.name, err)
+	}
+
+	// point the FIT microcode entries of the area at the repacked updates
+	start, end := area.offset, area.offset+area.size
+	tables := 0
+	region.Walk(func(r *rom.Region) {
+		if r.Type != "fit_table" {
+			return
+		}
+		table, err := fit.DecodeTableConfig(r.Raw)
+		if err != nil {
+			log.Fatalf("microcode: %v: %v", r.Name, err)
+		}
+		addressMap := r.AddressMap()
+		addresses := []uint64{}
+		for _, offset := range offsets {
+			address, ok := addressMap.HostAddress(start + offset)
+			if !ok {
+				log.Fatalf("microcode: update at 0x%08x isn't mapped below 4GiB", start+offset)
+			}
+			addresses = append(addresses, address)
+		}
+		table.ReplaceMicrocode(func(entry fit.EntryConfig) bool {
+			offset, ok := addressMap.FlashOffset(uint64(entry.Address), 0)
+			return ok && offset >= start && offset < end
+		}, addresses)
+		tableBytes, err := table.Encode(r.Size)
+		if err != nil {
+			log.Fatalf("microcode: %v: %v", r.Name, err)
+		}
+		copy(romBytes[r.Offset:], tableBytes)
+		tables++
+	})
+	if tables == 0 {
+		log.Printf("microcode: no FIT found, only %v was updated", area.name)
+	}
+
+	copy(romBytes[start:], raw)
+	// FFS files holding the area have a checksum over their data
+	region.Walk(func(r *rom.Region) {
+		if len(r.Children) == 0 || r.Children[0].Type != "ffs_header" || !r.Contains(start, area.size) {
+			return
+		}
+		if err := uefi.UpdateFileChecksum(romBytes[r.Offset : r.Offset+r.Size]); err != nil {
+			log.Fatalf("microcode: %v: %v", r.Name, err)
+		}
+	})
+	log.Printf("microcode: %v now holds %v update(s), 0x%x of 0x%x bytes used",
+		area.name, len(updates), packedSize(updates), area.size)
+
+	checkRom("microcode", romBytes, "")
+	if err := ioutil.WriteFile(args[2], romBytes, os.ModePerm); err != nil {
+		log.Fatalf("microcode: failed to write rom file: err=%v", err)
+	}
+}
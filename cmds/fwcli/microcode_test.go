@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/flammit/fwtools/pkg/cbfs"
+	"github.com/flammit/fwtools/pkg/microcode"
+	"github.com/flammit/fwtools/pkg/rom"
+	"github.com/flammit/fwtools/pkg/uefi"
+)
+
+// testUpdate is a valid update of size bytes for one processor
+func testUpdate(t *testing.T, signature, flags, revision, size uint32) *microcode.Update {
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, microcode.Header{
+		HeaderVersion:      1,
+		UpdateRevision:     revision,
+		Date:               0x04012019,
+		ProcessorSignature: signature,
+		LoaderRevision:     1,
+		ProcessorFlags:     flags,
+		DataSize:           size - microcode.HeaderSize,
+		TotalSize:          size,
+	})
+	raw := append(b.Bytes(), bytes.Repeat([]byte{uint8(revision)}, int(size)-b.Len())...)
+	sum := uint32(0)
+	for n := 0; n < len(raw); n += 4 {
+		sum += binary.LittleEndian.Uint32(raw[n:])
+	}
+	binary.LittleEndian.PutUint32(raw[16:], -sum)
+	u, err := microcode.Parse(raw)
+	if err != nil || !u.ChecksumValid {
+		t.Fatalf("microcode.Parse() = %+v, err=%v", u, err)
+	}
+	return u
+}
+
+func revisions(updates []*microcode.Update) string {
+	list := []string{}
+	for _, u := range updates {
+		list = append(list, fmt.Sprintf("0x%x", u.Header.UpdateRevision))
+	}
+	return strings.Join(list, " ")
+}
+
+// testMicrocodeRom is a 64KiB image with a CBFS microcode file at 0x1000
+// holding one update, an empty microcode FFS file at 0x3000, another FFS
+// file at 0x4000 and a blob of updates at 0x8000 outside of any container.
+func testMicrocodeRom(t *testing.T, u *microcode.Update) *rom.Region {
+	root := &rom.Region{Raw: bytes.Repeat([]byte{0xff}, 0x10000), Size: 0x10000, Type: "container", Name: "rom"}
+
+	container := func(offset, size uint32, headerType string, header []byte) *rom.Region {
+		copy(root.Raw[offset:], header)
+		r := root.Child(offset, size, "container", fmt.Sprintf("file_%x", offset))
+		r.Children = append(r.Children, r.Child(offset, uint32(len(header)), headerType, "header"))
+		root.Children = append(root.Children, r)
+		return r
+	}
+
+	header, err := cbfs.FileHeaderConfig{
+		Len:    0x1000,
+		Type:   rom.Hex32(cbfs.FileComponentMicrocode),
+		Offset: 0x38,
+		Name:   "cpu_microcode_blob.bin",
+	}.Encode(0x38)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := container(0x1000, 0x1040, "cbfs_header", header)
+	copy(root.Raw[0x1038:], u.Raw)
+	r.Children = append(r.Children, r.Child(0x1038, 0x1008, "unknown", "data"))
+
+	for _, file := range []struct {
+		offset uint32
+		guid   string
+	}{
+		{0x3000, uefi.MicrocodeFileGuid},
+		{0x4000, "8c8ce578-8a3d-4f1c-9935-896185c32dd3"},
+	} {
+		header, err = uefi.FileHeaderConfig{GUID: file.guid, Type: 0x01, State: 0xf8, Size: 0x818}.Encode(0x18)
+		if err != nil {
+			t.Fatal(err)
+		}
+		container(file.offset, 0x818, "ffs_header", header)
+	}
+
+	copy(root.Raw[0x8000:], u.Raw)
+	root.Children = append(root.Children, root.Child(0x8000, 0x800, "unknown", "blob"))
+	return root
+}
+
+func TestFindMicrocodeAreas(t *testing.T) {
+	u := testUpdate(t, 0x906ea, 0x22, 0xb4, 0x400)
+	areas := findMicrocodeAreas(testMicrocodeRom(t, u))
+
+	want := []struct {
+		name         string
+		offset, size uint32
+		revisions    string
+	}{
+		{"rom/file_1000", 0x1038, 0x1000, "0xb4"},
+		{"rom/file_3000", 0x3018, 0x800, ""},
+		{"rom/blob", 0x8000, 0x800, "0xb4"},
+	}
+	if len(areas) != len(want) {
+		t.Fatalf("findMicrocodeAreas() found %v areas, want %v", len(areas), len(want))
+	}
+	for n, area := range areas {
+		if area.name != want[n].name || area.offset != want[n].offset || area.size != want[n].size ||
+			revisions(area.updates) != want[n].revisions {
+			t.Errorf("area %v = %v 0x%x 0x%x [%v], want %+v",
+				n, area.name, area.offset, area.size, revisions(area.updates), want[n])
+		}
+	}
+}
+
+func TestEditMicrocode(t *testing.T) {
+	kbl := testUpdate(t, 0x906ea, 0x22, 0xb4, 0x800)
+	kblNew := testUpdate(t, 0x906ea, 0x02, 0xc0, 0x800)
+	kblOld := testUpdate(t, 0x906ea, 0x02, 0xaa, 0x400)
+	cfl := testUpdate(t, 0x806ec, 0x94, 0x21, 0x400)
+	other := testUpdate(t, 0x50657, 0x01, 0x01, 0x400)
+
+	area := func(name string, size uint32, updates ...*microcode.Update) *microcodeArea {
+		return &microcodeArea{name: name, updates: updates, size: size}
+	}
+	for _, tt := range []struct {
+		name      string
+		command   string
+		areas     []*microcodeArea
+		u         *microcode.Update
+		area      string
+		revisions string
+		err       string
+	}{
+		{"add", "add", []*microcodeArea{area("a", 0x1000, kbl)}, other, "a", "0xb4 0x1", ""},
+		{"add to an empty area", "add", []*microcodeArea{area("a", 0x800)}, other, "a", "0x1", ""},
+		{"add to the next area", "add", []*microcodeArea{area("a", 0x800, kbl), area("b", 0x400)}, other, "b", "0x1", ""},
+		{"add an existing cpu", "add", []*microcodeArea{area("a", 0x1000, cfl, kbl)}, kblNew, "", "", "use replace"},
+		{"add out of space", "add", []*microcodeArea{area("a", 0xa00, kbl), area("b", 0x200)}, other, "", "", "not enough space"},
+		{"replace", "replace", []*microcodeArea{area("a", 0x1000, cfl, kbl)}, kblNew, "a", "0x21 0xc0", ""},
+		{"replace duplicates", "replace", []*microcodeArea{area("a", 0x1000, kblOld, cfl, kbl)}, kblNew, "a", "0xc0 0x21", ""},
+		{"replace in the second area", "replace", []*microcodeArea{area("a", 0x400, cfl), area("b", 0x800, kbl)}, kblNew, "b", "0xc0", ""},
+		{"remove", "remove", []*microcodeArea{area("a", 0x1000, cfl, kbl)}, kblNew, "a", "0x21", ""},
+		{"remove the last one", "remove", []*microcodeArea{area("a", 0x800, kbl)}, kblNew, "a", "", ""},
+		{"remove a missing cpu", "remove", []*microcodeArea{area("a", 0x1000, cfl, kbl)}, other, "", "", "no update"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			area, updates, err := editMicrocode(tt.command, tt.areas, tt.u)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("editMicrocode() err=%v, want an error containing '%v'", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("editMicrocode() err=%v", err)
+			}
+			if area.name != tt.area || revisions(updates) != tt.revisions {
+				t.Errorf("editMicrocode() = %v [%v], want %v [%v]",
+					area.name, revisions(updates), tt.area, tt.revisions)
+			}
+		})
+	}
+}
+
+func TestPackMicrocode(t *testing.T) {
+	kbl := testUpdate(t, 0x906ea, 0x22, 0xb4, 0x800)
+	cfl := testUpdate(t, 0x806ec, 0x94, 0x21, 0x400)
+	// not a multiple of the alignment, real updates are in KiB
+	odd := &microcode.Update{Raw: bytes.Repeat([]byte{0x5a}, 0x3f4)}
+
+	for _, tt := range []struct {
+		name    string
+		updates []*microcode.Update
+		size    uint32
+		offsets []uint32
+		err     string
+	}{
+		{"packed", []*microcode.Update{cfl, kbl}, 0x1000, []uint32{0, 0x400}, ""},
+		{"aligned", []*microcode.Update{odd, cfl}, 0x800, []uint32{0, 0x400}, ""},
+		{"empty", []*microcode.Update{}, 0x400, []uint32{}, ""},
+		{"exact fit", []*microcode.Update{kbl, cfl}, 0xc00, []uint32{0, 0x800}, ""},
+		{"out of space", []*microcode.Update{kbl, cfl}, 0xbff, nil, "not enough space"},
+		{"alignment out of space", []*microcode.Update{odd, cfl}, 0x7f4, nil, "not enough space"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, offsets, err := packMicrocode(tt.updates, tt.size)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("packMicrocode() err=%v, want an error containing '%v'", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("packMicrocode() err=%v", err)
+			}
+			if uint32(len(raw)) != tt.size || fmt.Sprint(offsets) != fmt.Sprint(tt.offsets) {
+				t.Fatalf("packMicrocode() = 0x%x bytes at %x, want 0x%x bytes at %x",
+					len(raw), offsets, tt.size, tt.offsets)
+			}
+			end := uint32(0)
+			for n, u := range tt.updates {
+				if !bytes.Equal(raw[offsets[n]:offsets[n]+uint32(len(u.Raw))], u.Raw) {
+					t.Errorf("update %v isn't stored at 0x%x", n, offsets[n])
+				}
+				// alignment padding and the space after the updates are empty
+				if len(bytes.Trim(raw[end:offsets[n]], "\xff")) != 0 {
+					t.Errorf("bytes 0x%x - 0x%x aren't empty", end, offsets[n])
+				}
+				end = offsets[n] + uint32(len(u.Raw))
+			}
+			if len(bytes.Trim(raw[end:], "\xff")) != 0 {
+				t.Errorf("bytes after 0x%x aren't empty", end)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/flammit/fwtools/pkg/ifd"
+	"github.com/flammit/fwtools/pkg/rom"
+)
+
+// logChipRegions shows where the flash regions and any region crossing a
+// chip boundary end up on each chip.
+func logChipRegions(command string, romBytes []byte, chipSizes []uint32) {
+	region := detectRegions(romBytes)
+	region.Walk(func(r *rom.Region) {
+		if r == region {
+			return
+		}
+		spans := r.Spans(chipSizes)
+		nested := strings.Contains(r.Name, "/")
+		if nested && len(spans) < 2 {
+			return
+		}
+		for _, span := range spans {
+			log.Printf("%v: %-30v %v", command, r.Name, span)
+		}
+	})
+}
+
+func split(args []string) {
+	if len(args) < 2 {
+		log.Fatalf("%v: split usage: <rom_path> <chip0_path> [chip1_path ...]", os.Args[0])
+	}
+	romPath, chipPaths := args[0], args[1:]
+	romBytes, err := ioutil.ReadFile(romPath)
+	if err != nil {
+		log.Fatalf("split: failed to read rom path '%v': err=%v", romPath, err)
+	}
+	chips, err := ifd.Split(romBytes)
+	if err != nil {
+		log.Fatalf("split: %v", err)
+	}
+	if len(chips) != len(chipPaths) {
+		log.Fatalf("split: descriptor declares %v components, got %v chip paths",
+			len(chips), len(chipPaths))
+	}
+
+	chipSizes := []uint32{}
+	for n, chip := range chips {
+		if err := ioutil.WriteFile(chipPaths[n], chip, os.ModePerm); err != nil {
+			log.Fatalf("split: failed to write chip file: err=%v", err)
+		}
+		chipSizes = append(chipSizes, uint32(len(chip)))
+	}
+	logChipRegions("split", romBytes, chipSizes)
+}
+
+func join(args []string) {
+	if len(args) < 2 {
+		log.Fatalf("%v: join usage: <rom_path> <chip0_path> [chip1_path ...]", os.Args[0])
+	}
+	romPath, chipPaths := args[0], args[1:]
+	chips := [][]byte{}
+	chipSizes := []uint32{}
+	for _, chipPath := range chipPaths {
+		chip, err := ioutil.ReadFile(chipPath)
+		if err != nil {
+			log.Fatalf("join: failed to read chip path '%v': err=%v", chipPath, err)
+		}
+		chips = append(chips, chip)
+		chipSizes = append(chipSizes, uint32(len(chip)))
+	}
+	romBytes, err := ifd.Join(chips)
+	if err != nil {
+		log.Fatalf("join: %v", err)
+	}
+	logChipRegions("join", romBytes, chipSizes)
+	if err := ioutil.WriteFile(romPath, romBytes, os.ModePerm); err != nil {
+		log.Fatalf("join: failed to write rom file: err=%v", err)
+	}
+}
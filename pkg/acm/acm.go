@@ -0,0 +1,308 @@
+package acm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/flammit/fwtools/pkg/rom"
+)
+
+// Intel authenticated code modules (ACM) as described in the TXT software
+// development guide appendix A.  The header is followed by the module's
+// scratch area and the user area, which starts with the information table
+// pointing at the lists of chipsets and processors the module runs on.
+
+type Header struct {
+	ModuleType      uint16    // 0x00
+	ModuleSubType   uint16    // 0x02
+	HeaderLen       uint32    // 0x04 in dwords
+	HeaderVersion   uint32    // 0x08
+	ChipsetID       uint16    // 0x0c
+	Flags           uint16    // 0x0e
+	ModuleVendor    uint32    // 0x10
+	Date            uint32    // 0x14 BCD: year << 16 | month << 8 | day
+	Size            uint32    // 0x18 in dwords
+	TxtSvn          uint16    // 0x1c
+	SeSvn           uint16    // 0x1e
+	CodeControl     uint32    // 0x20
+	ErrorEntryPoint uint32    // 0x24
+	GdtLimit        uint32    // 0x28
+	GdtBasePtr      uint32    // 0x2c
+	SegSel          uint32    // 0x30
+	EntryPoint      uint32    // 0x34
+	Reserved        [64]uint8 // 0x38
+	KeySize         uint32    // 0x78 in dwords
+	ScratchSize     uint32    // 0x7c in dwords
+}
+
+type InfoTable struct {
+	UUID            [16]uint8
+	ChipsetACMType  uint8
+	Version         uint8
+	Length          uint16
+	ChipsetIDList   uint32
+	OsSinitDataVer  uint32
+	MinMleHeaderVer uint32
+	Capabilities    uint32
+	AcmVersion      uint8
+	AcmRevision     [3]uint8
+	ProcessorIDList uint32
+	TpmInfoList     uint32
+}
+
+type ChipsetID struct {
+	Flags      uint32
+	VendorID   uint16
+	DeviceID   uint16
+	RevisionID uint16
+	Reserved   uint16
+	ExtendedID uint32
+}
+
+type ProcessorID struct {
+	FMS          uint32
+	FMSMask      uint32
+	PlatformID   uint64
+	PlatformMask uint64
+}
+
+const (
+	HeaderSize  = 0x80
+	moduleType  = 0x0002
+	vendorIntel = 0x8086
+	// header versions before 3.0 have a 2048 bit key and an exponent,
+	// later ones a 3072 bit key with the fixed exponent 65537
+	headerVersion3  = 0x00030000
+	defaultExponent = 0x10001
+	// the debug signed, pre-production flag
+	flagDebug = 1 << 15
+	// the processor ID list was added in version 4 of the info table
+	infoTableVersion4 = 4
+	// refuse to parse lists larger than this
+	maxListCount = 0x100
+	// ACMs are stored 4KiB aligned
+	Align = 0x1000
+)
+
+var (
+	infoTableUUID = []byte{
+		0xaa, 0x3a, 0xc0, 0x7f, 0xa7, 0x46, 0xdb, 0x18,
+		0x2e, 0xac, 0x69, 0x8f, 0x8d, 0x41, 0x7f, 0x5a,
+	}
+
+	subTypes = map[uint16]string{
+		0x0000: "txt",
+		0x0001: "startup",
+	}
+
+	acmTypes = map[uint8]string{
+		0x00: "bios",
+		0x01: "sinit",
+		0x08: "bios_revocation",
+		0x09: "sinit_revocation",
+	}
+)
+
+func (h Header) Valid() bool {
+	return h.ModuleType == moduleType && h.ModuleVendor == vendorIntel &&
+		uint64(h.HeaderLen)*4 >= HeaderSize &&
+		uint64(h.Size) >= uint64(h.HeaderLen)+uint64(h.ScratchSize) &&
+		h.KeySize != 0
+}
+
+func (h Header) DateString() string {
+	return fmt.Sprintf("%04x-%02x-%02x", h.Date>>16, (h.Date>>8)&0xff, h.Date&0xff)
+}
+
+func (h Header) HeaderVersionString() string {
+	return fmt.Sprintf("%d.%d", h.HeaderVersion>>16, h.HeaderVersion&0xffff)
+}
+
+// Debug is set for pre-production modules signed with a debug key
+func (h Header) Debug() bool {
+	return h.Flags&flagDebug != 0
+}
+
+func (h Header) SubType() string {
+	if name, ok := subTypes[h.ModuleSubType]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%04x", h.ModuleSubType)
+}
+
+// ACM is a parsed module.  Key and Signature are little-endian as stored,
+// Info and the lists are nil when the module has no information table.
+type ACM struct {
+	Header       Header
+	Key          []byte
+	Exponent     uint32
+	Signature    []byte
+	Info         *InfoTable
+	ChipsetIDs   []ChipsetID
+	ProcessorIDs []ProcessorID
+	Raw          []byte
+}
+
+// Parse decodes the module at the start of raw
+func Parse(raw []byte) (*ACM, error) {
+	var h Header
+	if err := binary.Read(bytes.NewReader(raw), binary.LittleEndian, &h); err != nil {
+		return nil, fmt.Errorf("acm: truncated header: err=%v", err)
+	}
+	if !h.Valid() {
+		return nil, fmt.Errorf("acm: invalid header")
+	}
+	size := uint64(h.Size) * 4
+	if size > uint64(len(raw)) {
+		return nil, fmt.Errorf("acm: module of 0x%x bytes doesn't fit in 0x%x bytes", size, len(raw))
+	}
+	a := &ACM{Header: h, Exponent: defaultExponent, Raw: raw[:size]}
+
+	keySize := uint64(h.KeySize) * 4
+	offset := uint64(HeaderSize)
+	keyEnd := offset + keySize*2
+	if h.HeaderVersion < headerVersion3 {
+		keyEnd += 4
+	}
+	if keyEnd > uint64(h.HeaderLen)*4 {
+		return nil, fmt.Errorf("acm: key and signature don't fit in the 0x%x byte header", h.HeaderLen*4)
+	}
+	a.Key = a.Raw[offset : offset+keySize]
+	offset += keySize
+	if h.HeaderVersion < headerVersion3 {
+		a.Exponent = binary.LittleEndian.Uint32(a.Raw[offset:])
+		offset += 4
+	}
+	a.Signature = a.Raw[offset : offset+keySize]
+
+	userArea := (uint64(h.HeaderLen) + uint64(h.ScratchSize)) * 4
+	if !bytes.HasPrefix(a.Raw[userArea:], infoTableUUID) {
+		return a, nil
+	}
+	var info InfoTable
+	if err := binary.Read(bytes.NewReader(a.Raw[userArea:]), binary.LittleEndian, &info); err != nil {
+		return nil, fmt.Errorf("acm: truncated information table: err=%v", err)
+	}
+	a.Info = &info
+
+	count, r, err := readList(a.Raw, info.ChipsetIDList, ChipsetID{})
+	if err != nil {
+		return nil, fmt.Errorf("acm: chipset ID list: %v", err)
+	}
+	a.ChipsetIDs = make([]ChipsetID, count)
+	binary.Read(r, binary.LittleEndian, a.ChipsetIDs)
+	if info.Version >= infoTableVersion4 {
+		count, r, err := readList(a.Raw, info.ProcessorIDList, ProcessorID{})
+		if err != nil {
+			return nil, fmt.Errorf("acm: processor ID list: %v", err)
+		}
+		a.ProcessorIDs = make([]ProcessorID, count)
+		binary.Read(r, binary.LittleEndian, a.ProcessorIDs)
+	}
+	return a, nil
+}
+
+// readList checks the list at offset of raw, a count followed by entries
+// like entry, and returns the count and a reader at the first entry.
+func readList(raw []byte, offset uint32, entry interface{}) (uint32, *bytes.Reader, error) {
+	if uint64(offset)+4 > uint64(len(raw)) {
+		return 0, nil, fmt.Errorf("offset 0x%x is outside of the module", offset)
+	}
+	count := binary.LittleEndian.Uint32(raw[offset:])
+	end := uint64(offset) + 4 + uint64(count)*uint64(binary.Size(entry))
+	if count > maxListCount || end > uint64(len(raw)) {
+		return 0, nil, fmt.Errorf("%v entries don't fit in the module", count)
+	}
+	return count, bytes.NewReader(raw[offset+4 : end]), nil
+}
+
+// KeyBits is the size of the RSA signing key
+func (a ACM) KeyBits() int {
+	return len(a.Key) * 8
+}
+
+func (a ACM) Type() string {
+	if a.Info == nil {
+		return a.Header.SubType()
+	}
+	if name, ok := acmTypes[a.Info.ChipsetACMType]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%02x", a.Info.ChipsetACMType)
+}
+
+// Version is the module version and revision from the information table,
+// the one Intel advisories refer to.
+func (a ACM) Version() string {
+	if a.Info == nil {
+		return ""
+	}
+	rev := a.Info.AcmRevision
+	return fmt.Sprintf("%d.%d.%d.%d", a.Info.AcmVersion, rev[0], rev[1], rev[2])
+}
+
+func (id ChipsetID) String() string {
+	return fmt.Sprintf("%04x:%04x rev 0x%04x", id.VendorID, id.DeviceID, id.RevisionID)
+}
+
+func (id ProcessorID) String() string {
+	return fmt.Sprintf("0x%08x/0x%08x platforms 0x%x/0x%x",
+		id.FMS, id.FMSMask, id.PlatformID, id.PlatformMask)
+}
+
+func (a ACM) Metadata() map[string]string {
+	h := a.Header
+	m := map[string]string{
+		"type":           a.Type(),
+		"header_version": h.HeaderVersionString(),
+		"chipset_id":     fmt.Sprintf("0x%04x", h.ChipsetID),
+		"flags":          fmt.Sprintf("0x%04x", h.Flags),
+		"debug":          fmt.Sprintf("%v", h.Debug()),
+		"vendor":         fmt.Sprintf("0x%04x", h.ModuleVendor),
+		"date":           h.DateString(),
+		"svn":            fmt.Sprintf("%d", h.SeSvn),
+		"txt_svn":        fmt.Sprintf("%d", h.TxtSvn),
+		"entry_point":    fmt.Sprintf("0x%08x", h.EntryPoint),
+		"size":           fmt.Sprintf("0x%x", len(a.Raw)),
+		"key":            fmt.Sprintf("rsa%d", a.KeyBits()),
+	}
+	if a.Info == nil {
+		return m
+	}
+	chipsets := []string{}
+	for _, id := range a.ChipsetIDs {
+		chipsets = append(chipsets, fmt.Sprintf("%04x:%04x", id.VendorID, id.DeviceID))
+	}
+	processors := []string{}
+	for _, id := range a.ProcessorIDs {
+		processors = append(processors, fmt.Sprintf("0x%08x/0x%08x", id.FMS, id.FMSMask))
+	}
+	m["version"] = a.Version()
+	m["chipsets"] = strings.Join(chipsets, " ")
+	m["processors"] = strings.Join(processors, " ")
+	return m
+}
+
+// DetectACM finds the modules stored at 4KiB aligned flash offsets of a
+// region, e.g. SINIT ACMs in firmware volume files.  The data around them
+// is left for the other detectors.
+func DetectACM(unknownRegion *rom.Region) ([]*rom.Region, rom.Diagnostics) {
+	regions := []*rom.Region{}
+	base := uint64(unknownRegion.Offset)
+	end := base + uint64(unknownRegion.Size)
+	for offset := rom.AlignUp(base, Align); offset+HeaderSize <= end; {
+		a, err := Parse(unknownRegion.Raw[offset-base:])
+		if err != nil {
+			offset += Align
+			continue
+		}
+		name := fmt.Sprintf("acm_%04d", len(regions))
+		r := unknownRegion.Child(uint32(offset), uint32(len(a.Raw)), "raw", name)
+		r.Metadata = a.Metadata()
+		regions = append(regions, r)
+		offset += rom.AlignUp(uint64(len(a.Raw)), Align)
+	}
+	return regions, nil
+}
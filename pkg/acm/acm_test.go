@@ -0,0 +1,63 @@
+package acm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/flammit/fwtools/pkg/rom"
+)
+
+// testACM is a 4KiB header version 0.0 module with a 2048 bit key and no
+// information table.
+func testACM() []byte {
+	const keyDwords = 0x40
+	h := Header{
+		ModuleType:    moduleType,
+		ModuleSubType: 0x0001,
+		HeaderLen:     (HeaderSize + keyDwords*4*2 + 4) / 4,
+		ModuleVendor:  vendorIntel,
+		Date:          0x20190412,
+		Size:          Align / 4,
+		SeSvn:         2,
+		KeySize:       keyDwords,
+	}
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, h)
+	raw := append(b.Bytes(), make([]byte, Align-b.Len())...)
+	binary.LittleEndian.PutUint32(raw[HeaderSize+keyDwords*4:], defaultExponent)
+	return raw
+}
+
+func TestParse(t *testing.T) {
+	a, err := Parse(testACM())
+	if err != nil {
+		t.Fatalf("Parse() err=%v", err)
+	}
+	if a.KeyBits() != 2048 || a.Exponent != defaultExponent || a.Type() != "startup" || a.Info != nil {
+		t.Errorf("Parse() = %+v", a)
+	}
+	if _, err := Parse(testACM()[:Align-1]); err == nil {
+		t.Errorf("Parse() of a truncated module succeeded")
+	}
+}
+
+func TestDetectACM(t *testing.T) {
+	raw := bytes.Repeat([]byte{0xff}, 4*Align)
+	copy(raw[Align:], testACM())
+	copy(raw[3*Align:], testACM())
+	// not 4KiB aligned in the flash
+	copy(raw[2*Align+0x10:], testACM()[:HeaderSize])
+	region := &rom.Region{Raw: raw, Offset: 0x10000, Size: uint32(len(raw)), Type: "unknown"}
+
+	regions, _ := DetectACM(region)
+	if len(regions) != 2 {
+		t.Fatalf("DetectACM() found %v modules, want 2", len(regions))
+	}
+	for n, offset := range []uint32{0x11000, 0x13000} {
+		r := regions[n]
+		if r.Offset != offset || r.Size != Align || r.Metadata["svn"] != "2" {
+			t.Errorf("module %v: offset 0x%x size 0x%x metadata %v", n, r.Offset, r.Size, r.Metadata)
+		}
+	}
+}
@@ -0,0 +1,400 @@
+// Package bootguard decodes the Intel Boot Guard key manifest (KM, FIT
+// entry 0x0b) and boot policy manifest (BPM, FIT entry 0x0c).  Structure
+// version 1.x (0x10) is used by Boot Guard 1.0, versions 2.x (0x2x) by
+// Converged Boot Guard and TXT.  Every structure starts with an 8 byte ID
+// and a version, 2.x structures add a byte and the element size.
+package bootguard
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+
+	"github.com/flammit/fwtools/pkg/rom"
+)
+
+const detectorName = "bootguard"
+
+const (
+	structIDSize       = 8
+	structHeaderSize   = structIDSize + 1
+	structHeaderV2Size = structHeaderSize + 3
+	// structure versions from here on use the 2.x layout
+	structVersion2 = 0x20
+	// 1.x hash structures always hold a SHA256 sized buffer
+	digestSizeV1 = 32
+)
+
+// TPM algorithm IDs used for hashes, keys and signature schemes
+const (
+	algRSA    = 0x0001
+	algSHA1   = 0x0004
+	algSHA256 = 0x000b
+	algSHA384 = 0x000c
+	algSHA512 = 0x000d
+	algSM3    = 0x0012
+	algECC    = 0x0023
+)
+
+var algorithms = map[uint16]string{
+	algRSA:    "rsa",
+	algSHA1:   "sha1",
+	algSHA256: "sha256",
+	algSHA384: "sha384",
+	algSHA512: "sha512",
+	0x0010:    "null",
+	algSM3:    "sm3_256",
+	0x0014:    "rsassa",
+	0x0016:    "rsapss",
+	0x0018:    "ecdsa",
+	0x001b:    "sm2",
+	algECC:    "ecc",
+}
+
+func algorithmName(alg uint16) string {
+	if name, ok := algorithms[alg]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%04x", alg)
+}
+
+func parseAlgorithm(name string) (uint16, error) {
+	for alg, algName := range algorithms {
+		if algName == name {
+			return alg, nil
+		}
+	}
+	alg, err := strconv.ParseUint(name, 0, 16)
+	if err != nil {
+		return 0, fmt.Errorf("bootguard: unknown algorithm '%v'", name)
+	}
+	return uint16(alg), nil
+}
+
+type StructHeader struct {
+	ID      [structIDSize]byte
+	Version uint8
+}
+
+// StructHeaderV2 follows StructHeader in 2.x structures.  ElementSize is
+// the size of the whole element, it is 0 in the KM and signature elements.
+type StructHeaderV2 struct {
+	Variable0   uint8
+	ElementSize uint16
+}
+
+// HeaderConfig holds the header fields of a structure, the ID is given by
+// the region type.  1.x boot policy headers keep their header structure
+// version in the byte 2.x headers use for Variable0.  ElementSize is
+// regenerated on encode when it isn't 0.
+type HeaderConfig struct {
+	Version     rom.Hex8
+	Variable0   rom.Hex8  `json:",omitempty"`
+	ElementSize rom.Hex16 `json:",omitempty"`
+}
+
+func (c HeaderConfig) v2() bool {
+	return c.Version >= structVersion2
+}
+
+// HashConfig is a hash structure.  Size is only kept when it doesn't match
+// the digest, which happens in 1.x structures with unused hashes.
+type HashConfig struct {
+	Alg    string
+	Size   *rom.Hex16 `json:",omitempty"`
+	Digest rom.HexBytes
+}
+
+// KeySignatureConfig is a key and signature structure: a public key and the
+// signature made with it.  RSA keys hold the exponent and the modulus, ECC
+// keys and signatures the X and Y (R and S) values, all little-endian.
+type KeySignatureConfig struct {
+	Version    rom.Hex8
+	KeyAlg     string
+	KeyVersion rom.Hex8
+	KeySize    rom.Hex16
+	Exponent   rom.Hex32 `json:",omitempty"`
+	Key        rom.HexBytes
+	SigScheme  string
+	SigVersion rom.Hex8
+	SigKeySize rom.Hex16
+	SigHashAlg string
+	Signature  rom.HexBytes
+}
+
+type keyHeader struct {
+	Version    uint8
+	KeyAlg     uint16
+	KeyVersion uint8
+	KeySize    uint16
+}
+
+type signatureHeader struct {
+	SigScheme  uint16
+	SigVersion uint8
+	SigKeySize uint16
+	SigHashAlg uint16
+}
+
+// keyDataSizes are the sizes of the key and signature data, RSA keys are
+// preceded by a 4 byte exponent.
+func keyDataSizes(keyAlg uint16, keySize, sigKeySize uint16) (uint32, uint32, error) {
+	switch keyAlg {
+	case algRSA:
+		return uint32(keySize) / 8, uint32(sigKeySize) / 8, nil
+	case algECC:
+		return 2 * uint32(keySize) / 8, 2 * uint32(sigKeySize) / 8, nil
+	}
+	return 0, 0, fmt.Errorf("bootguard: unknown key algorithm 0x%04x", keyAlg)
+}
+
+// decoder reads consecutive fields of a structure, the first error is kept
+// and stops all further reads.
+type decoder struct {
+	bs  *bytes.Reader
+	err error
+}
+
+func newDecoder(raw []byte) *decoder {
+	return &decoder{bs: bytes.NewReader(raw)}
+}
+
+func (d *decoder) offset() uint32 {
+	return uint32(d.bs.Size()) - uint32(d.bs.Len())
+}
+
+func (d *decoder) fail(format string, args ...interface{}) {
+	if d.err == nil {
+		d.err = fmt.Errorf("bootguard: "+format, args...)
+	}
+}
+
+func (d *decoder) read(v interface{}) {
+	if d.err != nil {
+		return
+	}
+	offset := d.offset()
+	if err := binary.Read(d.bs, binary.LittleEndian, v); err != nil {
+		d.fail("truncated structure at 0x%x", offset)
+	}
+}
+
+func (d *decoder) bytes(size uint32) rom.HexBytes {
+	if d.err == nil && size > uint32(d.bs.Len()) {
+		d.fail("0x%x bytes at 0x%x run past the end of the structure", size, d.offset())
+	}
+	if d.err != nil {
+		return nil
+	}
+	data := make([]byte, size)
+	d.read(data)
+	return data
+}
+
+// reserved reads reserved bytes, they are only kept when not zero
+func (d *decoder) reserved(size uint32) rom.HexBytes {
+	data := d.bytes(size)
+	if bytes.Equal(data, make([]byte, size)) {
+		return nil
+	}
+	return data
+}
+
+// header reads the structure header and checks its ID
+func (d *decoder) header(id string) HeaderConfig {
+	var h StructHeader
+	d.read(&h)
+	if d.err == nil && string(h.ID[:]) != id {
+		d.fail("expected %v structure, found %q", id, h.ID[:])
+	}
+	c := HeaderConfig{Version: rom.Hex8(h.Version)}
+	if c.v2() {
+		var h2 StructHeaderV2
+		d.read(&h2)
+		c.Variable0, c.ElementSize = rom.Hex8(h2.Variable0), rom.Hex16(h2.ElementSize)
+	}
+	return c
+}
+
+func (d *decoder) hash(v2 bool) HashConfig {
+	var h struct {
+		Alg  uint16
+		Size uint16
+	}
+	d.read(&h)
+	c := HashConfig{Alg: algorithmName(h.Alg)}
+	if v2 {
+		c.Digest = d.bytes(uint32(h.Size))
+		return c
+	}
+	c.Digest = d.bytes(digestSizeV1)
+	if h.Size != digestSizeV1 {
+		size := rom.Hex16(h.Size)
+		c.Size = &size
+	}
+	return c
+}
+
+// hashList reads a 2.x digest list: its size in bytes including the size
+// and count fields, the number of hashes and the hashes.
+func (d *decoder) hashList() []HashConfig {
+	var h struct {
+		Size  uint16
+		Count uint16
+	}
+	start := d.offset()
+	d.read(&h)
+	hashes := []HashConfig{}
+	for n := uint16(0); n < h.Count && d.err == nil; n++ {
+		hashes = append(hashes, d.hash(true))
+	}
+	if d.err == nil && d.offset()-start != uint32(h.Size) {
+		d.fail("digest list at 0x%x is 0x%x bytes, its size is 0x%x", start, d.offset()-start, h.Size)
+	}
+	return hashes
+}
+
+func (d *decoder) keySignature() KeySignatureConfig {
+	var k keyHeader
+	d.read(&k)
+	c := KeySignatureConfig{
+		Version:    rom.Hex8(k.Version),
+		KeyAlg:     algorithmName(k.KeyAlg),
+		KeyVersion: rom.Hex8(k.KeyVersion),
+		KeySize:    rom.Hex16(k.KeySize),
+	}
+	if k.KeyAlg == algRSA {
+		var exponent uint32
+		d.read(&exponent)
+		c.Exponent = rom.Hex32(exponent)
+	}
+	keySize, _, err := keyDataSizes(k.KeyAlg, k.KeySize, 0)
+	if err != nil && d.err == nil {
+		d.err = err
+	}
+	c.Key = d.bytes(keySize)
+
+	var s signatureHeader
+	d.read(&s)
+	c.SigScheme = algorithmName(s.SigScheme)
+	c.SigVersion = rom.Hex8(s.SigVersion)
+	c.SigKeySize = rom.Hex16(s.SigKeySize)
+	c.SigHashAlg = algorithmName(s.SigHashAlg)
+	_, sigSize, _ := keyDataSizes(k.KeyAlg, 0, s.SigKeySize)
+	c.Signature = d.bytes(sigSize)
+	return c
+}
+
+// finish checks the structure was read completely
+func (d *decoder) finish() error {
+	if d.err == nil && d.bs.Len() != 0 {
+		d.fail("0x%x bytes left after the structure", d.bs.Len())
+	}
+	return d.err
+}
+
+// encoder writes the fields of a structure, the first error is kept.
+type encoder struct {
+	b   bytes.Buffer
+	err error
+}
+
+func (e *encoder) fail(err error) {
+	if e.err == nil {
+		e.err = err
+	}
+}
+
+func (e *encoder) write(vs ...interface{}) {
+	for _, v := range vs {
+		binary.Write(&e.b, binary.LittleEndian, v)
+	}
+}
+
+// reserved writes size reserved bytes, zeros unless data is given
+func (e *encoder) reserved(data rom.HexBytes, size int) {
+	if data == nil {
+		data = make([]byte, size)
+	}
+	if len(data) != size {
+		e.fail(fmt.Errorf("bootguard: expected %v reserved bytes, got %v", size, len(data)))
+	}
+	e.write([]byte(data))
+}
+
+func (e *encoder) header(id string, c HeaderConfig) {
+	h := StructHeader{Version: uint8(c.Version)}
+	copy(h.ID[:], id)
+	e.write(h)
+	if c.v2() {
+		e.write(StructHeaderV2{Variable0: uint8(c.Variable0), ElementSize: uint16(c.ElementSize)})
+	}
+}
+
+func (e *encoder) algorithm(name string) uint16 {
+	alg, err := parseAlgorithm(name)
+	if err != nil {
+		e.fail(err)
+	}
+	return alg
+}
+
+func (e *encoder) hash(c HashConfig, v2 bool) {
+	size := uint16(len(c.Digest))
+	if c.Size != nil {
+		size = uint16(*c.Size)
+	}
+	if !v2 && len(c.Digest) != digestSizeV1 {
+		e.fail(fmt.Errorf("bootguard: 1.x digests are %v bytes, got %v", digestSizeV1, len(c.Digest)))
+	}
+	e.write(e.algorithm(c.Alg), size, []byte(c.Digest))
+}
+
+func (e *encoder) hashList(hashes []HashConfig) {
+	size := uint16(4)
+	for _, h := range hashes {
+		size += 4 + uint16(len(h.Digest))
+	}
+	e.write(size, uint16(len(hashes)))
+	for _, h := range hashes {
+		e.hash(h, true)
+	}
+}
+
+func (e *encoder) keySignature(c KeySignatureConfig) {
+	k := keyHeader{
+		Version:    uint8(c.Version),
+		KeyAlg:     e.algorithm(c.KeyAlg),
+		KeyVersion: uint8(c.KeyVersion),
+		KeySize:    uint16(c.KeySize),
+	}
+	s := signatureHeader{
+		SigScheme:  e.algorithm(c.SigScheme),
+		SigVersion: uint8(c.SigVersion),
+		SigKeySize: uint16(c.SigKeySize),
+		SigHashAlg: e.algorithm(c.SigHashAlg),
+	}
+	keySize, sigSize, err := keyDataSizes(k.KeyAlg, k.KeySize, s.SigKeySize)
+	if err != nil {
+		e.fail(err)
+	}
+	if uint32(len(c.Key)) != keySize || uint32(len(c.Signature)) != sigSize {
+		e.fail(fmt.Errorf("bootguard: key (0x%x bytes) and signature (0x%x bytes) don't match the key sizes",
+			len(c.Key), len(c.Signature)))
+	}
+	e.write(k)
+	if k.KeyAlg == algRSA {
+		e.write(uint32(c.Exponent))
+	}
+	e.write([]byte(c.Key), s, []byte(c.Signature))
+}
+
+// finish patches a non-zero ElementSize to the size of the structure
+func (e *encoder) finish(c HeaderConfig) ([]byte, error) {
+	raw := e.b.Bytes()
+	if c.v2() && c.ElementSize != 0 && len(raw) >= structHeaderV2Size {
+		binary.LittleEndian.PutUint16(raw[structHeaderSize+1:], uint16(len(raw)))
+	}
+	return raw, e.err
+}
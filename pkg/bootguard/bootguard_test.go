@@ -0,0 +1,144 @@
+package bootguard
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// the manifests below are laid out like the ones Intel's tools build, with
+// made-up keys and signatures
+
+func pack(values ...interface{}) []byte {
+	var b bytes.Buffer
+	for _, v := range values {
+		if s, ok := v.(string); ok {
+			v = []byte(s)
+		}
+		binary.Write(&b, binary.LittleEndian, v)
+	}
+	return b.Bytes()
+}
+
+func testKeySignature(hashAlg uint16) []byte {
+	return pack(uint8(0x10), uint16(algRSA), uint8(0x10), uint16(2048), uint32(0x10001),
+		bytes.Repeat([]byte{0xa5}, 256),
+		uint16(0x14), uint8(0x10), uint16(2048), hashAlg,
+		bytes.Repeat([]byte{0x5a}, 256))
+}
+
+func hashV1(alg uint16, digest []byte) []byte {
+	return pack(alg, uint16(len(digest)), digest, make([]byte, digestSizeV1-len(digest)))
+}
+
+func hashV2(alg uint16, digest []byte) []byte {
+	return pack(alg, uint16(len(digest)), digest)
+}
+
+func hashList(hashes ...[]byte) []byte {
+	body := bytes.Join(hashes, nil)
+	return pack(uint16(4+len(body)), uint16(len(hashes)), body)
+}
+
+func elementV2(id string, version uint8, body []byte) []byte {
+	return pack(id, version, uint8(0), uint16(structHeaderV2Size+len(body)), body)
+}
+
+func testSegments() []byte {
+	return pack(uint8(3),
+		uint16(0), uint16(0), uint32(0xfffff000), uint32(0x1000),
+		uint16(0), uint16(1), uint32(0xffffe000), uint32(0x800),
+		uint16(0), uint16(0), uint32(0xffffe800), uint32(0x800))
+}
+
+func testManifestsV1() (km, bpm []byte) {
+	bpm = pack(bpmHeaderID, uint8(0x10), uint8(0x01), uint8(0x03), uint8(0x04), uint8(0x02), uint8(0), uint16(3),
+		ibbID, uint8(0x10), uint16(0), uint32(3), uint64(0xfed10000), uint64(0xfed90000),
+		uint32(0x100000), uint32(0xf00000), make([]byte, 16),
+		hashV1(0x10, nil), uint32(0xfffffff0), hashV1(algSHA256, bytes.Repeat([]byte{0x11}, 32)),
+		testSegments(),
+		pmdaID, uint8(0x10), uint16(8), "PMDATEST",
+		pmsgID, uint8(0x10), testKeySignature(algSHA256))
+	km = pack(kmID, uint8(0x10), uint8(0x01), uint8(0x02), uint8(0x0f),
+		hashV1(algSHA256, bytes.Repeat([]byte{0x22}, 32)),
+		testKeySignature(algSHA256))
+	return km, bpm
+}
+
+func testManifestsV2() (km, bpm []byte) {
+	ibbs := pack(uint8(0), uint8(0), uint8(0), uint8(0x0f), uint32(3), uint64(0xfed10000), uint64(0xfed90000),
+		uint32(0x100000), uint32(0xf00000), uint64(0x100000000), uint64(0x200000000),
+		hashV2(0x10, nil), uint32(0xfffffff0),
+		hashList(hashV2(algSHA256, bytes.Repeat([]byte{0x11}, 32)), hashV2(algSHA384, bytes.Repeat([]byte{0x33}, 48))),
+		hashV2(algSHA256, make([]byte, 32)), make([]byte, 3), testSegments())
+	txt := pack(uint8(0), uint8(0), uint8(0), uint8(0), uint32(0), uint16(0), uint8(0x2a), uint8(0x2b),
+		uint16(0x400), make([]byte, 2), uint32(0xfe000000), hashList(), make([]byte, 4))
+	body := bytes.Join([][]byte{
+		elementV2(ibbID, 0x20, ibbs),
+		elementV2(txtID, 0x21, txt),
+		elementV2(pcdID, 0x20, pack(make([]byte, 2), uint16(6), "PCDPCD")),
+		elementV2("__PFRS__", 0x21, []byte{1, 2, 3, 4}),
+		elementV2(pmdaID, 0x20, pack(make([]byte, 2), uint16(8), "PMDATEST")),
+	}, nil)
+	pmsg := structHeaderV2Size + 8 + len(body)
+	bpm = pack(bpmHeaderID, uint8(0x23), uint8(0x20), uint16(structHeaderV2Size+8),
+		uint16(pmsg+structHeaderV2Size), uint8(0x03), uint8(0x04), uint8(0x02), uint8(0), uint16(3),
+		body,
+		pmsgID, uint8(0x20), uint8(0), uint16(0), testKeySignature(algSHA384))
+
+	hashes := pack(uint64(kmUsageBpmKey), hashV2(algSHA384, bytes.Repeat([]byte{0x44}, 48)),
+		uint64(4), hashV2(algSHA256, bytes.Repeat([]byte{0x55}, 32)))
+	km = pack(kmID, uint8(0x21), uint8(0), uint16(0),
+		uint16(structHeaderV2Size+12+len(hashes)), make([]byte, 3), uint8(0x01), uint8(0x02), uint8(0x0f),
+		uint16(algSHA384), uint16(2), hashes,
+		testKeySignature(algSHA384))
+	return km, bpm
+}
+
+func TestManifestRoundTrip(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		manifests func() ([]byte, []byte)
+	}{
+		{"v1", testManifestsV1},
+		{"v2", testManifestsV2},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rawKM, rawBPM := tt.manifests()
+			km, err := ParseKeyManifest(rawKM)
+			if err != nil {
+				t.Fatalf("ParseKeyManifest() err=%v", err)
+			}
+			if km.Size != uint32(len(rawKM)) || len(km.BpmKeyHashes()) != 1 {
+				t.Errorf("ParseKeyManifest() = %+v", km)
+			}
+			checkEncode(t, "KM", km.Config, rawKM[:km.SignedSize])
+			checkEncode(t, "KM signature", km.Signature, rawKM[km.SignedSize:])
+
+			bpm, err := ParseBootPolicyManifest(rawBPM)
+			if err != nil {
+				t.Fatalf("ParseBootPolicyManifest() err=%v", err)
+			}
+			if bpm.Size != uint32(len(rawBPM)) || len(bpm.IBBs) != 1 || len(bpm.IBBs[0].Segments) != 3 {
+				t.Errorf("ParseBootPolicyManifest() = %+v", bpm)
+			}
+			for _, e := range bpm.Elements {
+				if e.Config != nil {
+					checkEncode(t, e.ID, e.Config, rawBPM[e.Offset:e.Offset+e.Size])
+				}
+			}
+		})
+	}
+}
+
+func checkEncode(t *testing.T, name string, c elementConfig, raw []byte) {
+	t.Helper()
+	encoded, err := c.Encode()
+	if err != nil {
+		t.Errorf("%v: Encode() err=%v", name, err)
+		return
+	}
+	if !bytes.Equal(encoded, raw) {
+		t.Errorf("%v: Encode() = %x, want %x", name, encoded, raw)
+	}
+}
@@ -0,0 +1,583 @@
+package bootguard
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/flammit/fwtools/pkg/rom"
+)
+
+const (
+	bpmHeaderID    = "__ACBP__"
+	ibbID          = "__IBBS__"
+	txtID          = "__TXTS__"
+	pcdID          = "__PCDS__"
+	pmdaID         = "__PMDA__"
+	pmsgID         = "__PMSG__"
+	maxBpmElements = 32
+)
+
+// BpmHeaderConfig is the BPMH, the first element of a BPM.  2.x headers
+// give the offset of the key and signature in the PMSG element.
+type BpmHeaderConfig struct {
+	HeaderConfig
+	KeySignatureOffset rom.Hex16 `json:",omitempty"`
+	Revision           rom.Hex8
+	SVN                rom.Hex8
+	ACMSVN             rom.Hex8
+	Reserved           rom.Hex8 `json:",omitempty"`
+	NEMDataStack       rom.Hex16
+}
+
+type bpmHeaderFields struct {
+	Revision     uint8
+	SVN          uint8
+	ACMSVN       uint8
+	Reserved     uint8
+	NEMDataStack uint16
+}
+
+func decodeBpmHeader(d *decoder) elementConfig {
+	c := &BpmHeaderConfig{HeaderConfig: d.header(bpmHeaderID)}
+	if c.v2() {
+		var offset uint16
+		d.read(&offset)
+		c.KeySignatureOffset = rom.Hex16(offset)
+	} else {
+		var version uint8
+		d.read(&version)
+		c.Variable0 = rom.Hex8(version)
+	}
+	var h bpmHeaderFields
+	d.read(&h)
+	c.Revision, c.SVN, c.ACMSVN = rom.Hex8(h.Revision), rom.Hex8(h.SVN), rom.Hex8(h.ACMSVN)
+	c.Reserved, c.NEMDataStack = rom.Hex8(h.Reserved), rom.Hex16(h.NEMDataStack)
+	return c
+}
+
+func (c BpmHeaderConfig) Encode() ([]byte, error) {
+	e := &encoder{}
+	e.header(bpmHeaderID, c.HeaderConfig)
+	if c.v2() {
+		e.write(uint16(c.KeySignatureOffset))
+	} else {
+		e.write(uint8(c.Variable0))
+	}
+	e.write(bpmHeaderFields{
+		Revision:     uint8(c.Revision),
+		SVN:          uint8(c.SVN),
+		ACMSVN:       uint8(c.ACMSVN),
+		Reserved:     uint8(c.Reserved),
+		NEMDataStack: uint16(c.NEMDataStack),
+	})
+	return e.finish(c.HeaderConfig)
+}
+
+// IbbConfig is an IBB (initial boot block) element: the memory ranges the
+// ACM hashes before running the BIOS and their expected digests.  1.x
+// elements have a single digest and DMAProtBase0/DMAProtLimit0 hold the
+// PMRL base and limit.
+type IbbConfig struct {
+	HeaderConfig
+	SetNumber     rom.Hex8 `json:",omitempty"`
+	PBETValue     rom.Hex8 `json:",omitempty"`
+	Flags         rom.Hex32
+	MCHBAR        rom.Hex64
+	VTdBAR        rom.Hex64
+	DMAProtBase0  rom.Hex32
+	DMAProtLimit0 rom.Hex32
+	DMAProtBase1  rom.Hex64 `json:",omitempty"`
+	DMAProtLimit1 rom.Hex64 `json:",omitempty"`
+	PostIBBHash   HashConfig
+	EntryPoint    rom.Hex32
+	Digests       []HashConfig
+	OBBHash       *HashConfig `json:",omitempty"`
+	Segments      []IbbSegmentConfig
+	Reserved      rom.HexBytes `json:",omitempty"`
+}
+
+// IbbSegment flags: segments with bit 0 set are not hashed
+const ibbSegmentNotHashed = 1 << 0
+
+type IbbSegment struct {
+	Reserved uint16
+	Flags    uint16
+	Base     uint32
+	Size     uint32
+}
+
+type IbbSegmentConfig struct {
+	Flags    rom.Hex16
+	Base     rom.Hex32
+	Size     rom.Hex32
+	Reserved rom.Hex16 `json:",omitempty"`
+}
+
+// Hashed is false for segments that are covered by the IBB but not hashed
+func (c IbbSegmentConfig) Hashed() bool {
+	return c.Flags&ibbSegmentNotHashed == 0
+}
+
+type ibbFieldsV1 struct {
+	Reserved0 [2]uint8
+	Flags     uint32
+	MCHBAR    uint64
+	VTdBAR    uint64
+	PMRLBase  uint32
+	PMRLLimit uint32
+	Reserved1 [16]uint8
+}
+
+type ibbFieldsV2 struct {
+	Reserved0     uint8
+	SetNumber     uint8
+	Reserved1     uint8
+	PBETValue     uint8
+	Flags         uint32
+	MCHBAR        uint64
+	VTdBAR        uint64
+	DMAProtBase0  uint32
+	DMAProtLimit0 uint32
+	DMAProtBase1  uint64
+	DMAProtLimit1 uint64
+}
+
+func decodeIbb(d *decoder) elementConfig {
+	c := &IbbConfig{HeaderConfig: d.header(ibbID)}
+	reserved := []byte{}
+	if c.v2() {
+		var f ibbFieldsV2
+		d.read(&f)
+		c.SetNumber, c.PBETValue = rom.Hex8(f.SetNumber), rom.Hex8(f.PBETValue)
+		c.Flags, c.MCHBAR, c.VTdBAR = rom.Hex32(f.Flags), rom.Hex64(f.MCHBAR), rom.Hex64(f.VTdBAR)
+		c.DMAProtBase0, c.DMAProtLimit0 = rom.Hex32(f.DMAProtBase0), rom.Hex32(f.DMAProtLimit0)
+		c.DMAProtBase1, c.DMAProtLimit1 = rom.Hex64(f.DMAProtBase1), rom.Hex64(f.DMAProtLimit1)
+		reserved = append(reserved, f.Reserved0, f.Reserved1)
+	} else {
+		var f ibbFieldsV1
+		d.read(&f)
+		c.Flags, c.MCHBAR, c.VTdBAR = rom.Hex32(f.Flags), rom.Hex64(f.MCHBAR), rom.Hex64(f.VTdBAR)
+		c.DMAProtBase0, c.DMAProtLimit0 = rom.Hex32(f.PMRLBase), rom.Hex32(f.PMRLLimit)
+		reserved = append(append(reserved, f.Reserved0[:]...), f.Reserved1[:]...)
+	}
+	c.PostIBBHash = d.hash(c.v2())
+	var entryPoint uint32
+	d.read(&entryPoint)
+	c.EntryPoint = rom.Hex32(entryPoint)
+	if c.v2() {
+		c.Digests = d.hashList()
+		obbHash := d.hash(true)
+		c.OBBHash = &obbHash
+		reserved = append(reserved, d.bytes(3)...)
+	} else {
+		c.Digests = []HashConfig{d.hash(false)}
+	}
+	if !bytes.Equal(reserved, make([]byte, len(reserved))) {
+		c.Reserved = reserved
+	}
+
+	var numSegments uint8
+	d.read(&numSegments)
+	segments := make([]IbbSegment, numSegments)
+	d.read(segments)
+	c.Segments = []IbbSegmentConfig{}
+	for _, s := range segments {
+		c.Segments = append(c.Segments, IbbSegmentConfig{
+			Flags:    rom.Hex16(s.Flags),
+			Base:     rom.Hex32(s.Base),
+			Size:     rom.Hex32(s.Size),
+			Reserved: rom.Hex16(s.Reserved),
+		})
+	}
+	return c
+}
+
+func (c IbbConfig) Encode() ([]byte, error) {
+	e := &encoder{}
+	e.header(ibbID, c.HeaderConfig)
+	reservedSize := 18
+	if c.v2() {
+		reservedSize = 5
+	}
+	reserved := c.Reserved
+	if reserved == nil {
+		reserved = make([]byte, reservedSize)
+	}
+	if len(reserved) != reservedSize {
+		return nil, fmt.Errorf("bootguard: IBB element needs %v reserved bytes, got %v",
+			reservedSize, len(reserved))
+	}
+
+	if c.v2() {
+		e.write(ibbFieldsV2{
+			Reserved0:     reserved[0],
+			SetNumber:     uint8(c.SetNumber),
+			Reserved1:     reserved[1],
+			PBETValue:     uint8(c.PBETValue),
+			Flags:         uint32(c.Flags),
+			MCHBAR:        uint64(c.MCHBAR),
+			VTdBAR:        uint64(c.VTdBAR),
+			DMAProtBase0:  uint32(c.DMAProtBase0),
+			DMAProtLimit0: uint32(c.DMAProtLimit0),
+			DMAProtBase1:  uint64(c.DMAProtBase1),
+			DMAProtLimit1: uint64(c.DMAProtLimit1),
+		})
+	} else {
+		f := ibbFieldsV1{
+			Flags:     uint32(c.Flags),
+			MCHBAR:    uint64(c.MCHBAR),
+			VTdBAR:    uint64(c.VTdBAR),
+			PMRLBase:  uint32(c.DMAProtBase0),
+			PMRLLimit: uint32(c.DMAProtLimit0),
+		}
+		copy(f.Reserved0[:], reserved)
+		copy(f.Reserved1[:], reserved[2:])
+		e.write(f)
+	}
+	e.hash(c.PostIBBHash, c.v2())
+	e.write(uint32(c.EntryPoint))
+	if c.v2() {
+		if c.OBBHash == nil {
+			return nil, fmt.Errorf("bootguard: 2.x IBB element needs an OBBHash")
+		}
+		e.hashList(c.Digests)
+		e.hash(*c.OBBHash, true)
+		e.write(reserved[2:])
+	} else {
+		if len(c.Digests) != 1 {
+			return nil, fmt.Errorf("bootguard: 1.x IBB element needs a single digest, got %v", len(c.Digests))
+		}
+		e.hash(c.Digests[0], false)
+	}
+
+	if len(c.Segments) > 0xff {
+		return nil, fmt.Errorf("bootguard: too many IBB segments: %v", len(c.Segments))
+	}
+	e.write(uint8(len(c.Segments)))
+	for _, s := range c.Segments {
+		e.write(IbbSegment{
+			Reserved: uint16(s.Reserved),
+			Flags:    uint16(s.Flags),
+			Base:     uint32(s.Base),
+			Size:     uint32(s.Size),
+		})
+	}
+	return e.finish(c.HeaderConfig)
+}
+
+// TxtConfig is the 2.x TXT element.  Trailer holds the bytes after the
+// digest list up to ElementSize.
+type TxtConfig struct {
+	HeaderConfig
+	SetNumber       rom.Hex8 `json:",omitempty"`
+	SInitMinSVNAuth rom.Hex8
+	ControlFlags    rom.Hex32
+	PwrDownInterval rom.Hex16
+	PTTCMOSOffset0  rom.Hex8
+	PTTCMOSOffset1  rom.Hex8
+	ACPIBaseOffset  rom.Hex16
+	PwrMBaseOffset  rom.Hex32
+	Digests         []HashConfig
+	Trailer         rom.HexBytes `json:",omitempty"`
+	Reserved        rom.HexBytes `json:",omitempty"`
+}
+
+type txtFields struct {
+	Reserved0       uint8
+	SetNumber       uint8
+	SInitMinSVNAuth uint8
+	Reserved1       uint8
+	ControlFlags    uint32
+	PwrDownInterval uint16
+	PTTCMOSOffset0  uint8
+	PTTCMOSOffset1  uint8
+	ACPIBaseOffset  uint16
+	Reserved2       [2]uint8
+	PwrMBaseOffset  uint32
+}
+
+func decodeTxt(d *decoder) elementConfig {
+	c := &TxtConfig{HeaderConfig: d.header(txtID)}
+	if d.err == nil && !c.v2() {
+		d.fail("unsupported TXT element version 0x%02x", uint8(c.Version))
+	}
+	var f txtFields
+	d.read(&f)
+	c.SetNumber, c.SInitMinSVNAuth = rom.Hex8(f.SetNumber), rom.Hex8(f.SInitMinSVNAuth)
+	c.ControlFlags, c.PwrDownInterval = rom.Hex32(f.ControlFlags), rom.Hex16(f.PwrDownInterval)
+	c.PTTCMOSOffset0, c.PTTCMOSOffset1 = rom.Hex8(f.PTTCMOSOffset0), rom.Hex8(f.PTTCMOSOffset1)
+	c.ACPIBaseOffset, c.PwrMBaseOffset = rom.Hex16(f.ACPIBaseOffset), rom.Hex32(f.PwrMBaseOffset)
+	reserved := []byte{f.Reserved0, f.Reserved1, f.Reserved2[0], f.Reserved2[1]}
+	if !bytes.Equal(reserved, make([]byte, len(reserved))) {
+		c.Reserved = reserved
+	}
+	c.Digests = d.hashList()
+	if d.err == nil && uint32(c.ElementSize) > d.offset() {
+		c.Trailer = d.bytes(uint32(c.ElementSize) - d.offset())
+	}
+	return c
+}
+
+func (c TxtConfig) Encode() ([]byte, error) {
+	e := &encoder{}
+	e.header(txtID, c.HeaderConfig)
+	reserved := c.Reserved
+	if reserved == nil {
+		reserved = make([]byte, 4)
+	}
+	if len(reserved) != 4 {
+		return nil, fmt.Errorf("bootguard: TXT element needs 4 reserved bytes, got %v", len(reserved))
+	}
+	e.write(txtFields{
+		Reserved0:       reserved[0],
+		SetNumber:       uint8(c.SetNumber),
+		SInitMinSVNAuth: uint8(c.SInitMinSVNAuth),
+		Reserved1:       reserved[1],
+		ControlFlags:    uint32(c.ControlFlags),
+		PwrDownInterval: uint16(c.PwrDownInterval),
+		PTTCMOSOffset0:  uint8(c.PTTCMOSOffset0),
+		PTTCMOSOffset1:  uint8(c.PTTCMOSOffset1),
+		ACPIBaseOffset:  uint16(c.ACPIBaseOffset),
+		Reserved2:       [2]uint8{reserved[2], reserved[3]},
+		PwrMBaseOffset:  uint32(c.PwrMBaseOffset),
+	})
+	e.hashList(c.Digests)
+	e.write([]byte(c.Trailer))
+	return e.finish(c.HeaderConfig)
+}
+
+// DataConfig is an element holding opaque data: the platform configuration
+// data (PCD) element and the platform manufacturer data (PMDA) element.
+type DataConfig struct {
+	HeaderConfig
+	Reserved rom.HexBytes `json:",omitempty"`
+	Data     rom.HexBytes
+}
+
+// decodeData reads the data size and the data, 2.x elements have 2
+// reserved bytes before the size.
+func decodeData(d *decoder, id string) *DataConfig {
+	c := &DataConfig{HeaderConfig: d.header(id)}
+	if c.v2() {
+		c.Reserved = d.reserved(2)
+	}
+	var size uint16
+	d.read(&size)
+	c.Data = d.bytes(uint32(size))
+	return c
+}
+
+func (c DataConfig) encode(id string) ([]byte, error) {
+	e := &encoder{}
+	e.header(id, c.HeaderConfig)
+	if c.v2() {
+		e.reserved(c.Reserved, 2)
+	}
+	if len(c.Data) > 0xffff {
+		return nil, fmt.Errorf("bootguard: %v data is too large: 0x%x", id, len(c.Data))
+	}
+	e.write(uint16(len(c.Data)), []byte(c.Data))
+	return e.finish(c.HeaderConfig)
+}
+
+type PcdConfig struct{ DataConfig }
+type PmdaConfig struct{ DataConfig }
+
+func decodePcd(d *decoder) elementConfig {
+	return &PcdConfig{*decodeData(d, pcdID)}
+}
+
+func (c PcdConfig) Encode() ([]byte, error) {
+	return c.encode(pcdID)
+}
+
+func decodePmda(d *decoder) elementConfig {
+	return &PmdaConfig{*decodeData(d, pmdaID)}
+}
+
+func (c PmdaConfig) Encode() ([]byte, error) {
+	return c.encode(pmdaID)
+}
+
+// PmsgConfig is the signature element that ends the BPM
+type PmsgConfig struct {
+	HeaderConfig
+	KeySignature KeySignatureConfig
+}
+
+func decodePmsg(d *decoder) elementConfig {
+	c := &PmsgConfig{HeaderConfig: d.header(pmsgID)}
+	c.KeySignature = d.keySignature()
+	return c
+}
+
+func (c PmsgConfig) Encode() ([]byte, error) {
+	e := &encoder{}
+	e.header(pmsgID, c.HeaderConfig)
+	e.keySignature(c.KeySignature)
+	return e.finish(c.HeaderConfig)
+}
+
+// Element is a BPM element at Offset of the manifest, Config is nil for
+// unknown 2.x elements.
+type Element struct {
+	ID     string
+	Offset uint32
+	Size   uint32
+	Config elementConfig
+}
+
+// BootPolicyManifest is a decoded BPM.  The signature covers the first
+// SignedSize bytes, everything before the key and signature in the PMSG
+// element.
+type BootPolicyManifest struct {
+	Header     *BpmHeaderConfig
+	IBBs       []*IbbConfig
+	Signature  *KeySignatureConfig
+	Elements   []Element
+	SignedSize uint32
+	Size       uint32
+}
+
+// ParseBootPolicyManifest decodes the elements of the BPM at the start of
+// raw up to its PMSG element.  Unknown 2.x elements are skipped using
+// their element size, unknown 1.x elements end parsing.
+func ParseBootPolicyManifest(raw []byte) (*BootPolicyManifest, error) {
+	bpm := &BootPolicyManifest{}
+	offset := uint32(0)
+	for bpm.Signature == nil {
+		if len(bpm.Elements) == maxBpmElements {
+			return nil, fmt.Errorf("bootguard: BPM has more than %v elements", maxBpmElements)
+		}
+		if uint64(offset)+structHeaderSize > uint64(len(raw)) {
+			return nil, fmt.Errorf("bootguard: BPM ends at 0x%x without a signature element", offset)
+		}
+		id := string(raw[offset : offset+structIDSize])
+		if len(bpm.Elements) == 0 && id != bpmHeaderID {
+			return nil, fmt.Errorf("bootguard: BPM doesn't start with a %v element", bpmHeaderID)
+		}
+		elementRaw := raw[offset:]
+		size := uint32(0)
+		if raw[offset+structIDSize] >= structVersion2 && uint64(offset)+structHeaderV2Size <= uint64(len(raw)) {
+			size = uint32(binary.LittleEndian.Uint16(raw[offset+structHeaderSize+1:]))
+			if uint64(offset)+uint64(size) > uint64(len(raw)) {
+				return nil, fmt.Errorf("bootguard: BPM element %q at 0x%x runs past the end: size=0x%x",
+					id, offset, size)
+			}
+			if size != 0 {
+				elementRaw = raw[offset : offset+size]
+			}
+		}
+
+		e, ok := elements[id]
+		if !ok || id == kmID {
+			if size == 0 {
+				return nil, fmt.Errorf("bootguard: unknown BPM element %q at 0x%x", id, offset)
+			}
+			bpm.Elements = append(bpm.Elements, Element{ID: id, Offset: offset, Size: size})
+			offset += size
+			continue
+		}
+		d := newDecoder(elementRaw)
+		c := e.decode(d)
+		if d.err == nil && size != 0 && d.offset() != size {
+			d.fail("%v element at 0x%x is 0x%x bytes, its size is 0x%x", id, offset, d.offset(), size)
+		}
+		if d.err != nil {
+			return nil, d.err
+		}
+		size = d.offset()
+
+		switch c := c.(type) {
+		case *BpmHeaderConfig:
+			if bpm.Header != nil {
+				return nil, fmt.Errorf("bootguard: BPM has a second %v element at 0x%x", id, offset)
+			}
+			bpm.Header = c
+		case *IbbConfig:
+			bpm.IBBs = append(bpm.IBBs, c)
+		case *PmsgConfig:
+			bpm.Signature = &c.KeySignature
+			bpm.SignedSize = offset + structHeaderSize
+			if c.v2() {
+				bpm.SignedSize = offset + structHeaderV2Size
+			}
+		}
+		bpm.Elements = append(bpm.Elements, Element{ID: id, Offset: offset, Size: size, Config: c})
+		offset += size
+	}
+	bpm.Size = offset
+	if bpm.Header.v2() && uint32(bpm.Header.KeySignatureOffset) != bpm.SignedSize {
+		return nil, fmt.Errorf("bootguard: BPM key signature offset 0x%x doesn't match the PMSG element at 0x%x",
+			uint16(bpm.Header.KeySignatureOffset), bpm.SignedSize)
+	}
+	return bpm, nil
+}
+
+func (bpm BootPolicyManifest) Metadata() map[string]string {
+	m := map[string]string{
+		"version":  fmt.Sprintf("0x%02x", uint8(bpm.Header.Version)),
+		"revision": fmt.Sprintf("0x%02x", uint8(bpm.Header.Revision)),
+		"svn":      fmt.Sprintf("%d", bpm.Header.SVN),
+		"acm_svn":  fmt.Sprintf("%d", bpm.Header.ACMSVN),
+		"key":      keyString(bpm.Signature),
+	}
+	segments, digests := []string{}, []string{}
+	for _, ibb := range bpm.IBBs {
+		for _, s := range ibb.Segments {
+			segments = append(segments, fmt.Sprintf("0x%08x+0x%x", uint32(s.Base), uint32(s.Size)))
+		}
+		for _, h := range ibb.Digests {
+			digests = append(digests, h.Alg+":"+hex.EncodeToString(h.Digest))
+		}
+	}
+	if len(bpm.IBBs) > 0 {
+		m["ibb_entry_point"] = fmt.Sprintf("0x%08x", uint32(bpm.IBBs[0].EntryPoint))
+		m["ibb_segments"] = strings.Join(segments, " ")
+		m["ibb_digest"] = strings.Join(digests, " ")
+	}
+	return m
+}
+
+// DetectBPM splits a boot policy manifest into its elements
+func DetectBPM(unknownRegion *rom.Region) ([]*rom.Region, rom.Diagnostics) {
+	var diags rom.Diagnostics
+	if !strings.HasPrefix(string(unknownRegion.Raw), bpmHeaderID) {
+		return nil, nil
+	}
+	bpm, err := ParseBootPolicyManifest(unknownRegion.Raw)
+	if err != nil {
+		diags.Warnf(detectorName, unknownRegion.Offset, "invalid boot policy manifest: err=%v", err)
+		return nil, diags
+	}
+
+	regions := []*rom.Region{}
+	count := map[string]int{}
+	for _, element := range bpm.Elements {
+		regionType, name := "raw", elementName(element.ID)
+		if e, ok := elements[element.ID]; ok {
+			regionType = e.regionType
+		}
+		if n := count[name]; n > 0 {
+			name = fmt.Sprintf("%v_%d", name, n)
+		}
+		count[elementName(element.ID)]++
+		regions = append(regions, unknownRegion.Child(unknownRegion.Offset+element.Offset,
+			element.Size, regionType, name))
+	}
+	return regions, diags
+}
+
+// elementName is the element ID without the underscores, e.g. "ibbs"
+func elementName(id string) string {
+	name := strings.ToLower(strings.Trim(id, "_"))
+	for _, c := range name {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') {
+			return "element"
+		}
+	}
+	return name
+}
@@ -0,0 +1,65 @@
+package bootguard
+
+import (
+	"github.com/flammit/fwtools/pkg/rom"
+)
+
+// elementConfig is the editable form of a structure, it is encoded back
+// into the exact bytes it was decoded from.
+type elementConfig interface {
+	Encode() ([]byte, error)
+}
+
+type element struct {
+	regionType string
+	new        func() elementConfig
+	decode     func(d *decoder) elementConfig
+}
+
+var elements = map[string]element{
+	kmID:        {"bootguard_km", func() elementConfig { return &KeyManifestConfig{} }, decodeKeyManifest},
+	bpmHeaderID: {"bootguard_bpmh", func() elementConfig { return &BpmHeaderConfig{} }, decodeBpmHeader},
+	ibbID:       {"bootguard_ibb", func() elementConfig { return &IbbConfig{} }, decodeIbb},
+	txtID:       {"bootguard_txt", func() elementConfig { return &TxtConfig{} }, decodeTxt},
+	pcdID:       {"bootguard_pcd", func() elementConfig { return &PcdConfig{} }, decodePcd},
+	pmdaID:      {"bootguard_pmda", func() elementConfig { return &PmdaConfig{} }, decodePmda},
+	pmsgID:      {"bootguard_pmsg", func() elementConfig { return &PmsgConfig{} }, decodePmsg},
+}
+
+func init() {
+	for _, e := range elements {
+		registerElement(e)
+	}
+	// the KM key and signature has no header of its own
+	registerElement(element{
+		regionType: "bootguard_signature",
+		new:        func() elementConfig { return &KeySignatureConfig{} },
+		decode: func(d *decoder) elementConfig {
+			c := d.keySignature()
+			return &c
+		},
+	})
+}
+
+func registerElement(e element) {
+	rom.RegisterHandler(e.regionType, rom.StructHandler{
+		New: func() interface{} { return e.new() },
+		Decode: func(r *rom.Region) (interface{}, error) {
+			d := newDecoder(r.Raw)
+			c := e.decode(d)
+			if err := d.finish(); err != nil {
+				return nil, err
+			}
+			return c, nil
+		},
+		Encode: func(r *rom.Region, v interface{}) ([]byte, error) {
+			return v.(elementConfig).Encode()
+		},
+	})
+}
+
+func (c KeySignatureConfig) Encode() ([]byte, error) {
+	e := &encoder{}
+	e.keySignature(c)
+	return e.b.Bytes(), e.err
+}
@@ -0,0 +1,187 @@
+package bootguard
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/flammit/fwtools/pkg/rom"
+)
+
+const (
+	kmID = "__KEYM__"
+	// key hash usage bit of the BPM signing key in 2.x manifests
+	kmUsageBpmKey = 1 << 0
+)
+
+// KeyManifestConfig is the KM up to its key and signature.  1.x manifests
+// hold the hash of the BPM signing key, 2.x manifests a list of key hashes
+// with usage bits.
+type KeyManifestConfig struct {
+	HeaderConfig
+	KeySignatureOffset rom.Hex16    `json:",omitempty"`
+	Reserved           rom.HexBytes `json:",omitempty"`
+	Revision           rom.Hex8
+	SVN                rom.Hex8
+	KMID               rom.Hex8
+	BpKeyHash          *HashConfig     `json:",omitempty"`
+	PubKeyHashAlg      string          `json:",omitempty"`
+	KeyHashes          []KeyHashConfig `json:",omitempty"`
+}
+
+type KeyHashConfig struct {
+	Usage rom.Hex64
+	Hash  HashConfig
+}
+
+type keyManifestV1 struct {
+	Revision uint8
+	SVN      uint8
+	KMID     uint8
+}
+
+type keyManifestV2 struct {
+	KeySignatureOffset uint16
+	Reserved           [3]uint8
+	Revision           uint8
+	SVN                uint8
+	KMID               uint8
+	PubKeyHashAlg      uint16
+	NumKeyHashes       uint16
+}
+
+func decodeKeyManifest(d *decoder) elementConfig {
+	c := &KeyManifestConfig{HeaderConfig: d.header(kmID)}
+	if !c.v2() {
+		var km keyManifestV1
+		d.read(&km)
+		c.Revision, c.SVN, c.KMID = rom.Hex8(km.Revision), rom.Hex8(km.SVN), rom.Hex8(km.KMID)
+		hash := d.hash(false)
+		c.BpKeyHash = &hash
+		return c
+	}
+
+	var km keyManifestV2
+	d.read(&km)
+	c.KeySignatureOffset = rom.Hex16(km.KeySignatureOffset)
+	if km.Reserved != [3]uint8{} {
+		c.Reserved = km.Reserved[:]
+	}
+	c.Revision, c.SVN, c.KMID = rom.Hex8(km.Revision), rom.Hex8(km.SVN), rom.Hex8(km.KMID)
+	c.PubKeyHashAlg = algorithmName(km.PubKeyHashAlg)
+	for n := uint16(0); n < km.NumKeyHashes && d.err == nil; n++ {
+		var usage uint64
+		d.read(&usage)
+		c.KeyHashes = append(c.KeyHashes, KeyHashConfig{Usage: rom.Hex64(usage), Hash: d.hash(true)})
+	}
+	return c
+}
+
+func (c KeyManifestConfig) Encode() ([]byte, error) {
+	e := &encoder{}
+	e.header(kmID, c.HeaderConfig)
+	if !c.v2() {
+		if c.BpKeyHash == nil {
+			return nil, fmt.Errorf("bootguard: 1.x key manifest needs a BpKeyHash")
+		}
+		e.write(keyManifestV1{
+			Revision: uint8(c.Revision),
+			SVN:      uint8(c.SVN),
+			KMID:     uint8(c.KMID),
+		})
+		e.hash(*c.BpKeyHash, false)
+		return e.finish(c.HeaderConfig)
+	}
+
+	e.write(uint16(c.KeySignatureOffset))
+	e.reserved(c.Reserved, 3)
+	e.write(uint8(c.Revision), uint8(c.SVN), uint8(c.KMID),
+		e.algorithm(c.PubKeyHashAlg), uint16(len(c.KeyHashes)))
+	for _, h := range c.KeyHashes {
+		e.write(uint64(h.Usage))
+		e.hash(h.Hash, true)
+	}
+	return e.finish(c.HeaderConfig)
+}
+
+// KeyManifest is a decoded KM.  The signature covers the first SignedSize
+// bytes, everything before the key and signature.
+type KeyManifest struct {
+	Config     *KeyManifestConfig
+	Signature  *KeySignatureConfig
+	SignedSize uint32
+	Size       uint32
+}
+
+// ParseKeyManifest decodes the KM at the start of raw
+func ParseKeyManifest(raw []byte) (*KeyManifest, error) {
+	d := newDecoder(raw)
+	c := decodeKeyManifest(d).(*KeyManifestConfig)
+	signedSize := d.offset()
+	if d.err == nil && c.v2() && uint32(c.KeySignatureOffset) != signedSize {
+		d.fail("KM key signature offset 0x%x doesn't follow the key hashes at 0x%x",
+			uint16(c.KeySignatureOffset), signedSize)
+	}
+	signature := d.keySignature()
+	if d.err != nil {
+		return nil, d.err
+	}
+	return &KeyManifest{
+		Config:     c,
+		Signature:  &signature,
+		SignedSize: signedSize,
+		Size:       d.offset(),
+	}, nil
+}
+
+// BpmKeyHashes are the hashes of the keys allowed to sign the BPM
+func (km KeyManifest) BpmKeyHashes() []HashConfig {
+	if km.Config.BpKeyHash != nil {
+		return []HashConfig{*km.Config.BpKeyHash}
+	}
+	hashes := []HashConfig{}
+	for _, h := range km.Config.KeyHashes {
+		if h.Usage&kmUsageBpmKey != 0 {
+			hashes = append(hashes, h.Hash)
+		}
+	}
+	return hashes
+}
+
+func (km KeyManifest) Metadata() map[string]string {
+	hashes := []string{}
+	for _, h := range km.BpmKeyHashes() {
+		hashes = append(hashes, h.Alg+":"+hex.EncodeToString(h.Digest))
+	}
+	return map[string]string{
+		"version":      fmt.Sprintf("0x%02x", uint8(km.Config.Version)),
+		"revision":     fmt.Sprintf("0x%02x", uint8(km.Config.Revision)),
+		"svn":          fmt.Sprintf("%d", km.Config.SVN),
+		"kmid":         fmt.Sprintf("0x%02x", uint8(km.Config.KMID)),
+		"key":          keyString(km.Signature),
+		"bpm_key_hash": strings.Join(hashes, " "),
+	}
+}
+
+func keyString(s *KeySignatureConfig) string {
+	return fmt.Sprintf("%v%d", s.KeyAlg, s.KeySize)
+}
+
+// DetectKM splits a key manifest into the manifest and its key and
+// signature.
+func DetectKM(unknownRegion *rom.Region) ([]*rom.Region, rom.Diagnostics) {
+	var diags rom.Diagnostics
+	if !strings.HasPrefix(string(unknownRegion.Raw), kmID) {
+		return nil, nil
+	}
+	km, err := ParseKeyManifest(unknownRegion.Raw)
+	if err != nil {
+		diags.Warnf(detectorName, unknownRegion.Offset, "invalid key manifest: err=%v", err)
+		return nil, diags
+	}
+	base := unknownRegion.Offset
+	return []*rom.Region{
+		unknownRegion.Child(base, km.SignedSize, "bootguard_km", "keym"),
+		unknownRegion.Child(base+km.SignedSize, km.Size-km.SignedSize, "bootguard_signature", "signature"),
+	}, diags
+}
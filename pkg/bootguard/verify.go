@@ -0,0 +1,160 @@
+package bootguard
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+)
+
+var hashes = map[string]crypto.Hash{
+	"sha1":   crypto.SHA1,
+	"sha256": crypto.SHA256,
+	"sha384": crypto.SHA384,
+	"sha512": crypto.SHA512,
+}
+
+// Digest hashes data with the named algorithm
+func Digest(alg string, data []byte) ([]byte, error) {
+	h, ok := hashes[alg]
+	if !ok {
+		return nil, fmt.Errorf("bootguard: unsupported hash algorithm %v", alg)
+	}
+	w := h.New()
+	w.Write(data)
+	return w.Sum(nil), nil
+}
+
+// reversed returns a big-endian copy of little-endian data
+func reversed(data []byte) []byte {
+	r := make([]byte, len(data))
+	for n, b := range data {
+		r[len(data)-1-n] = b
+	}
+	return r
+}
+
+// KeyHash is the hash of the public key as stored in the KM (for the BPM
+// key) and in the field programmable fuses (for the KM key): the modulus of
+// RSA keys and the X and Y values of ECC keys, as stored.
+func KeyHash(ks *KeySignatureConfig, alg string) ([]byte, error) {
+	return Digest(alg, ks.Key)
+}
+
+// VerifySignature checks the signature of a key and signature structure
+// over the signed data.
+func VerifySignature(ks *KeySignatureConfig, data []byte) error {
+	h, ok := hashes[ks.SigHashAlg]
+	if !ok {
+		return fmt.Errorf("bootguard: unsupported signature hash algorithm %v", ks.SigHashAlg)
+	}
+	hashed, _ := Digest(ks.SigHashAlg, data)
+
+	switch ks.KeyAlg {
+	case "rsa":
+		key := &rsa.PublicKey{
+			N: new(big.Int).SetBytes(reversed(ks.Key)),
+			E: int(ks.Exponent),
+		}
+		signature := reversed(ks.Signature)
+		switch ks.SigScheme {
+		case "rsassa":
+			return rsa.VerifyPKCS1v15(key, h, hashed, signature)
+		case "rsapss":
+			return rsa.VerifyPSS(key, h, hashed, signature,
+				&rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto})
+		}
+	case "ecc":
+		curves := map[uint16]elliptic.Curve{256: elliptic.P256(), 384: elliptic.P384()}
+		curve, ok := curves[uint16(ks.KeySize)]
+		if !ok || ks.SigScheme != "ecdsa" {
+			break
+		}
+		n := len(ks.Key) / 2
+		key := &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(reversed(ks.Key[:n])),
+			Y:     new(big.Int).SetBytes(reversed(ks.Key[n:])),
+		}
+		n = len(ks.Signature) / 2
+		r := new(big.Int).SetBytes(reversed(ks.Signature[:n]))
+		s := new(big.Int).SetBytes(reversed(ks.Signature[n:]))
+		if !ecdsa.Verify(key, hashed, r, s) {
+			return fmt.Errorf("bootguard: ecdsa verification failed")
+		}
+		return nil
+	}
+	return fmt.Errorf("bootguard: unsupported signature %v %v%d", ks.SigScheme, ks.KeyAlg, ks.KeySize)
+}
+
+// HostReader returns size bytes of the flash at a host address
+type HostReader func(address uint64, size uint32) ([]byte, error)
+
+// IbbDigest hashes the hashed segments of an IBB element in order
+func IbbDigest(ibb *IbbConfig, alg string, read HostReader) ([]byte, error) {
+	data := []byte{}
+	for _, s := range ibb.Segments {
+		if !s.Hashed() {
+			continue
+		}
+		segment, err := read(uint64(s.Base), uint32(s.Size))
+		if err != nil {
+			return nil, fmt.Errorf("bootguard: IBB segment 0x%08x+0x%x: %v", uint32(s.Base), uint32(s.Size), err)
+		}
+		data = append(data, segment...)
+	}
+	return Digest(alg, data)
+}
+
+// VerifyKeyManifest checks the KM signature
+func VerifyKeyManifest(km *KeyManifest, raw []byte) error {
+	if err := VerifySignature(km.Signature, raw[:km.SignedSize]); err != nil {
+		return fmt.Errorf("bootguard: KM signature is invalid: %v", err)
+	}
+	return nil
+}
+
+// VerifyBootPolicyManifest checks the BPM key is one the KM allows, the
+// BPM signature and the IBB digests against the flash contents.
+func VerifyBootPolicyManifest(bpm *BootPolicyManifest, raw []byte, km *KeyManifest, read HostReader) []error {
+	errs := []error{}
+	if km != nil {
+		found := false
+		for _, h := range km.BpmKeyHashes() {
+			digest, err := KeyHash(bpm.Signature, h.Alg)
+			if err == nil && bytes.Equal(digest, h.Digest) {
+				found = true
+			}
+		}
+		if !found {
+			errs = append(errs, fmt.Errorf("bootguard: BPM key isn't in the KM BPM key hashes"))
+		}
+	}
+	if err := VerifySignature(bpm.Signature, raw[:bpm.SignedSize]); err != nil {
+		errs = append(errs, fmt.Errorf("bootguard: BPM signature is invalid: %v", err))
+	}
+	for n, ibb := range bpm.IBBs {
+		for _, h := range ibb.Digests {
+			if len(h.Digest) == 0 {
+				continue
+			}
+			digest, err := IbbDigest(ibb, h.Alg, read)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			if !bytes.Equal(digest, h.Digest) {
+				errs = append(errs, fmt.Errorf("bootguard: IBB %v %v digest is %v, the BPM expects %v",
+					n, h.Alg, hex.EncodeToString(digest), hex.EncodeToString(h.Digest)))
+			}
+		}
+	}
+	return errs
+}
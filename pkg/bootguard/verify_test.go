@@ -0,0 +1,346 @@
+package bootguard
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+)
+
+// testKeySize is the size of the made-up key and signature structure
+// testKeySignature puts at the end of the test manifests
+var testKeySize = len(testKeySignature(algSHA256))
+
+// le is the little-endian form of a big-endian number of size bytes
+func le(n *big.Int, size int) []byte {
+	return reversed(append(make([]byte, size-len(n.Bytes())), n.Bytes()...))
+}
+
+// keySignature builds a key and signature structure for key signing data,
+// a pss RSA key uses RSASSA-PSS.
+func keySignature(t *testing.T, key crypto.Signer, pss bool, hashAlg uint16, data []byte) []byte {
+	hashed, err := Digest(algorithmName(hashAlg), data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		size := key.Size()
+		scheme := uint16(0x14)
+		h := hashes[algorithmName(hashAlg)]
+		var signature []byte
+		if pss {
+			scheme = 0x16
+			signature, err = rsa.SignPSS(rand.Reader, key, h, hashed, nil)
+		} else {
+			signature, err = rsa.SignPKCS1v15(rand.Reader, key, h, hashed)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pack(uint8(0x10), uint16(algRSA), uint8(0x10), uint16(size*8), uint32(key.E),
+			le(key.N, size),
+			scheme, uint8(0x10), uint16(size*8), hashAlg,
+			reversed(signature))
+	case *ecdsa.PrivateKey:
+		bits := key.Curve.Params().BitSize
+		size := bits / 8
+		r, s, err := ecdsa.Sign(rand.Reader, key, hashed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pack(uint8(0x10), uint16(algECC), uint8(0x10), uint16(bits),
+			le(key.X, size), le(key.Y, size),
+			uint16(0x18), uint8(0x10), uint16(bits), hashAlg,
+			le(r, size), le(s, size))
+	}
+	t.Fatalf("unsupported key %T", key)
+	return nil
+}
+
+// signManifest swaps the made-up key and signature at the end of a test
+// manifest for the ones of key over the signed part, signedSize parses it.
+func signManifest(t *testing.T, raw []byte, key crypto.Signer, hashAlg uint16,
+	signedSize func([]byte) (uint32, error)) []byte {
+	start := len(raw) - testKeySize
+	unsigned := append(append([]byte{}, raw[:start]...), keySignature(t, key, false, hashAlg, nil)...)
+	size, err := signedSize(unsigned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(unsigned[:start], keySignature(t, key, false, hashAlg, unsigned[:size])...)
+}
+
+func kmSignedSize(raw []byte) (uint32, error) {
+	km, err := ParseKeyManifest(raw)
+	if err != nil {
+		return 0, err
+	}
+	return km.SignedSize, nil
+}
+
+func bpmSignedSize(raw []byte) (uint32, error) {
+	bpm, err := ParseBootPolicyManifest(raw)
+	if err != nil {
+		return 0, err
+	}
+	return bpm.SignedSize, nil
+}
+
+func TestVerifySignature(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p256, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	p384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	data := []byte("__KEYM__ signed part")
+
+	for _, tt := range []struct {
+		name    string
+		key     crypto.Signer
+		pss     bool
+		hashAlg uint16
+	}{
+		{"rsassa sha256", rsaKey, false, algSHA256},
+		{"rsapss sha384", rsaKey, true, algSHA384},
+		{"ecdsa p256 sha256", p256, false, algSHA256},
+		{"ecdsa p384 sha384", p384, false, algSHA384},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newDecoder(keySignature(t, tt.key, tt.pss, tt.hashAlg, data))
+			ks := d.keySignature()
+			if err := d.finish(); err != nil {
+				t.Fatalf("keySignature() err=%v", err)
+			}
+			if err := VerifySignature(&ks, data); err != nil {
+				t.Errorf("VerifySignature() err=%v", err)
+			}
+			if err := VerifySignature(&ks, append([]byte{}, data[1:]...)); err == nil {
+				t.Errorf("VerifySignature() of other data succeeded")
+			}
+
+			// keys and signatures are stored little-endian
+			bigEndian := ks
+			bigEndian.Signature = reversed(ks.Signature)
+			if err := VerifySignature(&bigEndian, data); err == nil {
+				t.Errorf("VerifySignature() of a big-endian signature succeeded")
+			}
+			bigEndian = ks
+			bigEndian.Key = reversed(ks.Key)
+			if err := VerifySignature(&bigEndian, data); err == nil {
+				t.Errorf("VerifySignature() with a big-endian key succeeded")
+			}
+		})
+	}
+
+	ks := newDecoder(keySignature(t, p256, false, algSHA256, data)).keySignature()
+	ks.SigHashAlg = "sm3_256"
+	if err := VerifySignature(&ks, data); err == nil || !strings.Contains(err.Error(), "unsupported") {
+		t.Errorf("VerifySignature() err=%v, want an unsupported hash algorithm", err)
+	}
+}
+
+// testFlash is the top 8KiB of the flash below 4GiB, holding the IBB
+// segments of testSegments
+type testFlash []byte
+
+const testFlashBase = 0xffffe000
+
+func (f testFlash) read(address uint64, size uint32) ([]byte, error) {
+	if address < testFlashBase || address+uint64(size) > testFlashBase+uint64(len(f)) {
+		return nil, fmt.Errorf("0x%x isn't in the test flash", address)
+	}
+	return f[address-testFlashBase : address-testFlashBase+uint64(size)], nil
+}
+
+func newTestFlash() testFlash {
+	f := make(testFlash, 0x2000)
+	for n := range f {
+		f[n] = uint8(n * 7)
+	}
+	return f
+}
+
+func TestIbbDigest(t *testing.T) {
+	_, rawBPM := testManifestsV1()
+	bpm, err := ParseBootPolicyManifest(rawBPM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flash := newTestFlash()
+	// the segments at 0xfffff000 and 0xffffe800 in BPM order, the one at
+	// 0xffffe000 isn't hashed
+	want, _ := Digest("sha256", append(append([]byte{}, flash[0x1000:]...), flash[0x800:0x1000]...))
+
+	digest, err := IbbDigest(bpm.IBBs[0], "sha256", flash.read)
+	if err != nil || !bytes.Equal(digest, want) {
+		t.Errorf("IbbDigest() = %x, err=%v, want %x", digest, err, want)
+	}
+	flash[0] ^= 0xff
+	if digest, _ := IbbDigest(bpm.IBBs[0], "sha256", flash.read); !bytes.Equal(digest, want) {
+		t.Errorf("IbbDigest() hashes the unhashed segment")
+	}
+	flash[0x800] ^= 0xff
+	if digest, _ := IbbDigest(bpm.IBBs[0], "sha256", flash.read); bytes.Equal(digest, want) {
+		t.Errorf("IbbDigest() doesn't hash the segment at 0xffffe800")
+	}
+
+	bpm.IBBs[0].Segments[0].Base = 0xfff00000
+	if _, err := IbbDigest(bpm.IBBs[0], "sha256", flash.read); err == nil {
+		t.Errorf("IbbDigest() of an unreadable segment succeeded")
+	}
+}
+
+// testSignedManifests are the test manifests with the KM signed by an RSA
+// key, the BPM signed by bpmKey, the hash of the BPM key in the KM and the
+// IBB digests of flash in the BPM.
+func testSignedManifests(t *testing.T, v2 bool, kmKey, bpmKey crypto.Signer, flash testFlash) (km, bpm []byte) {
+	manifests, hashAlg, bpmKeyHash := testManifestsV1, uint16(algSHA256), bytes.Repeat([]byte{0x22}, 32)
+	ibbDigests := map[uint16][]byte{algSHA256: bytes.Repeat([]byte{0x11}, 32)}
+	if v2 {
+		manifests, hashAlg, bpmKeyHash = testManifestsV2, algSHA384, bytes.Repeat([]byte{0x44}, 48)
+		ibbDigests[algSHA384] = bytes.Repeat([]byte{0x33}, 48)
+	}
+	km, bpm = manifests()
+
+	for alg, old := range ibbDigests {
+		parsed, err := ParseBootPolicyManifest(bpm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		digest, err := IbbDigest(parsed.IBBs[0], algorithmName(alg), flash.read)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bpm = bytes.Replace(bpm, old, digest, 1)
+	}
+	bpm = signManifest(t, bpm, bpmKey, hashAlg, bpmSignedSize)
+
+	parsed, err := ParseBootPolicyManifest(bpm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyHash, err := KeyHash(parsed.Signature, algorithmName(hashAlg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	km = bytes.Replace(km, bpmKeyHash, keyHash, 1)
+	return signManifest(t, km, kmKey, hashAlg, kmSignedSize), bpm
+}
+
+func TestVerifyBootPolicyManifest(t *testing.T) {
+	kmKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eccKey, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+
+	for _, tt := range []struct {
+		name   string
+		v2     bool
+		bpmKey crypto.Signer
+		// edit changes the signed manifests or the flash after signing
+		edit func(km, bpm []byte, flash testFlash) ([]byte, []byte)
+		errs []string
+	}{
+		{name: "v1", bpmKey: rsaKey},
+		{name: "v2 ecdsa", v2: true, bpmKey: eccKey},
+		{
+			name:   "unhashed segment changed",
+			bpmKey: rsaKey,
+			edit: func(km, bpm []byte, flash testFlash) ([]byte, []byte) {
+				flash[0x10] ^= 0xff
+				return km, bpm
+			},
+		},
+		{
+			name:   "v1 IBB tampered",
+			bpmKey: rsaKey,
+			edit: func(km, bpm []byte, flash testFlash) ([]byte, []byte) {
+				flash[0x1ff0] ^= 0xff
+				return km, bpm
+			},
+			errs: []string{"IBB 0 sha256 digest is"},
+		},
+		{
+			name:   "v2 IBB tampered",
+			v2:     true,
+			bpmKey: eccKey,
+			edit: func(km, bpm []byte, flash testFlash) ([]byte, []byte) {
+				flash[0x800] ^= 0xff
+				return km, bpm
+			},
+			errs: []string{"IBB 0 sha256 digest is", "IBB 0 sha384 digest is"},
+		},
+		{
+			name:   "BPM tampered",
+			bpmKey: rsaKey,
+			edit: func(km, bpm []byte, flash testFlash) ([]byte, []byte) {
+				return km, bytes.Replace(bpm, []byte("PMDATEST"), []byte("PMDATESU"), 1)
+			},
+			errs: []string{"BPM signature is invalid"},
+		},
+		{
+			name:   "BPM key not in the KM",
+			v2:     true,
+			bpmKey: eccKey,
+			edit: func(km, bpm []byte, flash testFlash) ([]byte, []byte) {
+				_, other := testSignedManifests(t, true, kmKey, rsaKey, flash)
+				return km, other
+			},
+			errs: []string{"BPM key isn't in the KM"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			flash := newTestFlash()
+			rawKM, rawBPM := testSignedManifests(t, tt.v2, kmKey, tt.bpmKey, flash)
+			if tt.edit != nil {
+				rawKM, rawBPM = tt.edit(rawKM, rawBPM, flash)
+			}
+			km, err := ParseKeyManifest(rawKM)
+			if err != nil {
+				t.Fatalf("ParseKeyManifest() err=%v", err)
+			}
+			if err := VerifyKeyManifest(km, rawKM); err != nil {
+				t.Errorf("VerifyKeyManifest() err=%v", err)
+			}
+			bpm, err := ParseBootPolicyManifest(rawBPM)
+			if err != nil {
+				t.Fatalf("ParseBootPolicyManifest() err=%v", err)
+			}
+
+			errs := VerifyBootPolicyManifest(bpm, rawBPM, km, flash.read)
+			if len(errs) != len(tt.errs) {
+				t.Fatalf("VerifyBootPolicyManifest() = %v, want errors containing %v", errs, tt.errs)
+			}
+			for n, err := range errs {
+				if !strings.Contains(err.Error(), tt.errs[n]) {
+					t.Errorf("VerifyBootPolicyManifest() err=%v, want an error containing '%v'", err, tt.errs[n])
+				}
+			}
+		})
+	}
+
+	// a KM changed after signing
+	flash := newTestFlash()
+	rawKM, _ := testSignedManifests(t, false, kmKey, rsaKey, flash)
+	rawKM[structHeaderSize] ^= 0xff
+	km, err := ParseKeyManifest(rawKM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyKeyManifest(km, rawKM); err == nil || !strings.Contains(err.Error(), "KM signature is invalid") {
+		t.Errorf("VerifyKeyManifest() err=%v, want an invalid signature", err)
+	}
+}
@@ -18,6 +18,8 @@ const (
 
 	fileMagic         = uint64(0x4c41524348495645) // "LARCHIVE"
 	fileComponentNull = uint32(0xFFFFFFFF)
+	// coreboot's cpu_microcode_blob.bin
+	FileComponentMicrocode = uint32(0x53)
 )
 
 type VolumeHeader struct {
@@ -48,10 +50,16 @@ func (h FileHeader) Valid() bool {
 	return h.Magic == fileMagic
 }
 
-func DetectVolume(unknownRegion *rom.Region) []*rom.Region {
+const (
+	detectorName   = "cbfs"
+	fileHeaderSize = 24
+)
+
+func DetectVolume(unknownRegion *rom.Region) ([]*rom.Region, rom.Diagnostics) {
 	// check for file header and volume
 	bs := bytes.NewReader(unknownRegion.Raw)
 	baseOffset := unknownRegion.Offset
+	var diags rom.Diagnostics
 
 	// loop and generate all files
 	var volume VolumeHeader
@@ -60,20 +68,32 @@ func DetectVolume(unknownRegion *rom.Region) []*rom.Region {
 	for off := uint32(0); off < uint32(unknownRegion.Size); {
 		bs.Seek(int64(off), io.SeekStart)
 		var file FileHeader
-		binary.Read(bs, binary.BigEndian, &file)
+		if err := binary.Read(bs, binary.BigEndian, &file); err != nil {
+			return files, diags
+		}
 		if !file.Valid() {
-			return files
+			return files, diags
 		}
 
 		var nameLen uint32
 		if file.AttributesOffset != 0 {
-			nameLen = file.AttributesOffset - 24
+			nameLen = file.AttributesOffset - fileHeaderSize
 		} else {
-			nameLen = file.Offset - 24
+			nameLen = file.Offset - fileHeaderSize
+		}
+		if file.Offset < fileHeaderSize || file.Offset < file.AttributesOffset ||
+			nameLen > file.Offset || file.Offset > unknownRegion.Size-off {
+			diags.Errorf(detectorName, baseOffset+off,
+				"bad file header: offset=0x%08x attributes=0x%08x",
+				file.Offset, file.AttributesOffset)
+			return files, diags
 		}
 		nameBytes := make([]byte, nameLen)
 		binary.Read(bs, binary.BigEndian, &nameBytes)
 		nameEnd := bytes.IndexByte(nameBytes, 0)
+		if nameEnd < 0 {
+			nameEnd = len(nameBytes)
+		}
 		name := string(nameBytes[0:nameEnd])
 		if file.Type == fileComponentNull {
 			name = fmt.Sprintf("null_%08x", off)
@@ -84,16 +104,20 @@ func DetectVolume(unknownRegion *rom.Region) []*rom.Region {
 		// name is zero padded for length
 		// attributes is 16 bytes
 
-		size := uint32(rom.AlignUp(uint64(file.Offset+file.Len),
+		size := uint32(rom.AlignUp(uint64(file.Offset)+uint64(file.Len),
 			uint64(volume.Align)))
+		if uint64(size) > uint64(unknownRegion.Size-off) {
+			diags.Errorf(detectorName, baseOffset+off,
+				"file '%s' (len=0x%08x) runs past the end of the region", name, file.Len)
+			return files, diags
+		}
 
-		// TODO: handle with non-raw structures
 		fileRegion := unknownRegion.Child(baseOffset+off, size,
 			"container", name)
 		files = append(files, fileRegion)
 
 		headerRegion := fileRegion.Child(baseOffset+off, file.Offset,
-			"raw", "header")
+			"cbfs_header", "header")
 		fileRegion.Children = append(fileRegion.Children, headerRegion)
 
 		dataRegion := fileRegion.Child(
@@ -111,5 +135,5 @@ func DetectVolume(unknownRegion *rom.Region) []*rom.Region {
 		off += size
 	}
 
-	return files
+	return files, diags
 }
@@ -0,0 +1,131 @@
+package cbfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/flammit/fwtools/pkg/rom"
+)
+
+func init() {
+	rom.RegisterHandler("cbfs_header", rom.StructHandler{
+		New: func() interface{} { return &FileHeaderConfig{} },
+		Decode: func(r *rom.Region) (interface{}, error) {
+			return DecodeFileHeaderConfig(r.Raw)
+		},
+		Encode: func(r *rom.Region, v interface{}) ([]byte, error) {
+			return v.(*FileHeaderConfig).Encode(r.Size)
+		},
+	})
+}
+
+const (
+	attributeHeaderSize = 8
+)
+
+// FileHeaderConfig is the editable form of a CBFS file header including
+// its name and attributes.  Offsets are kept as-is, the data following the
+// header is a separate region.
+type FileHeaderConfig struct {
+	Len              rom.Hex32
+	Type             rom.Hex32
+	AttributesOffset rom.Hex32
+	Offset           rom.Hex32
+	Name             string
+	Attributes       []AttributeConfig `json:",omitempty"`
+}
+
+// AttributeConfig is one tag/length/value attribute, Data excludes the
+// 8 byte tag and length header.
+type AttributeConfig struct {
+	Tag  rom.Hex32
+	Data rom.HexBytes
+}
+
+func DecodeFileHeaderConfig(raw []byte) (*FileHeaderConfig, error) {
+	var file FileHeader
+	if err := binary.Read(bytes.NewReader(raw), binary.BigEndian, &file); err != nil {
+		return nil, err
+	}
+	if !file.Valid() {
+		return nil, fmt.Errorf("cbfs: invalid file header")
+	}
+	if int(file.Offset) != len(raw) ||
+		(file.AttributesOffset != 0 && (file.AttributesOffset < fileHeaderSize ||
+			file.AttributesOffset > file.Offset)) {
+		return nil, fmt.Errorf("cbfs: bad header offsets: offset=0x%x attributes=0x%x",
+			file.Offset, file.AttributesOffset)
+	}
+
+	nameEnd := file.Offset
+	if file.AttributesOffset != 0 {
+		nameEnd = file.AttributesOffset
+	}
+	nameBytes := raw[fileHeaderSize:nameEnd]
+	if n := bytes.IndexByte(nameBytes, 0); n >= 0 {
+		nameBytes = nameBytes[:n]
+	}
+	c := &FileHeaderConfig{
+		Len:              rom.Hex32(file.Len),
+		Type:             rom.Hex32(file.Type),
+		AttributesOffset: rom.Hex32(file.AttributesOffset),
+		Offset:           rom.Hex32(file.Offset),
+		Name:             string(nameBytes),
+	}
+
+	if file.AttributesOffset == 0 {
+		return c, nil
+	}
+	for off := file.AttributesOffset; off < file.Offset; {
+		if file.Offset-off < attributeHeaderSize {
+			return nil, fmt.Errorf("cbfs: truncated attribute at 0x%x", off)
+		}
+		tag := binary.BigEndian.Uint32(raw[off:])
+		len := binary.BigEndian.Uint32(raw[off+4:])
+		if len < attributeHeaderSize || len > file.Offset-off {
+			return nil, fmt.Errorf("cbfs: bad attribute length 0x%x at 0x%x", len, off)
+		}
+		c.Attributes = append(c.Attributes, AttributeConfig{
+			Tag:  rom.Hex32(tag),
+			Data: rom.HexBytes(append([]byte{}, raw[off+attributeHeaderSize:off+len]...)),
+		})
+		off += len
+	}
+	return c, nil
+}
+
+func (c FileHeaderConfig) Encode(size uint32) ([]byte, error) {
+	if uint32(c.Offset) != size {
+		return nil, fmt.Errorf("cbfs: header offset 0x%x doesn't match header region size 0x%x",
+			uint32(c.Offset), size)
+	}
+	nameEnd := uint32(c.Offset)
+	if c.AttributesOffset != 0 {
+		nameEnd = uint32(c.AttributesOffset)
+	}
+	if nameEnd > size || fileHeaderSize+uint32(len(c.Name)) > nameEnd {
+		return nil, fmt.Errorf("cbfs: name '%v' doesn't fit before offset 0x%x", c.Name, nameEnd)
+	}
+
+	raw := make([]byte, size)
+	binary.BigEndian.PutUint64(raw[0:], fileMagic)
+	binary.BigEndian.PutUint32(raw[8:], uint32(c.Len))
+	binary.BigEndian.PutUint32(raw[12:], uint32(c.Type))
+	binary.BigEndian.PutUint32(raw[16:], uint32(c.AttributesOffset))
+	binary.BigEndian.PutUint32(raw[20:], uint32(c.Offset))
+	copy(raw[fileHeaderSize:], c.Name)
+
+	off := uint64(nameEnd)
+	for _, attr := range c.Attributes {
+		len := uint64(attributeHeaderSize + len(attr.Data))
+		if off+len > uint64(size) {
+			return nil, fmt.Errorf("cbfs: attribute 0x%08x doesn't fit in header", uint32(attr.Tag))
+		}
+		binary.BigEndian.PutUint32(raw[off:], uint32(attr.Tag))
+		binary.BigEndian.PutUint32(raw[off+4:], uint32(len))
+		copy(raw[off+attributeHeaderSize:], attr.Data)
+		off += len
+	}
+	return raw, nil
+}
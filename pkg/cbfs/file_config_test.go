@@ -0,0 +1,47 @@
+package cbfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// testFileHeader is the header of a compressed stage: its name padded to
+// 16 bytes and a compression attribute, 0x38 bytes in all
+func testFileHeader() []byte {
+	raw := make([]byte, 0x38)
+	binary.BigEndian.PutUint64(raw[0:], fileMagic)
+	binary.BigEndian.PutUint32(raw[8:], 0x1234) // Len
+	binary.BigEndian.PutUint32(raw[12:], 0x10)  // Type, stage
+	binary.BigEndian.PutUint32(raw[16:], 0x28)  // AttributesOffset
+	binary.BigEndian.PutUint32(raw[20:], 0x38)  // Offset
+	copy(raw[fileHeaderSize:], "normal/romstage")
+	binary.BigEndian.PutUint32(raw[0x28:], 0x42435a4c) // compression tag
+	binary.BigEndian.PutUint32(raw[0x2c:], 0x10)
+	binary.BigEndian.PutUint32(raw[0x30:], 1)
+	binary.BigEndian.PutUint32(raw[0x34:], 0x2000)
+	return raw
+}
+
+func TestFileHeaderConfigRoundTrip(t *testing.T) {
+	raw := testFileHeader()
+	c, err := DecodeFileHeaderConfig(raw)
+	if err != nil {
+		t.Fatalf("DecodeFileHeaderConfig() err=%v", err)
+	}
+	if c.Name != "normal/romstage" || len(c.Attributes) != 1 || len(c.Attributes[0].Data) != 8 {
+		t.Errorf("DecodeFileHeaderConfig() = %+v", c)
+	}
+	encoded, err := c.Encode(uint32(len(raw)))
+	if err != nil {
+		t.Fatalf("Encode() err=%v", err)
+	}
+	if !bytes.Equal(encoded, raw) {
+		t.Errorf("Encode(DecodeFileHeaderConfig()) = %x, want %x", encoded, raw)
+	}
+
+	c.Name = "fallback/romstage"
+	if _, err := c.Encode(uint32(len(raw))); err == nil {
+		t.Errorf("Encode() of a name past the attributes succeeded")
+	}
+}
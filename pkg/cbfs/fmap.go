@@ -12,6 +12,8 @@ import (
 )
 
 const (
+	fmapDetectorName = "fmap"
+
 	fmapSignature      = uint64(0x5f5f50414d465f5f) // "__FMAP__"
 	fmapVerMajor       = 1
 	fmapVerMinor       = 1
@@ -58,26 +60,35 @@ func (a FmapArea) NameString() string {
 	return strings.TrimRight(string(a.Name[:fmapStrlen]), "\u0000")
 }
 
-func DetectFlashMap(unknownRegion *rom.Region) []*rom.Region {
+func DetectFlashMap(unknownRegion *rom.Region) ([]*rom.Region, rom.Diagnostics) {
 	bs := bytes.NewReader(unknownRegion.Raw)
+	var diags rom.Diagnostics
 
 	// check for signature
 	// TODO: scan for signature instead of just at the beginning
 	var header FmapHeader
+	var headerOff uint32
 	for off := uint32(0); off < unknownRegion.Size; off += 0x10 {
 		bs.Seek(int64(off), io.SeekStart)
-		binary.Read(bs, binary.LittleEndian, &header)
+		if err := binary.Read(bs, binary.LittleEndian, &header); err != nil {
+			break
+		}
 		if header.Valid() {
+			headerOff = off
 			break
 		}
 	}
 	if !header.Valid() {
-		return nil
+		return nil, nil
 	}
 	log.Printf("FMAP Header: %v", header)
 
 	areas := make([]FmapArea, header.NumAreas)
-	binary.Read(bs, binary.LittleEndian, &areas)
+	if err := binary.Read(bs, binary.LittleEndian, &areas); err != nil {
+		diags.Errorf(fmapDetectorName, unknownRegion.Offset+headerOff,
+			"truncated FMAP area list (%v areas): err=%v", header.NumAreas, err)
+		return nil, diags
+	}
 	unknownRegion.Name = "fmap"
 	unknownRegion.Type = "container"
 	unknownRegion.Children = []*rom.Region{}
@@ -88,15 +99,17 @@ func DetectFlashMap(unknownRegion *rom.Region) []*rom.Region {
 		log.Printf("FMAP Area %v: %v", i, area)
 		if !unknownRegion.Contains(area.Offset, area.Size) {
 			// skip regions as in samsung stumpy - like IFD/ME
-			log.Printf("Skipping Area")
+			diags.Infof(fmapDetectorName, unknownRegion.Offset+headerOff,
+				"skipping area %v outside of region: %v", i, area)
 			continue
 		}
 
 		region := unknownRegion.Child(area.Offset, area.Size,
 			"unknown", area.NameString())
 
-		if area.NameString() == "FMAP" {
-			// TODO: drop this region and have a custom struct handler
+		if area.Offset == unknownRegion.Offset+headerOff {
+			region.Type = "fmap"
+		} else if area.NameString() == "FMAP" {
 			region.Type = "raw"
 		}
 
@@ -113,5 +126,5 @@ func DetectFlashMap(unknownRegion *rom.Region) []*rom.Region {
 		lastRegion = region
 	}
 
-	return []*rom.Region{unknownRegion}
+	return []*rom.Region{unknownRegion}, diags
 }
@@ -0,0 +1,174 @@
+package cbfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/flammit/fwtools/pkg/rom"
+)
+
+func init() {
+	rom.RegisterHandler("fmap", rom.StructHandler{
+		New: func() interface{} { return &FmapConfig{} },
+		Decode: func(r *rom.Region) (interface{}, error) {
+			return DecodeFmapConfig(r.Raw)
+		},
+		Encode: func(r *rom.Region, v interface{}) ([]byte, error) {
+			return v.(*FmapConfig).Encode(r.Size)
+		},
+	})
+}
+
+var (
+	fmapAreaFlagNames = []struct {
+		flag uint16
+		name string
+	}{
+		{fmapAreaStatic, "STATIC"},
+		{fmapAreaCompressed, "COMPRESSED"},
+		{fmapAreaReadOnly, "RO"},
+	}
+)
+
+// FmapConfig is the editable form of an FMAP region.
+type FmapConfig struct {
+	VerMajor uint8
+	VerMinor uint8
+	Base     rom.Hex64
+	Size     rom.Hex32
+	Name     string
+	Areas    []FmapAreaConfig
+	Extra    []rom.Chunk `json:",omitempty"`
+}
+
+type FmapAreaConfig struct {
+	Name   string
+	Offset rom.Hex32
+	Size   rom.Hex32
+	Flags  []string `json:",omitempty"`
+}
+
+func fmapName(name [fmapStrlen]byte) string {
+	return strings.TrimRight(string(name[:]), "\u0000")
+}
+
+func fmapNameBytes(name string) ([fmapStrlen]byte, error) {
+	var bs [fmapStrlen]byte
+	if len(name) >= fmapStrlen {
+		return bs, fmt.Errorf("fmap: name '%v' is longer than %v bytes", name, fmapStrlen-1)
+	}
+	copy(bs[:], name)
+	return bs, nil
+}
+
+func decodeFmapFlags(flags uint16) []string {
+	names := []string{}
+	for _, f := range fmapAreaFlagNames {
+		if flags&f.flag != 0 {
+			names = append(names, f.name)
+			flags &^= f.flag
+		}
+	}
+	if flags != 0 {
+		names = append(names, fmt.Sprintf("0x%04x", flags))
+	}
+	return names
+}
+
+func encodeFmapFlags(names []string) (uint16, error) {
+	var flags uint16
+nextName:
+	for _, name := range names {
+		for _, f := range fmapAreaFlagNames {
+			if name == f.name {
+				flags |= f.flag
+				continue nextName
+			}
+		}
+		v, err := strconv.ParseUint(name, 0, 16)
+		if err != nil {
+			return 0, fmt.Errorf("fmap: unknown area flag '%v'", name)
+		}
+		flags |= uint16(v)
+	}
+	return flags, nil
+}
+
+func DecodeFmapConfig(raw []byte) (*FmapConfig, error) {
+	bs := bytes.NewReader(raw)
+	var header FmapHeader
+	if err := binary.Read(bs, binary.LittleEndian, &header); err != nil {
+		return nil, err
+	}
+	if !header.Valid() {
+		return nil, fmt.Errorf("fmap: invalid header")
+	}
+	areas := make([]FmapArea, header.NumAreas)
+	if err := binary.Read(bs, binary.LittleEndian, &areas); err != nil {
+		return nil, err
+	}
+
+	c := &FmapConfig{
+		VerMajor: header.VerMajor,
+		VerMinor: header.VerMinor,
+		Base:     rom.Hex64(header.Base),
+		Size:     rom.Hex32(header.Size),
+		Name:     fmapName(header.Name),
+		Areas:    []FmapAreaConfig{},
+	}
+	for _, area := range areas {
+		c.Areas = append(c.Areas, FmapAreaConfig{
+			Name:   fmapName(area.Name),
+			Offset: rom.Hex32(area.Offset),
+			Size:   rom.Hex32(area.Size),
+			Flags:  decodeFmapFlags(area.Flags),
+		})
+	}
+
+	coverage := rom.NewCoverage(uint32(len(raw)))
+	coverage.Cover(0, uint32(binary.Size(header)+binary.Size(areas)))
+	c.Extra = coverage.Chunks(raw)
+	return c, nil
+}
+
+func (c FmapConfig) Encode(size uint32) ([]byte, error) {
+	header := FmapHeader{
+		Signature: fmapSignature,
+		VerMajor:  c.VerMajor,
+		VerMinor:  c.VerMinor,
+		Base:      uint64(c.Base),
+		Size:      uint32(c.Size),
+		NumAreas:  uint16(len(c.Areas)),
+	}
+	var err error
+	if header.Name, err = fmapNameBytes(c.Name); err != nil {
+		return nil, err
+	}
+	areas := make([]FmapArea, len(c.Areas))
+	for n, area := range c.Areas {
+		areas[n].Offset = uint32(area.Offset)
+		areas[n].Size = uint32(area.Size)
+		if areas[n].Name, err = fmapNameBytes(area.Name); err != nil {
+			return nil, err
+		}
+		if areas[n].Flags, err = encodeFmapFlags(area.Flags); err != nil {
+			return nil, err
+		}
+	}
+
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, header)
+	binary.Write(&b, binary.LittleEndian, areas)
+	if uint32(b.Len()) > size {
+		return nil, fmt.Errorf("fmap: %v areas don't fit in 0x%x bytes", len(areas), size)
+	}
+	raw := rom.EmptyBytes(size)
+	copy(raw, b.Bytes())
+	if err := rom.ApplyChunks(raw, c.Extra); err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
@@ -0,0 +1,62 @@
+package cbfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// testFmap is a 0x200 byte FMAP region of a 16MiB coreboot image
+func testFmap() []byte {
+	name := func(s string) (b [fmapStrlen]byte) {
+		copy(b[:], s)
+		return b
+	}
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, FmapHeader{
+		Signature: fmapSignature,
+		VerMajor:  fmapVerMajor,
+		VerMinor:  fmapVerMinor,
+		Base:      0xff000000,
+		Size:      0x1000000,
+		Name:      name("FLASH"),
+		NumAreas:  3,
+	})
+	binary.Write(&b, binary.LittleEndian, []FmapArea{
+		{Offset: 0x0, Size: 0x1000, Name: name("SI_DESC"), Flags: fmapAreaStatic | fmapAreaReadOnly},
+		{Offset: 0x200000, Size: 0x200, Name: name("FMAP")},
+		{Offset: 0x200200, Size: 0xdffe00, Name: name("COREBOOT"), Flags: 0x0100},
+	})
+	raw := append(b.Bytes(), bytes.Repeat([]byte{0xff}, 0x200-b.Len())...)
+	raw[0x1f0] = 0x42 // past the areas
+	return raw
+}
+
+func TestFmapConfigRoundTrip(t *testing.T) {
+	raw := testFmap()
+	c, err := DecodeFmapConfig(raw)
+	if err != nil {
+		t.Fatalf("DecodeFmapConfig() err=%v", err)
+	}
+	if c.Name != "FLASH" || len(c.Areas) != 3 || len(c.Extra) != 1 {
+		t.Errorf("DecodeFmapConfig() = %+v", c)
+	}
+	if flags := c.Areas[0].Flags; len(flags) != 2 || flags[0] != "STATIC" || flags[1] != "RO" {
+		t.Errorf("SI_DESC flags = %v", flags)
+	}
+	if flags := c.Areas[2].Flags; len(flags) != 1 || flags[0] != "0x0100" {
+		t.Errorf("COREBOOT flags = %v", flags)
+	}
+	encoded, err := c.Encode(uint32(len(raw)))
+	if err != nil {
+		t.Fatalf("Encode() err=%v", err)
+	}
+	if !bytes.Equal(encoded, raw) {
+		t.Errorf("Encode(DecodeFmapConfig()) = %x, want %x", encoded, raw)
+	}
+
+	c.Areas[1].Flags = []string{"BOGUS"}
+	if _, err := c.Encode(uint32(len(raw))); err == nil {
+		t.Errorf("Encode() with an unknown flag succeeded")
+	}
+}
@@ -3,9 +3,13 @@ package fit
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"io"
 	"log"
 
+	"github.com/flammit/fwtools/pkg/acm"
+	"github.com/flammit/fwtools/pkg/bootguard"
+	"github.com/flammit/fwtools/pkg/microcode"
 	"github.com/flammit/fwtools/pkg/rom"
 )
 
@@ -47,26 +51,67 @@ func (e Entry) ValidHeader() bool {
 		e.Version == fitVersion
 }
 
-func DetectFIT(unknownRegion *rom.Region) []*rom.Region {
-	bs := bytes.NewReader(unknownRegion.Raw)
+const detectorName = "fit"
+
+const (
+	// the FIT pointer is at 4GiB - 0x40, FITs without one are searched at
+	// 64KiB boundaries
+	fitPointerOffset = 0x40
+	fitScanAlign     = 0x10000
+)
 
-	// scan for signature
+// findFITPointer returns the flash offset the FIT pointer points at, false
+// when it doesn't point at a FIT header.
+func findFITPointer(r *rom.Region) (uint32, uint32, bool) {
+	root, addresses := r.Root(), r.AddressMap()
+	pointerOff, ok := addresses.FlashOffset(1<<32-fitPointerOffset, 4)
+	if !ok || uint64(pointerOff)+4 > uint64(len(root.Raw)) {
+		return 0, 0, false
+	}
+	pointer := binary.LittleEndian.Uint32(root.Raw[pointerOff:])
+	off, ok := addresses.FlashOffset(uint64(pointer), 0x10)
+	if !ok || uint64(off)+0x10 > uint64(len(root.Raw)) {
+		return pointer, 0, false
+	}
+	var header Entry
+	binary.Read(bytes.NewReader(root.Raw[off:]), binary.LittleEndian, &header)
+	return pointer, off, header.ValidHeader()
+}
+
+func DetectFIT(unknownRegion *rom.Region) ([]*rom.Region, rom.Diagnostics) {
+	var diags rom.Diagnostics
 	var header Entry
 	var off uint32
+	method := "pointer"
 
-	off = uint32(rom.AlignUp(uint64(unknownRegion.Offset), 0x10000)) -
-		unknownRegion.Offset
+	pointer, pointerOff, valid := findFITPointer(unknownRegion)
+	if valid {
+		// the FIT is in another region
+		if !unknownRegion.Contains(pointerOff, 0x10) {
+			return nil, nil
+		}
+		off = pointerOff - unknownRegion.Offset
+	} else {
+		method = "scan"
+		bs := bytes.NewReader(unknownRegion.Raw)
+		off = uint32(rom.AlignUp(uint64(unknownRegion.Offset), fitScanAlign)) -
+			unknownRegion.Offset
 
-	// just check for global offset alignment to 0x10000
-	for ; off < unknownRegion.Size; off += 0x10000 {
-		bs.Seek(int64(off), io.SeekStart)
-		binary.Read(bs, binary.LittleEndian, &header)
-		if header.ValidHeader() {
-			break
+		// just check for global offset alignment to 0x10000
+		for ; off < unknownRegion.Size; off += fitScanAlign {
+			bs.Seek(int64(off), io.SeekStart)
+			if err := binary.Read(bs, binary.LittleEndian, &header); err != nil {
+				break
+			}
+			if header.ValidHeader() {
+				break
+			}
 		}
-	}
-	if !header.ValidHeader() {
-		return nil
+		if !header.ValidHeader() {
+			return nil, nil
+		}
+		diags.Infof(detectorName, unknownRegion.Offset+off,
+			"FIT pointer 0x%08x doesn't point at a FIT, found it by scanning", pointer)
 	}
 
 	fitRegion := unknownRegion.Child(
@@ -75,30 +120,46 @@ func DetectFIT(unknownRegion *rom.Region) []*rom.Region {
 		"unknown",
 		"fit",
 	)
+	// ACMs outside of the FIT entries are found in the gaps
 	fitRegion = rom.DetectRegions(
-		[]rom.Detector{detectFITRegions},
+		[]rom.Detector{detectFITRegions, acm.DetectACM},
 		fitRegion,
 	)
-	return []*rom.Region{fitRegion}
+	fitRegion.Metadata = map[string]string{
+		"discovery": method,
+		"pointer":   fmt.Sprintf("0x%08x", pointer),
+	}
+	return []*rom.Region{fitRegion}, diags
 }
 
-func detectFITRegions(unknownRegion *rom.Region) []*rom.Region {
+func detectFITRegions(unknownRegion *rom.Region) ([]*rom.Region, rom.Diagnostics) {
 	bs := bytes.NewReader(unknownRegion.Raw)
+	var diags rom.Diagnostics
 	var header Entry
-	binary.Read(bs, binary.LittleEndian, &header)
+	if err := binary.Read(bs, binary.LittleEndian, &header); err != nil {
+		return nil, nil
+	}
 	if !header.ValidHeader() {
-		return nil
+		return nil, nil
 	}
 
 	numEntries := rom.Size24(header.Len24)
 	headerSize := numEntries * 0x10
-	headerRegion := unknownRegion.Child(unknownRegion.Offset, headerSize,
-		"raw", fitTypes[header.Type])
+	if numEntries == 0 || !unknownRegion.Contains(unknownRegion.Offset, headerSize) {
+		diags.Errorf(detectorName, unknownRegion.Offset,
+			"bad FIT header: num entries=%v", numEntries)
+		return nil, diags
+	}
+	// entries can be added in the unused slots after the table
+	headerRegion := unknownRegion.Child(unknownRegion.Offset,
+		tableSlots(unknownRegion.Raw, numEntries), "fit_table", fitTypes[0])
 	regions := []*rom.Region{headerRegion}
 	log.Printf("FIT Header @ 0x%08x: Num Entries(inclusive)=%v",
 		unknownRegion.Offset, numEntries)
 
-	fullSize := unknownRegion.FullSize()
+	var acmRegions []*rom.Region
+	var bpmRegion *rom.Region
+	addresses := unknownRegion.AddressMap()
 	for n := uint32(0); n < numEntries-1; n++ {
 		var entry Entry
 		binary.Read(bs, binary.LittleEndian, &entry)
@@ -107,43 +168,142 @@ func detectFITRegions(unknownRegion *rom.Region) []*rom.Region {
 		}
 		log.Printf("FIT Entry %d: %#v", n, entry)
 		len := rom.Size24(entry.Len24) * 0x10
-		romOff := fullSize + uint32(entry.Address)
-		if !unknownRegion.Contains(romOff, 0) ||
+		romOff, mapped := addresses.FlashOffset(entry.Address, 0)
+		if !mapped || !unknownRegion.Contains(romOff, 0) ||
 			headerRegion.Contains(romOff, 0) {
+			diags.Infof(detectorName, unknownRegion.Offset+(n+1)*0x10,
+				"entry %v (%v) at 0x%016x is outside of the FIT region, skipping",
+				n, fitTypes[entry.Type], entry.Address)
 			continue
 		}
 
+		switch entry.Type & typeMask {
+		case 0x0b, 0x0c:
+			// KM and BPM sizes are in bytes in some FITs and in 16 byte
+			// units in others, use the size of the manifest
+			if size := parseBootGuardLen(unknownRegion, romOff, entry.Type&typeMask); size != 0 {
+				len = size
+			}
+		}
 		if len == 0 {
-			switch entry.Type {
+			switch entry.Type & typeMask {
+			case 0x01:
+				len = parseMicrocodeLen(unknownRegion, romOff)
 			case 0x02:
 				len = parseStartupAcmLen(unknownRegion, romOff)
 			}
 		}
 
 		if len != 0 {
-			regions = append(regions, unknownRegion.Child(
-				romOff, len, "raw", fitTypes[entry.Type],
-			))
+			if !unknownRegion.Contains(romOff, len) {
+				diags.Warnf(detectorName, unknownRegion.Offset+(n+1)*0x10,
+					"entry %v (%v) at 0x%08x runs past the end of the region: len=0x%08x",
+					n, fitTypes[entry.Type], romOff, len)
+				continue
+			}
+			entryRegion := unknownRegion.Child(romOff, len, "raw", fitTypes[entry.Type&typeMask])
+			switch entry.Type & typeMask {
+			case 0x01:
+				addMicrocodeMetadata(entryRegion, &diags)
+			case 0x02:
+				addStartupAcmMetadata(entryRegion, &diags)
+				acmRegions = append(acmRegions, entryRegion)
+			case 0x0b, 0x0c:
+				entryRegion = bootGuardRegion(entryRegion, entry.Type&typeMask)
+				if entry.Type&typeMask == 0x0c {
+					bpmRegion = entryRegion
+				}
+			}
+			regions = append(regions, entryRegion)
 		}
 	}
+	checkAcmSvn(acmRegions, bpmRegion, &diags)
 	// TODO: add dependencies on external locations
-	return regions
+	return regions, diags
 }
 
-type StartupAcmHeader struct {
-	ModuleType    uint16 // 0x00
-	ModuleSubType uint16 // 0x02
-	Misc          [0x14]uint8
-	Size          uint32 // 0x18
+func parseMicrocodeLen(unknownRegion *rom.Region, off uint32) uint32 {
+	u, err := microcode.Parse(unknownRegion.Raw[off-unknownRegion.Offset:])
+	if err != nil {
+		return 0
+	}
+	return uint32(len(u.Raw))
 }
 
-func parseStartupAcmLen(unknownRegion *rom.Region, off uint32) uint32 {
-	bs := bytes.NewReader(unknownRegion.Raw)
-	var header StartupAcmHeader
-	bs.Seek(int64(off-unknownRegion.Offset), io.SeekStart)
-	binary.Read(bs, binary.LittleEndian, &header)
-	if header.ModuleType == 0x0002 && header.ModuleSubType == 0x0001 {
-		return header.Size * 4
+func addMicrocodeMetadata(r *rom.Region, diags *rom.Diagnostics) {
+	u, err := microcode.Parse(r.Raw)
+	if err != nil {
+		diags.Warnf(detectorName, r.Offset, "invalid microcode update: err=%v", err)
+		return
+	}
+	if !u.ChecksumValid || !u.ExtendedChecksumValid {
+		diags.Warnf(detectorName, r.Offset, "microcode update checksum is invalid")
+	}
+	r.Metadata = u.Metadata()
+}
+
+func parseBootGuardLen(unknownRegion *rom.Region, off uint32, t uint8) uint32 {
+	raw := unknownRegion.Raw[off-unknownRegion.Offset:]
+	if t == 0x0b {
+		if km, err := bootguard.ParseKeyManifest(raw); err == nil {
+			return km.Size
+		}
+		return 0
+	}
+	if bpm, err := bootguard.ParseBootPolicyManifest(raw); err == nil {
+		return bpm.Size
 	}
 	return 0
 }
+
+// bootGuardRegion splits a key or boot policy manifest into typed regions
+func bootGuardRegion(r *rom.Region, t uint8) *rom.Region {
+	r.Type = "unknown"
+	if t == 0x0b {
+		r = rom.DetectRegions([]rom.Detector{bootguard.DetectKM}, r)
+		if km, err := bootguard.ParseKeyManifest(r.Raw); err == nil {
+			r.Metadata = km.Metadata()
+		}
+		return r
+	}
+	r = rom.DetectRegions([]rom.Detector{bootguard.DetectBPM}, r)
+	if bpm, err := bootguard.ParseBootPolicyManifest(r.Raw); err == nil {
+		r.Metadata = bpm.Metadata()
+	}
+	return r
+}
+
+func parseStartupAcmLen(unknownRegion *rom.Region, off uint32) uint32 {
+	a, err := acm.Parse(unknownRegion.Raw[off-unknownRegion.Offset:])
+	if err != nil {
+		return 0
+	}
+	return uint32(len(a.Raw))
+}
+
+func addStartupAcmMetadata(r *rom.Region, diags *rom.Diagnostics) {
+	a, err := acm.Parse(r.Raw)
+	if err != nil {
+		diags.Warnf(detectorName, r.Offset, "invalid startup ACM: err=%v", err)
+		return
+	}
+	r.Metadata = a.Metadata()
+}
+
+// checkAcmSvn warns about startup ACMs older than the BPM allows, the BPM
+// holds the lowest ACM SVN it may be verified by.
+func checkAcmSvn(acmRegions []*rom.Region, bpmRegion *rom.Region, diags *rom.Diagnostics) {
+	if bpmRegion == nil {
+		return
+	}
+	bpm, err := bootguard.ParseBootPolicyManifest(bpmRegion.Raw)
+	if err != nil {
+		return
+	}
+	for _, r := range acmRegions {
+		if a, err := acm.Parse(r.Raw); err == nil && a.Header.SeSvn < uint16(bpm.Header.ACMSVN) {
+			diags.Warnf(detectorName, r.Offset, "startup ACM SVN %d is below the BPM ACM SVN %d",
+				a.Header.SeSvn, bpm.Header.ACMSVN)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package fit
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+
+	"github.com/flammit/fwtools/pkg/rom"
+)
+
+func init() {
+	rom.RegisterHandler("fit_table", rom.StructHandler{
+		New: func() interface{} { return &TableConfig{} },
+		Decode: func(r *rom.Region) (interface{}, error) {
+			return DecodeTableConfig(r.Raw)
+		},
+		Encode: func(r *rom.Region, v interface{}) ([]byte, error) {
+			return v.(*TableConfig).Encode(r.Size)
+		},
+	})
+}
+
+const (
+	entrySize      = 0x10
+	typeMask       = 0x7f
+	checksumValid  = 0x80
+	maxTableSlots  = 0x40
+	maxEntrySize24 = 0xffffff
+)
+
+// TableConfig is the editable form of the FIT table.  The header entry
+// count follows the Entries list.  When ChecksumValid is set the header
+// checksum is recomputed over the table, a stored checksum that didn't
+// match is kept in BadChecksum and written back only while the table is
+// unchanged.  Checksum pins the header checksum byte: it is never set when
+// decoding a table with ChecksumValid, without it Checksum keeps a
+// non-zero byte.  Unused slots after the table are filled with Fill so
+// entries can be added up to the size of the region.
+type TableConfig struct {
+	ChecksumValid bool
+	Checksum      *rom.Hex8    `json:",omitempty"`
+	BadChecksum   *BadChecksum `json:",omitempty"`
+	Fill          rom.Hex8
+	Entries       []EntryConfig
+}
+
+// BadChecksum is a stored table checksum and the one the table sums to
+type BadChecksum struct {
+	Stored   rom.Hex8
+	Expected rom.Hex8
+}
+
+// EntryConfig is a FIT entry.  Size is the 24-bit size field, in units of
+// 16 bytes for most types.  Checksum is only meaningful with ChecksumValid,
+// it covers the component and is kept as is.
+type EntryConfig struct {
+	Type          string
+	Address       rom.Hex64
+	Size          rom.Hex32
+	Version       rom.Hex16
+	ChecksumValid bool
+	Checksum      rom.Hex8 `json:",omitempty"`
+	Reserved      rom.Hex8 `json:",omitempty"`
+}
+
+func typeName(t uint8) string {
+	if name, ok := fitTypes[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%02x", t)
+}
+
+func parseType(name string) (uint8, error) {
+	for t, typeName := range fitTypes {
+		if typeName == name {
+			return t, nil
+		}
+	}
+	t, err := strconv.ParseUint(name, 0, 8)
+	if err != nil || t > typeMask {
+		return 0, fmt.Errorf("fit: unknown entry type '%v'", name)
+	}
+	return uint8(t), nil
+}
+
+func tableChecksum(table []byte) uint8 {
+	var sum uint8
+	for _, b := range table {
+		sum += b
+	}
+	return sum
+}
+
+// tableSlots is the size of the FIT table at the start of raw, including
+// the unused slots after it that are all filled with the same byte.
+func tableSlots(raw []byte, numEntries uint32) uint32 {
+	size := numEntries * entrySize
+	if uint32(len(raw)) < size+entrySize {
+		return size
+	}
+	fill := raw[size]
+	for size+entrySize <= uint32(len(raw)) && size < maxTableSlots*entrySize {
+		if !bytes.Equal(raw[size:size+entrySize], bytes.Repeat([]byte{fill}, entrySize)) {
+			break
+		}
+		size += entrySize
+	}
+	return size
+}
+
+func DecodeTableConfig(raw []byte) (*TableConfig, error) {
+	bs := bytes.NewReader(raw)
+	var header Entry
+	if err := binary.Read(bs, binary.LittleEndian, &header); err != nil {
+		return nil, err
+	}
+	if !header.ValidHeader() || header.Type&typeMask != 0 {
+		return nil, fmt.Errorf("fit: invalid header entry")
+	}
+	numEntries := rom.Size24(header.Len24)
+	tableSize := numEntries * entrySize
+	if numEntries == 0 || tableSize > uint32(len(raw)) {
+		return nil, fmt.Errorf("fit: %v entries don't fit in 0x%x bytes", numEntries, len(raw))
+	}
+
+	c := &TableConfig{
+		ChecksumValid: header.Type&checksumValid != 0,
+		Fill:          0xff,
+		Entries:       []EntryConfig{},
+	}
+	switch {
+	case c.ChecksumValid && tableChecksum(raw[:tableSize]) != 0:
+		c.BadChecksum = &BadChecksum{
+			Stored:   rom.Hex8(header.Checksum),
+			Expected: rom.Hex8(header.Checksum - tableChecksum(raw[:tableSize])),
+		}
+	case !c.ChecksumValid && header.Checksum != 0:
+		checksum := rom.Hex8(header.Checksum)
+		c.Checksum = &checksum
+	}
+	if tableSize < uint32(len(raw)) {
+		c.Fill = rom.Hex8(raw[tableSize])
+	}
+	for n := uint32(1); n < numEntries; n++ {
+		var e Entry
+		binary.Read(bs, binary.LittleEndian, &e)
+		c.Entries = append(c.Entries, EntryConfig{
+			Type:          typeName(e.Type & typeMask),
+			Address:       rom.Hex64(e.Address),
+			Size:          rom.Hex32(rom.Size24(e.Len24)),
+			Version:       rom.Hex16(e.Version),
+			ChecksumValid: e.Type&checksumValid != 0,
+			Checksum:      rom.Hex8(e.Checksum),
+			Reserved:      rom.Hex8(e.Reserved),
+		})
+	}
+	return c, nil
+}
+
+func len24(size uint32) [3]uint8 {
+	return [3]uint8{uint8(size), uint8(size >> 8), uint8(size >> 16)}
+}
+
+func (c EntryConfig) encode() (Entry, error) {
+	t, err := parseType(c.Type)
+	if err != nil {
+		return Entry{}, err
+	}
+	if c.ChecksumValid {
+		t |= checksumValid
+	}
+	if c.Size > maxEntrySize24 {
+		return Entry{}, fmt.Errorf("fit: %v entry size 0x%x doesn't fit in 24 bits", c.Type, uint32(c.Size))
+	}
+	return Entry{
+		Address:  uint64(c.Address),
+		Len24:    len24(uint32(c.Size)),
+		Reserved: uint8(c.Reserved),
+		Version:  uint16(c.Version),
+		Type:     t,
+		Checksum: uint8(c.Checksum),
+	}, nil
+}
+
+func (c TableConfig) Encode(size uint32) ([]byte, error) {
+	numEntries := uint32(len(c.Entries)) + 1
+	if numEntries*entrySize > size {
+		return nil, fmt.Errorf("fit: %v entries don't fit in 0x%x bytes", numEntries, size)
+	}
+	header := Entry{
+		Address: fitSignature,
+		Len24:   len24(numEntries),
+		Version: fitVersion,
+	}
+	if c.ChecksumValid {
+		header.Type |= checksumValid
+	}
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, header)
+	for _, entry := range c.Entries {
+		e, err := entry.encode()
+		if err != nil {
+			return nil, err
+		}
+		binary.Write(&b, binary.LittleEndian, e)
+	}
+
+	raw := bytes.Repeat([]byte{uint8(c.Fill)}, int(size))
+	copy(raw, b.Bytes())
+	switch {
+	case c.Checksum != nil:
+		raw[entrySize-1] = uint8(*c.Checksum)
+	case c.ChecksumValid:
+		sum := -tableChecksum(raw[:numEntries*entrySize])
+		if c.BadChecksum != nil && uint8(c.BadChecksum.Expected) == sum {
+			sum = uint8(c.BadChecksum.Stored)
+		}
+		raw[entrySize-1] = sum
+	}
+	return raw, nil
+}
+
+// ReplaceMicrocode swaps the microcode entries selected by replace for new
+// entries pointing at addresses.  The new entries take the place of the
+// first replaced entry, or follow the other microcode entries, so the
+// table stays sorted by type.
+func (c *TableConfig) ReplaceMicrocode(replace func(EntryConfig) bool, addresses []uint64) {
+	microcodeType := typeName(0x01)
+	added := []EntryConfig{}
+	for _, address := range addresses {
+		added = append(added, EntryConfig{
+			Type:    microcodeType,
+			Address: rom.Hex64(address),
+			Version: fitVersion,
+		})
+	}
+
+	entries := []EntryConfig{}
+	insert := -1
+	for _, entry := range c.Entries {
+		if entry.Type == microcodeType && replace(entry) {
+			if insert < 0 {
+				insert = len(entries)
+			}
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if insert < 0 {
+		insert = 0
+		for n, entry := range entries {
+			if entry.Type == microcodeType {
+				insert = n + 1
+			}
+		}
+	}
+	c.Entries = append(entries[:insert], append(added, entries[insert:]...)...)
+}
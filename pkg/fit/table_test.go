@@ -0,0 +1,155 @@
+package fit
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"github.com/flammit/fwtools/pkg/rom"
+)
+
+// testTable is a FIT with a microcode and a startup ACM entry in a 0x100
+// byte region, with a valid checksum.
+func testTable() []byte {
+	var b bytes.Buffer
+	for _, e := range []Entry{
+		{Address: fitSignature, Len24: len24(3), Version: fitVersion, Type: checksumValid},
+		{Address: 0xff2110f8, Version: fitVersion, Type: 0x01},
+		{Address: 0xfff10000, Version: fitVersion, Type: 0x02},
+	} {
+		binary.Write(&b, binary.LittleEndian, e)
+	}
+	raw := append(b.Bytes(), bytes.Repeat([]byte{0xff}, 0x100-b.Len())...)
+	raw[entrySize-1] = -tableChecksum(raw[:3*entrySize])
+	return raw
+}
+
+func roundTrip(t *testing.T, raw []byte) (*TableConfig, []byte) {
+	c, err := DecodeTableConfig(raw)
+	if err != nil {
+		t.Fatalf("DecodeTableConfig() err=%v", err)
+	}
+	encoded, err := c.Encode(uint32(len(raw)))
+	if err != nil {
+		t.Fatalf("Encode() err=%v", err)
+	}
+	return c, encoded
+}
+
+func TestTableRoundTrip(t *testing.T) {
+	raw := testTable()
+	c, encoded := roundTrip(t, raw)
+	if !bytes.Equal(encoded, raw) {
+		t.Errorf("Encode(DecodeTableConfig()) = %x, want %x", encoded[:0x30], raw[:0x30])
+	}
+	if len(c.Entries) != 2 || c.Entries[1].Type != "startup_acm" || c.BadChecksum != nil {
+		t.Errorf("DecodeTableConfig() = %+v", c)
+	}
+}
+
+func TestTableChecksum(t *testing.T) {
+	raw := testTable()
+	raw[entrySize-1]++
+	c, encoded := roundTrip(t, raw)
+	if c.BadChecksum == nil || !bytes.Equal(encoded, raw) {
+		t.Fatalf("bad checksum isn't kept: %+v", c.BadChecksum)
+	}
+
+	// an edited table gets a new checksum
+	c.Entries[0].Address = 0xff220000
+	encoded, err := c.Encode(uint32(len(raw)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum := tableChecksum(encoded[:3*entrySize]); sum != 0 {
+		t.Errorf("edited table sums to 0x%02x", sum)
+	}
+
+	// unless it is pinned
+	pinned := rom.Hex8(0x42)
+	c.Checksum = &pinned
+	encoded, err = c.Encode(uint32(len(raw)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encoded[entrySize-1] != 0x42 {
+		t.Errorf("pinned checksum is 0x%02x", encoded[entrySize-1])
+	}
+}
+
+func TestReplaceMicrocode(t *testing.T) {
+	entries := func(entries ...string) []EntryConfig {
+		list := []EntryConfig{}
+		for _, e := range entries {
+			var address uint64
+			var entryType string
+			fmt.Sscanf(e, "%s %x", &entryType, &address)
+			list = append(list, EntryConfig{Type: entryType, Address: rom.Hex64(address), Version: fitVersion})
+		}
+		return list
+	}
+	// the microcode area at 0xff210000
+	inArea := func(entry EntryConfig) bool {
+		return entry.Address >= 0xff210000 && entry.Address < 0xff220000
+	}
+
+	for _, tt := range []struct {
+		name      string
+		entries   []EntryConfig
+		addresses []uint64
+		want      []EntryConfig
+	}{
+		{
+			name:      "repacked in place",
+			entries:   entries("microcode ff2110f8", "microcode ff300000", "startup_acm fff10000"),
+			addresses: []uint64{0xff210000, 0xff210400},
+			want:      entries("microcode ff210000", "microcode ff210400", "microcode ff300000", "startup_acm fff10000"),
+		},
+		{
+			name:      "area after other updates",
+			entries:   entries("microcode ff200000", "microcode ff210400", "microcode ff211000", "startup_acm fff10000"),
+			addresses: []uint64{0xff210000},
+			want:      entries("microcode ff200000", "microcode ff210000", "startup_acm fff10000"),
+		},
+		{
+			name:      "all removed",
+			entries:   entries("microcode ff210000", "microcode ff210400", "startup_acm fff10000"),
+			addresses: []uint64{},
+			want:      entries("startup_acm fff10000"),
+		},
+		{
+			name:      "area without entries",
+			entries:   entries("microcode ff200000", "startup_acm fff10000"),
+			addresses: []uint64{0xff210000},
+			want:      entries("microcode ff200000", "microcode ff210000", "startup_acm fff10000"),
+		},
+		{
+			name:      "no microcode entries",
+			entries:   entries("startup_acm fff10000"),
+			addresses: []uint64{0xff210000, 0xff210800},
+			want:      entries("microcode ff210000", "microcode ff210800", "startup_acm fff10000"),
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &TableConfig{ChecksumValid: true, Fill: 0xff, Entries: tt.entries}
+			c.ReplaceMicrocode(inArea, tt.addresses)
+			if fmt.Sprint(c.Entries) != fmt.Sprint(tt.want) {
+				t.Errorf("ReplaceMicrocode() = %+v, want %+v", c.Entries, tt.want)
+			}
+
+			// the header count and checksum follow the new entries
+			raw, err := c.Encode(0x100)
+			if err != nil {
+				t.Fatalf("Encode() err=%v", err)
+			}
+			decoded, err := DecodeTableConfig(raw)
+			if err != nil {
+				t.Fatalf("DecodeTableConfig(Encode()) err=%v", err)
+			}
+			if decoded.BadChecksum != nil || fmt.Sprint(decoded.Entries) != fmt.Sprint(tt.want) {
+				t.Errorf("DecodeTableConfig(Encode()) = %+v", decoded)
+			}
+		})
+	}
+}
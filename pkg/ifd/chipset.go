@@ -0,0 +1,256 @@
+package ifd
+
+// Strap definitions per chipset, collected from ifdtool, flashrom's
+// ich_descriptors.c and the PCH datasheets.  Bits without a definition are
+// still kept in the PchStraps/CpuStraps dwords.  The SPI clocks of FLCOMP
+// are named in the components config, they aren't straps here.
+
+var (
+	enabled = map[uint32]string{
+		0: "disabled",
+		1: "enabled",
+	}
+
+	meDisable = StrapField{
+		Name:        "AltMeDisable",
+		Section:     PchStrap,
+		Dword:       10,
+		Lsb:         7,
+		Msb:         7,
+		Description: "ME disabled after bring-up (AltMeDisable)",
+		Values:      enabled,
+	}
+
+	hap = StrapField{
+		Name:        "HAP",
+		Section:     PchStrap,
+		Dword:       0,
+		Lsb:         16,
+		Msb:         16,
+		Description: "High Assurance Platform, ME disabled after bring-up",
+		Values:      enabled,
+	}
+
+	meBootFlash = StrapField{
+		Name:        "MeBootFlash",
+		Section:     PchStrap,
+		Dword:       10,
+		Lsb:         1,
+		Msb:         1,
+		Description: "ME boots from the flash (ME_BOOT_FLASH)",
+		Values:      enabled,
+	}
+
+	// SMBus/SMLink enables of 5 to 9 series PCHs
+	smbusStraps = []StrapField{
+		{
+			Name:        "SmbusEnable",
+			Section:     PchStrap,
+			Dword:       0,
+			Lsb:         7,
+			Msb:         7,
+			Description: "ME SMBus controller (SMB_EN)",
+			Values:      enabled,
+		},
+		{
+			Name:        "SmLink0Enable",
+			Section:     PchStrap,
+			Dword:       0,
+			Lsb:         8,
+			Msb:         8,
+			Description: "SMLink0 segment (SML0_EN)",
+			Values:      enabled,
+		},
+		{
+			Name:        "SmLink1Enable",
+			Section:     PchStrap,
+			Dword:       0,
+			Lsb:         9,
+			Msb:         9,
+			Description: "SMLink1 segment (SML1_EN)",
+			Values:      enabled,
+		},
+	}
+
+	ichStraps = concatStraps([]StrapField{
+		{
+			Name:        "MeDisable",
+			Section:     PchStrap,
+			Dword:       0,
+			Lsb:         0,
+			Msb:         0,
+			Description: "ICH ME disable (ICH_MeDisable)",
+			Values:      enabled,
+		},
+		{
+			Name:        "MchMeDisable",
+			Section:     CpuStrap,
+			Dword:       0,
+			Lsb:         0,
+			Msb:         0,
+			Description: "MCH ME disable (MCH_MeDisable)",
+			Values:      enabled,
+		},
+		{
+			Name:        "MchAltMeDisable",
+			Section:     CpuStrap,
+			Dword:       0,
+			Lsb:         7,
+			Msb:         7,
+			Description: "MCH ME disabled after bring-up (MCH_AltMeDisable)",
+			Values:      enabled,
+		},
+	})
+
+	ibxStraps = concatStraps(smbusStraps, []StrapField{
+		meBootFlash,
+		meDisable,
+	})
+
+	cptStraps = concatStraps(smbusStraps, []StrapField{
+		{
+			Name:        "BootBlockSize",
+			Section:     PchStrap,
+			Dword:       0,
+			Lsb:         28,
+			Msb:         29,
+			Description: "BIOS boot-block size (BBBS) for top swap",
+			Values: map[uint32]string{
+				0: "64KB",
+				1: "128KB",
+				2: "256KB",
+				3: "512KB",
+			},
+		},
+		{
+			Name:        "PciePortConfig1",
+			Section:     PchStrap,
+			Dword:       9,
+			Lsb:         0,
+			Msb:         1,
+			Description: "PCIe root ports 1-4 configuration (PCIEPCS1)",
+			Values: map[uint32]string{
+				0: "4x1",
+				1: "1x2+2x1",
+				2: "2x2",
+				3: "1x4",
+			},
+		},
+		{
+			Name:        "PciePortConfig2",
+			Section:     PchStrap,
+			Dword:       9,
+			Lsb:         2,
+			Msb:         3,
+			Description: "PCIe root ports 5-8 configuration (PCIEPCS2)",
+			Values: map[uint32]string{
+				0: "4x1",
+				1: "1x2+2x1",
+				2: "2x2",
+				3: "1x4",
+			},
+		},
+		meBootFlash,
+		meDisable,
+		{
+			Name:        "IntegratedClock",
+			Section:     PchStrap,
+			Dword:       17,
+			Lsb:         0,
+			Msb:         0,
+			Description: "Integrated clock mode (ICC_SEL)",
+			Values: map[uint32]string{
+				0: "buffered-through",
+				1: "full-integrated",
+			},
+		},
+	})
+
+	// Lynx Point and Wildcat Point share the SMBus and ME straps of Cougar
+	// Point.
+	lptStraps = concatStraps(smbusStraps, []StrapField{
+		meBootFlash,
+		meDisable,
+	})
+
+	// HAP is at the same place on all IFDv2 PCHs, ifdtool sets it for all
+	// of its IFDv2 platforms.  The other IFDv2 straps are only described in
+	// Intel's SPI programming guides, which aren't public, so the IFDv2
+	// chipsets share this table until a generation gets its own fields.
+	ifd2Straps = []StrapField{
+		hap,
+	}
+
+	// Chipsets are the known strap definition sets, a descriptor config
+	// can pick one by name.
+	Chipsets = []*Chipset{
+		{
+			Name:        "ich",
+			Description: "ICH8/ICH9/ICH10",
+			Version:     Version1,
+			Straps:      ichStraps,
+		},
+		{
+			Name:        "ibx",
+			Description: "5 series Ibex Peak",
+			Version:     Version1,
+			Straps:      ibxStraps,
+		},
+		{
+			Name:        "cpt",
+			Description: "6/7 series Cougar Point/Panther Point (Sandy Bridge/Ivy Bridge)",
+			Version:     Version1,
+			Straps:      cptStraps,
+		},
+		{
+			Name:        "lpt",
+			Description: "8/9 series Lynx Point/Wildcat Point (Haswell/Broadwell)",
+			Version:     Version1,
+			Straps:      lptStraps,
+		},
+		{
+			Name:        "ifd1",
+			Description: "unknown IFDv1 chipset (e.g. Bay Trail)",
+			Version:     Version1,
+			Straps:      []StrapField{},
+		},
+		{
+			Name:        "spt",
+			Description: "100/200 series Sunrise Point/Union Point (Skylake/Kaby Lake)",
+			Version:     Version2,
+			Straps:      ifd2Straps,
+		},
+		{
+			Name:        "cnp",
+			Description: "300/400/495 series Cannon Point/Comet Point/Ice Point (Coffee Lake/Comet Lake/Ice Lake)",
+			Version:     Version2,
+			Straps:      ifd2Straps,
+		},
+		{
+			Name:        "tgp",
+			Description: "500 series Tiger Point (Tiger Lake)",
+			Version:     Version2,
+			Straps:      ifd2Straps,
+		},
+		{
+			Name:        "adp",
+			Description: "600 series Alder Point (Alder Lake)",
+			Version:     Version2,
+			Straps:      ifd2Straps,
+		},
+		{
+			Name:        "ifd2",
+			Description: "unknown IFDv2 chipset",
+			Version:     Version2,
+			Straps:      ifd2Straps,
+		},
+	}
+)
+
+func concatStraps(lists ...[]StrapField) []StrapField {
+	straps := []StrapField{}
+	for _, list := range lists {
+		straps = append(straps, list...)
+	}
+	return straps
+}
@@ -0,0 +1,294 @@
+package ifd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/flammit/fwtools/pkg/rom"
+)
+
+// SPI clock frequencies used by the FLCOMP clock fields
+const (
+	spiFrequency20MHz    = 0
+	spiFrequency33MHz    = 1
+	spiFrequency48MHz    = 2
+	spiFrequency50MHz30M = 4 // 50MHz on IFDv1, 30MHz on IFDv2
+	spiFrequency17MHz    = 6
+)
+
+func frequencyName(v Version, freq uint32) string {
+	switch freq {
+	case spiFrequency20MHz:
+		return "20MHz"
+	case spiFrequency33MHz:
+		return "33MHz"
+	case spiFrequency48MHz:
+		return "48MHz"
+	case spiFrequency50MHz30M:
+		if v == Version2 {
+			return "30MHz"
+		}
+		return "50MHz"
+	case spiFrequency17MHz:
+		return "17MHz"
+	}
+	return fmt.Sprintf("0x%x", freq)
+}
+
+func parseFrequency(name string) (uint32, error) {
+	switch name {
+	case "20MHz":
+		return spiFrequency20MHz, nil
+	case "33MHz":
+		return spiFrequency33MHz, nil
+	case "48MHz":
+		return spiFrequency48MHz, nil
+	case "50MHz", "30MHz":
+		return spiFrequency50MHz30M, nil
+	case "17MHz":
+		return spiFrequency17MHz, nil
+	}
+	freq, err := strconv.ParseUint(name, 0, 3)
+	if err != nil {
+		return 0, fmt.Errorf("ifd: unknown SPI frequency '%v'", name)
+	}
+	return uint32(freq), nil
+}
+
+// versionFromFlcomp guesses the descriptor layout version from the read
+// clock frequency as done by ifdtool, IFDv2 chipsets can't run the SPI read
+// clock at 20MHz.
+func versionFromFlcomp(flcomp uint32) Version {
+	switch (flcomp >> 17) & 7 {
+	case spiFrequency50MHz30M, spiFrequency17MHz:
+		return Version2
+	}
+	return Version1
+}
+
+const (
+	densityUnused = 0xf
+)
+
+// DensityNames are the FLCOMP component densities, IFDv1 only has room
+// for the first six.
+var (
+	DensityNames = []string{
+		"512KB",
+		"1MB",
+		"2MB",
+		"4MB",
+		"8MB",
+		"16MB",
+		"32MB",
+		"64MB",
+	}
+)
+
+func densityName(density uint32) string {
+	if density == densityUnused {
+		return "unused"
+	}
+	if density < uint32(len(DensityNames)) {
+		return DensityNames[density]
+	}
+	return fmt.Sprintf("0x%x", density)
+}
+
+func parseDensity(name string) (uint32, error) {
+	if name == "unused" {
+		return densityUnused, nil
+	}
+	for density, densityName := range DensityNames {
+		if name == densityName {
+			return uint32(density), nil
+		}
+	}
+	density, err := strconv.ParseUint(name, 0, 4)
+	if err != nil {
+		return 0, fmt.Errorf("ifd: unknown component density '%v'", name)
+	}
+	return uint32(density), nil
+}
+
+// DensityBytes returns the size of a component density, or 0 for unused
+// and unknown densities.
+func DensityBytes(name string) uint32 {
+	for density, densityName := range DensityNames {
+		if name == densityName {
+			return 0x80000 << uint(density)
+		}
+	}
+	return 0
+}
+
+// densityBits is the width of each component density field in FLCOMP
+func (v Version) densityBits() uint {
+	if v == Version2 {
+		return 4
+	}
+	return 3
+}
+
+// ComponentsConfig is the decoded component section: FLCOMP, FLILL and
+// FLPB (FLILL1 on IFDv2).  Reserved keeps FLCOMP bits that have no field.
+type ComponentsConfig struct {
+	Densities          []string
+	ReadClock          string
+	FastRead           bool
+	FastReadClock      string
+	WriteEraseClock    string
+	ReadIdStatusClock  string
+	DualOutputFastRead bool
+	Reserved           rom.Hex32 `json:",omitempty"`
+
+	// opcodes the SPI controller refuses to send, FLILL then FLILL1
+	InvalidInstructions []rom.Hex8
+
+	// FLPB, IFDv1 only: flash address where the second partition starts
+	PartitionBoundary *rom.Hex32 `json:",omitempty"`
+	FlpbReserved      rom.Hex32  `json:",omitempty"`
+}
+
+const (
+	numComponentDwords = 3
+	flpbBoundaryMask   = 0x1fff
+)
+
+func decodeComponents(dwords []rom.Hex32) ComponentsConfig {
+	flcomp, flill, flpb := uint32(dwords[0]), uint32(dwords[1]), uint32(dwords[2])
+	v := versionFromFlcomp(flcomp)
+	bits := v.densityBits()
+	mask := uint32(1)<<bits - 1
+
+	c := ComponentsConfig{
+		Densities: []string{
+			densityName(flcomp & mask),
+			densityName((flcomp >> bits) & mask),
+		},
+		ReadClock:          frequencyName(v, (flcomp>>17)&7),
+		FastRead:           (flcomp>>20)&1 != 0,
+		FastReadClock:      frequencyName(v, (flcomp>>21)&7),
+		WriteEraseClock:    frequencyName(v, (flcomp>>24)&7),
+		ReadIdStatusClock:  frequencyName(v, (flcomp>>27)&7),
+		DualOutputFastRead: (flcomp>>30)&1 != 0,
+		Reserved:           rom.Hex32(flcomp &^ (mask | mask<<bits | 0x7ffe0000)),
+	}
+
+	ill := []uint32{flill}
+	if v == Version2 {
+		ill = append(ill, flpb)
+	} else {
+		boundary := rom.Hex32((flpb & flpbBoundaryMask) << 12)
+		c.PartitionBoundary = &boundary
+		c.FlpbReserved = rom.Hex32(flpb &^ flpbBoundaryMask)
+	}
+	for _, dword := range ill {
+		for n := uint(0); n < 32; n += 8 {
+			c.InvalidInstructions = append(c.InvalidInstructions, rom.Hex8(dword>>n))
+		}
+	}
+	return c
+}
+
+func (c ComponentsConfig) version() Version {
+	freq, err := parseFrequency(c.ReadClock)
+	if err != nil {
+		return Version1
+	}
+	return versionFromFlcomp(freq << 17)
+}
+
+func (c ComponentsConfig) encode() ([]rom.Hex32, error) {
+	v := c.version()
+	bits := v.densityBits()
+	mask := uint32(1)<<bits - 1
+
+	if len(c.Densities) != 2 {
+		return nil, fmt.Errorf("ifd: components need 2 densities, got %v", len(c.Densities))
+	}
+	flcomp := uint32(c.Reserved)
+	for n, name := range c.Densities {
+		density, err := parseDensity(name)
+		if err != nil {
+			return nil, err
+		}
+		if density > mask {
+			return nil, fmt.Errorf("ifd: density '%v' doesn't fit IFDv%d", name, v)
+		}
+		flcomp |= density << (bits * uint(n))
+	}
+	for _, field := range []struct {
+		name  string
+		shift uint
+	}{
+		{c.ReadClock, 17},
+		{c.FastReadClock, 21},
+		{c.WriteEraseClock, 24},
+		{c.ReadIdStatusClock, 27},
+	} {
+		freq, err := parseFrequency(field.name)
+		if err != nil {
+			return nil, err
+		}
+		flcomp |= freq << field.shift
+	}
+	if c.FastRead {
+		flcomp |= 1 << 20
+	}
+	if c.DualOutputFastRead {
+		flcomp |= 1 << 30
+	}
+
+	numIll := 4
+	if v == Version2 {
+		numIll = 8
+	}
+	if len(c.InvalidInstructions) != numIll {
+		return nil, fmt.Errorf("ifd: IFDv%d has %v invalid instructions, got %v",
+			v, numIll, len(c.InvalidInstructions))
+	}
+	ill := []uint32{0, 0}
+	for n, opcode := range c.InvalidInstructions {
+		ill[n/4] |= uint32(opcode) << (8 * uint(n%4))
+	}
+
+	flpb := ill[1]
+	if v == Version1 {
+		if c.PartitionBoundary == nil {
+			return nil, fmt.Errorf("ifd: IFDv1 components need a partition boundary")
+		}
+		boundary := uint32(*c.PartitionBoundary)
+		if boundary&0xfff != 0 || boundary>>12 > flpbBoundaryMask {
+			return nil, fmt.Errorf("ifd: invalid partition boundary 0x%08x", boundary)
+		}
+		flpb = boundary>>12 | uint32(c.FlpbReserved)
+	}
+	return []rom.Hex32{rom.Hex32(flcomp), rom.Hex32(ill[0]), rom.Hex32(flpb)}, nil
+}
+
+// Size is the flash size declared by the first numComponents densities.
+func (c ComponentsConfig) Size(numComponents uint32) uint32 {
+	size := uint32(0)
+	for n := 0; n < int(numComponents) && n < len(c.Densities); n++ {
+		size += DensityBytes(c.Densities[n])
+	}
+	return size
+}
+
+// FlashSize is the flash size declared by the components in use.
+func (c Config) FlashSize() uint32 {
+	return c.Components.Size(c.header().NumComponents())
+}
+
+func (c ComponentsConfig) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "densities %v, read %v, fast read %v (%v), write/erase %v, read id/status %v",
+		strings.Join(c.Densities, "/"), c.ReadClock, c.FastRead, c.FastReadClock,
+		c.WriteEraseClock, c.ReadIdStatusClock)
+	if c.DualOutputFastRead {
+		fmt.Fprintf(&b, ", dual output fast read")
+	}
+	return b.String()
+}
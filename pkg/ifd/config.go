@@ -0,0 +1,376 @@
+package ifd
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/flammit/fwtools/pkg/rom"
+)
+
+func init() {
+	rom.RegisterHandler("ifd", rom.StructHandler{
+		New: func() interface{} { return &Config{} },
+		Decode: func(r *rom.Region) (interface{}, error) {
+			return DecodeConfig(r.Raw)
+		},
+		Encode: func(r *rom.Region, v interface{}) ([]byte, error) {
+			return v.(*Config).Encode(r.Size)
+		},
+	})
+}
+
+const (
+	descriptorSize = 0x1000
+	flumap0Offset  = 0xeec // relative to the signature
+	oemOffset      = 0xf00
+	oemSize        = 0x100
+)
+
+// Config is the editable form of the descriptor region.  Section bases and
+// lengths come from the FLMAP registers, the section lists must keep the
+// lengths the FLMAPs declare.  Non-empty bytes outside of the known
+// sections are kept in Extra.
+//
+// Straps are the named strap fields of Chipset.  On encode a strap whose
+// Value was edited since decode is written over the PchStraps/CpuStraps
+// bits, an unchanged one keeps the bits of the dwords.
+type Config struct {
+	SigOffset rom.Hex32
+	FlMap0    rom.Hex32
+	FlMap1    rom.Hex32
+	FlMap2    rom.Hex32
+	FlMap3    rom.Hex32
+	FlUmap0   rom.Hex32
+
+	Regions    []RegionConfig
+	Components ComponentsConfig
+	Masters    []MasterConfig
+	PchStraps  []rom.Hex32
+	CpuStraps  []rom.Hex32
+	Chipset    string
+	Straps     []StrapValue `json:",omitempty"`
+	Vscc       []VsccConfig
+	Oem        rom.HexBytes `json:",omitempty"`
+	Extra      []rom.Chunk  `json:",omitempty"`
+}
+
+// RegionConfig is a FLREG entry, Base and Limit are flash addresses of the
+// first and last byte of the region.
+type RegionConfig struct {
+	Name     string
+	Base     rom.Hex32
+	Limit    rom.Hex32
+	Reserved rom.Hex32 `json:",omitempty"`
+}
+
+type VsccConfig struct {
+	Jid  rom.Hex32
+	Vscc rom.Hex32
+}
+
+func (c Config) header() Header {
+	return Header{
+		FlMap0:  uint32(c.FlMap0),
+		FlMap1:  uint32(c.FlMap1),
+		FlMap2:  uint32(c.FlMap2),
+		FlMap3:  uint32(c.FlMap3),
+		FlUmap0: uint32(c.FlUmap0),
+	}
+}
+
+// section is a run of dwords in the descriptor described by the FLMAPs
+type section struct {
+	name   string
+	offset uint32
+	dwords uint32
+}
+
+type sections struct {
+	regions    section
+	components section
+	masters    section
+	pchStraps  section
+	cpuStraps  section
+	vscc       section
+}
+
+func (c Config) sections() sections {
+	h := c.header()
+	v := c.Version()
+	return sections{
+		regions:    section{"regions", h.FlashRegionBaseAddress(), v.numRegions(h)},
+		components: section{"components", h.FlashComponentBaseAddress(), numComponentDwords},
+		masters:    section{"masters", h.FlashMasterBaseAddress(), v.numMasters(h)},
+		pchStraps:  section{"pch straps", h.FlashPchStrapBaseAddress(), h.PchStrapLength()},
+		cpuStraps:  section{"cpu straps", h.FlashCpuStrapBaseAddress(), h.CpuStrapLength()},
+		vscc:       section{"vscc table", h.VsccTableBaseAddress(), h.VsccTableLength() &^ 1},
+	}
+}
+
+func readDwords(raw []byte, s section) ([]rom.Hex32, error) {
+	if uint64(s.offset)+uint64(s.dwords)*4 > uint64(len(raw)) {
+		return nil, fmt.Errorf("ifd: %v at 0x%x (%v dwords) is outside of the descriptor",
+			s.name, s.offset, s.dwords)
+	}
+	dwords := make([]rom.Hex32, s.dwords)
+	for n := range dwords {
+		dwords[n] = rom.Hex32(binary.LittleEndian.Uint32(raw[s.offset+uint32(n)*4:]))
+	}
+	return dwords, nil
+}
+
+func writeDwords(raw []byte, s section, dwords []rom.Hex32) error {
+	if uint32(len(dwords)) != s.dwords {
+		return fmt.Errorf("ifd: %v has %v dwords, FLMAP declares %v",
+			s.name, len(dwords), s.dwords)
+	}
+	if uint64(s.offset)+uint64(s.dwords)*4 > uint64(len(raw)) {
+		return fmt.Errorf("ifd: %v at 0x%x (%v dwords) is outside of the descriptor",
+			s.name, s.offset, s.dwords)
+	}
+	for n, dword := range dwords {
+		binary.LittleEndian.PutUint32(raw[s.offset+uint32(n)*4:], uint32(dword))
+	}
+	return nil
+}
+
+func DecodeConfig(raw []byte) (*Config, error) {
+	var sigOff uint32
+	if len(raw) < 0x20 {
+		return nil, fmt.Errorf("ifd: descriptor too small: 0x%x", len(raw))
+	}
+	if binary.LittleEndian.Uint32(raw) != ifdSignature {
+		sigOff = 0x10
+		if binary.LittleEndian.Uint32(raw[sigOff:]) != ifdSignature {
+			return nil, fmt.Errorf("ifd: missing descriptor signature")
+		}
+	}
+	if uint32(len(raw)) < sigOff+flumap0Offset+4 {
+		return nil, fmt.Errorf("ifd: descriptor too small: 0x%x", len(raw))
+	}
+
+	dword := func(off uint32) rom.Hex32 {
+		return rom.Hex32(binary.LittleEndian.Uint32(raw[off:]))
+	}
+	c := &Config{
+		SigOffset: rom.Hex32(sigOff),
+		FlMap0:    dword(sigOff + 0x4),
+		FlMap1:    dword(sigOff + 0x8),
+		FlMap2:    dword(sigOff + 0xc),
+		FlMap3:    dword(sigOff + 0x10),
+		FlUmap0:   dword(sigOff + flumap0Offset),
+	}
+
+	var err error
+	coverage := rom.NewCoverage(uint32(len(raw)))
+	coverage.Cover(sigOff, 0x14)
+	coverage.Cover(sigOff+flumap0Offset, 4)
+
+	read := func(s section) []rom.Hex32 {
+		if err != nil {
+			return nil
+		}
+		var dwords []rom.Hex32
+		dwords, err = readDwords(raw, s)
+		coverage.Cover(s.offset, s.dwords*4)
+		return dwords
+	}
+	components := read(c.sections().components)
+	if err != nil {
+		return nil, err
+	}
+	c.Components = decodeComponents(components)
+	// the region and master layouts depend on the version from the components
+	s := c.sections()
+	regions := read(s.regions)
+	masters := read(s.masters)
+	c.PchStraps = read(s.pchStraps)
+	c.CpuStraps = read(s.cpuStraps)
+	vscc := read(s.vscc)
+	if err != nil {
+		return nil, err
+	}
+	c.Regions = c.Version().decodeRegions(regions)
+	c.setMasterDwords(masters)
+	c.Chipset = detectChipset(c.header(), c.Version())
+	chipset, err := LookupChipset(c.Chipset)
+	if err != nil {
+		return nil, err
+	}
+	c.Straps = chipset.decodeStraps(strapSections{
+		PchStrap: uint32s(c.PchStraps),
+		CpuStrap: uint32s(c.CpuStraps),
+	})
+	for n := 0; n < len(vscc); n += 2 {
+		c.Vscc = append(c.Vscc, VsccConfig{Jid: vscc[n], Vscc: vscc[n+1]})
+	}
+
+	if uint32(len(raw)) >= oemOffset+oemSize {
+		oem := raw[oemOffset : oemOffset+oemSize]
+		coverage.Cover(oemOffset, oemSize)
+		if !(rom.Region{Raw: oem}).Empty() {
+			c.Oem = rom.HexBytes(append([]byte{}, oem...))
+		}
+	}
+
+	c.Extra = coverage.Chunks(raw)
+	return c, nil
+}
+
+// ReadConfig decodes the descriptor at the start of a full flash image.
+func ReadConfig(romBytes []byte) (*Config, error) {
+	if len(romBytes) < descriptorSize {
+		return nil, fmt.Errorf("ifd: image too small for a descriptor: 0x%x", len(romBytes))
+	}
+	return DecodeConfig(romBytes[:descriptorSize])
+}
+
+// WriteConfig encodes the descriptor back into the start of a full flash
+// image.
+func WriteConfig(romBytes []byte, c *Config) error {
+	raw, err := c.Encode(descriptorSize)
+	if err != nil {
+		return err
+	}
+	copy(romBytes, raw)
+	return nil
+}
+
+// decodeRegions converts FLREG dwords, unused regions have a Limit below
+// their Base.
+func (v Version) decodeRegions(dwords []rom.Hex32) []RegionConfig {
+	mask := v.regionMask()
+	regions := []RegionConfig{}
+	for n, flreg := range dwords {
+		regions = append(regions, RegionConfig{
+			Name:     v.regionName(n),
+			Base:     rom.Hex32((uint32(flreg) & mask) << 12),
+			Limit:    rom.Hex32(((uint32(flreg)>>16)&mask)<<12 | 0xfff),
+			Reserved: flreg &^ rom.Hex32(mask|mask<<16),
+		})
+	}
+	return regions
+}
+
+func (v Version) encodeRegions(regions []RegionConfig) ([]rom.Hex32, error) {
+	mask := rom.Hex32(v.regionMask())
+	dwords := []rom.Hex32{}
+	for n, region := range regions {
+		if region.Name != v.regionName(n) {
+			return nil, fmt.Errorf("ifd: FLREG%d is region %v in IFDv%d, got %v",
+				n, v.regionName(n), v, region.Name)
+		}
+		if region.Base&0xfff != 0 || region.Limit&0xfff != 0xfff {
+			return nil, fmt.Errorf("ifd: region %v (0x%08x - 0x%08x) is not 4K aligned",
+				region.Name, uint32(region.Base), uint32(region.Limit))
+		}
+		if region.Base>>12 > mask || region.Limit>>12 > mask {
+			return nil, fmt.Errorf("ifd: region %v (0x%08x - 0x%08x) is out of range",
+				region.Name, uint32(region.Base), uint32(region.Limit))
+		}
+		dwords = append(dwords, region.Base>>12|(region.Limit>>12)<<16|region.Reserved)
+	}
+	return dwords, nil
+}
+
+func uint32s(dwords []rom.Hex32) []uint32 {
+	values := make([]uint32, len(dwords))
+	for n, dword := range dwords {
+		values[n] = uint32(dword)
+	}
+	return values
+}
+
+func hex32s(values []uint32) []rom.Hex32 {
+	dwords := make([]rom.Hex32, len(values))
+	for n, value := range values {
+		dwords[n] = rom.Hex32(value)
+	}
+	return dwords
+}
+
+// strapDwords returns the strap sections with the named straps applied.
+func (c Config) strapDwords() ([]rom.Hex32, []rom.Hex32, error) {
+	pch, cpu := uint32s(c.PchStraps), uint32s(c.CpuStraps)
+	if len(c.Straps) > 0 {
+		chipset, err := LookupChipset(c.Chipset)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := chipset.encodeStraps(c.Straps, strapSections{
+			PchStrap: pch,
+			CpuStrap: cpu,
+		}); err != nil {
+			return nil, nil, err
+		}
+	}
+	return hex32s(pch), hex32s(cpu), nil
+}
+
+func (c Config) Encode(size uint32) ([]byte, error) {
+	sigOff := uint32(c.SigOffset)
+	if sigOff != 0 && sigOff != 0x10 {
+		return nil, fmt.Errorf("ifd: invalid signature offset 0x%x", sigOff)
+	}
+	if size < sigOff+flumap0Offset+4 {
+		return nil, fmt.Errorf("ifd: descriptor too small: 0x%x", size)
+	}
+
+	raw := rom.EmptyBytes(size)
+	binary.LittleEndian.PutUint32(raw[sigOff:], ifdSignature)
+	binary.LittleEndian.PutUint32(raw[sigOff+0x4:], uint32(c.FlMap0))
+	binary.LittleEndian.PutUint32(raw[sigOff+0x8:], uint32(c.FlMap1))
+	binary.LittleEndian.PutUint32(raw[sigOff+0xc:], uint32(c.FlMap2))
+	binary.LittleEndian.PutUint32(raw[sigOff+0x10:], uint32(c.FlMap3))
+	binary.LittleEndian.PutUint32(raw[sigOff+flumap0Offset:], uint32(c.FlUmap0))
+
+	regions, err := c.Version().encodeRegions(c.Regions)
+	if err != nil {
+		return nil, err
+	}
+	components, err := c.Components.encode()
+	if err != nil {
+		return nil, err
+	}
+	masters, err := c.masterDwords()
+	if err != nil {
+		return nil, err
+	}
+	pchStraps, cpuStraps, err := c.strapDwords()
+	if err != nil {
+		return nil, err
+	}
+	vscc := []rom.Hex32{}
+	for _, entry := range c.Vscc {
+		vscc = append(vscc, entry.Jid, entry.Vscc)
+	}
+	s := c.sections()
+	for _, w := range []struct {
+		s      section
+		dwords []rom.Hex32
+	}{
+		{s.regions, regions},
+		{s.components, components},
+		{s.masters, masters},
+		{s.pchStraps, pchStraps},
+		{s.cpuStraps, cpuStraps},
+		{s.vscc, vscc},
+	} {
+		if err := writeDwords(raw, w.s, w.dwords); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(c.Oem) > 0 {
+		if len(c.Oem) != oemSize || size < oemOffset+oemSize {
+			return nil, fmt.Errorf("ifd: OEM section must be 0x%x bytes at 0x%x",
+				oemSize, oemOffset)
+		}
+		copy(raw[oemOffset:], c.Oem)
+	}
+
+	if err := rom.ApplyChunks(raw, c.Extra); err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
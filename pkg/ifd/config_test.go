@@ -0,0 +1,160 @@
+package ifd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// testDescriptor is a Cougar Point IFDv1 descriptor with the signature at
+// 0x10: a 16MiB component split into ifd, bios and me regions, three
+// masters, 18 PCH strap dwords, one CPU strap dword and a VSCC entry.
+func testDescriptor() []byte {
+	raw := bytes.Repeat([]byte{0xff}, descriptorSize)
+	for offset, dword := range map[uint32]uint32{
+		0x10:  ifdSignature,
+		0x14:  0x04040003, // FLMAP0
+		0x18:  0x12100206, // FLMAP1
+		0x1c:  0x00210120, // FLMAP2
+		0x20:  0x00000000, // FLMAP3
+		0x30:  0x00000005, // FLCOMP
+		0x34:  0x00000000, // FLILL
+		0x38:  0x00000000, // FLPB
+		0x40:  0x00000000, // ifd
+		0x44:  0x0fff0200, // bios
+		0x48:  0x01ff0001, // me
+		0x4c:  0x00001fff, // gbe, unused
+		0x50:  0x00001fff, // pd, unused
+		0x60:  0x0b0a0000,
+		0x64:  0x0c0d0000,
+		0x68:  0x08080118,
+		0x200: 0x00000000, // CPU strap
+		0xdf0: 0x001720c2, // VSCC JID
+		0xdf4: 0x20052005,
+		0xefc: 0x000002df, // FLUMAP0
+		0x400: 0x12345678, // outside of the known sections
+	} {
+		binary.LittleEndian.PutUint32(raw[offset:], dword)
+	}
+	for n := uint32(0); n < 18; n++ {
+		binary.LittleEndian.PutUint32(raw[0x100+n*4:], 0)
+	}
+	return raw
+}
+
+func TestConfigRoundTrip(t *testing.T) {
+	raw := testDescriptor()
+	c, err := DecodeConfig(raw)
+	if err != nil {
+		t.Fatalf("DecodeConfig() err=%v", err)
+	}
+	if c.Chipset != "cpt" || len(c.Regions) != 5 || len(c.Masters) != 3 ||
+		len(c.PchStraps) != 18 || len(c.Vscc) != 1 || len(c.Extra) != 1 {
+		t.Errorf("DecodeConfig() = %+v", c)
+	}
+	if bios := c.Regions[1]; bios.Name != "bios" || bios.Base != 0x200000 || bios.Limit != 0xffffff {
+		t.Errorf("bios region = %+v", bios)
+	}
+	encoded, err := c.Encode(descriptorSize)
+	if err != nil {
+		t.Fatalf("Encode() err=%v", err)
+	}
+	if !bytes.Equal(encoded, raw) {
+		t.Errorf("Encode(DecodeConfig()) differs from the descriptor")
+	}
+}
+
+func TestConfigStraps(t *testing.T) {
+	c, err := DecodeConfig(testDescriptor())
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, err := c.DisableMe()
+	if err != nil || name != "AltMeDisable" {
+		t.Fatalf("DisableMe() = %v, err=%v", name, err)
+	}
+	if c.PchStraps[10] != 1<<7 {
+		t.Errorf("DisableMe() left PCHSTRP10 = 0x%08x", uint32(c.PchStraps[10]))
+	}
+	encoded, err := c.Encode(descriptorSize)
+	if err != nil {
+		t.Fatalf("Encode() err=%v", err)
+	}
+	if pchstrp10 := binary.LittleEndian.Uint32(encoded[0x100+10*4:]); pchstrp10 != 1<<7 {
+		t.Errorf("PCHSTRP10 = 0x%08x, want 0x%08x", pchstrp10, 1<<7)
+	}
+}
+
+func TestConfigStrapEdits(t *testing.T) {
+	setStrap := func(c *Config, name, value string) {
+		for n := range c.Straps {
+			if c.Straps[n].Name == name {
+				c.Straps[n].Value = value
+			}
+		}
+	}
+	for _, tt := range []struct {
+		name   string
+		edit   func(c *Config)
+		dword  int
+		want   uint32
+		errStr string
+	}{
+		{
+			name:  "named",
+			edit:  func(c *Config) { setStrap(c, "SmbusEnable", "enabled") },
+			dword: 0,
+			want:  1 << 7,
+		},
+		{
+			name:  "raw",
+			edit:  func(c *Config) { c.PchStraps[10] = 0x80 },
+			dword: 10,
+			want:  0x80,
+		},
+		{
+			name: "both the same",
+			edit: func(c *Config) {
+				c.PchStraps[0] = 2 << 28
+				setStrap(c, "BootBlockSize", "256KB")
+			},
+			dword: 0,
+			want:  2 << 28,
+		},
+		{
+			name: "both different",
+			edit: func(c *Config) {
+				c.PchStraps[0] = 1 << 28
+				setStrap(c, "BootBlockSize", "256KB")
+			},
+			errStr: "edit only one of them",
+		},
+		{
+			name:   "unknown value",
+			edit:   func(c *Config) { setStrap(c, "BootBlockSize", "1MB") },
+			errStr: "unknown value",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := DecodeConfig(testDescriptor())
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.edit(c)
+			encoded, err := c.Encode(descriptorSize)
+			if tt.errStr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.errStr) {
+					t.Errorf("Encode() err=%v, want an error containing '%v'", err, tt.errStr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Encode() err=%v", err)
+			}
+			if dword := binary.LittleEndian.Uint32(encoded[0x100+tt.dword*4:]); dword != tt.want {
+				t.Errorf("PCHSTRP%d = 0x%08x, want 0x%08x", tt.dword, dword, tt.want)
+			}
+		})
+	}
+}
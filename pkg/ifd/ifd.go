@@ -115,6 +115,7 @@ func (h Header) String() string {
 }
 
 var (
+	// IFDv1 FLREG0..FLREG4 and the reserved regions of FLMSTR
 	RegionNames = []string{
 		"ifd",
 		"bios",
@@ -124,21 +125,92 @@ var (
 		"res5",
 		"res6",
 		"res7",
+	}
+
+	// IFDv2 FLREG0..FLREG15
+	RegionNamesV2 = []string{
+		"ifd",
+		"bios",
+		"me",
+		"gbe",
+		"pd",
+		"devexp",
+		"bios2",
+		"res7",
 		"ec",
-		"res9",
+		"devexp2",
+		"ie",
+		"10gbe_0",
+		"10gbe_1",
+		"res13",
+		"res14",
+		"ptt",
 	}
 )
 
+const (
+	maxRegionsV1 = 5
+)
+
+func (v Version) regionNames() []string {
+	if v == Version2 {
+		return RegionNamesV2
+	}
+	return RegionNames
+}
+
+func (v Version) maxRegions() uint32 {
+	if v == Version2 {
+		return uint32(len(RegionNamesV2))
+	}
+	return maxRegionsV1
+}
+
+// regionMask is the width of FLREG base and limit in 4K blocks
+func (v Version) regionMask() uint32 {
+	if v == Version2 {
+		return 0x7fff
+	}
+	return 0xfff
+}
+
+// numRegions is the number of FLREG dwords: the generation maximum, limited
+// by the next section of the descriptor and NR where it is set.
+func (v Version) numRegions(h Header) uint32 {
+	n := v.maxRegions()
+	if v == Version1 && h.NumRegions() > 0 && h.NumRegions()+1 < n {
+		n = h.NumRegions() + 1
+	}
+	frba := h.FlashRegionBaseAddress()
+	next := uint32(flumap0Offset)
+	for _, base := range []uint32{
+		h.FlashComponentBaseAddress(),
+		h.FlashPchStrapBaseAddress(),
+		h.FlashMasterBaseAddress(),
+		h.FlashCpuStrapBaseAddress(),
+		h.VsccTableBaseAddress(),
+	} {
+		if base > frba && base < next {
+			next = base
+		}
+	}
+	if (next-frba)/4 < n {
+		n = (next - frba) / 4
+	}
+	return n
+}
+
 type Regions struct {
-	FlRegs [10]uint32
+	Version Version
+	FlRegs  []uint32
 }
 
 func (r Regions) Base(region int) uint32 {
-	return r.FlRegs[region] & 0x7fff
+	return r.FlRegs[region] & r.Version.regionMask()
 }
 
 func (r Regions) Limit(region int) uint32 {
-	return (r.FlRegs[region] >> 16) & 0x7fff
+	return (r.FlRegs[region] >> 16) & r.Version.regionMask()
 }
 
 func (r Regions) Start(region int) uint32 {
@@ -149,9 +221,14 @@ func (r Regions) End(region int) uint32 {
 	return (r.Limit(region) + 1) * 0x1000
 }
 
+// Used is false for regions with a limit below the base
+func (r Regions) Used(region int) bool {
+	return r.Base(region) <= r.Limit(region)
+}
+
 func (r Regions) String() string {
 	var b strings.Builder
-	for n := 0; n < 10; n++ {
+	for n := range r.FlRegs {
 		fmt.Fprintf(&b, "Region %v: start=0x%08x, end=0x%08x\n", n, r.Start(n), r.End(n))
 	}
 	return b.String()
@@ -167,32 +244,89 @@ func (d Descriptor) String() string {
 	var b strings.Builder
 	fmt.Fprintf(&b, "Sig Offset: 0x%02x\n", d.SigOffset)
 	fmt.Fprintf(&b, "Header:\n%v", d.Header)
-	fmt.Fprintf(&b, "Regions:\n%v", d.Regions)
+	fmt.Fprintf(&b, "Regions (IFDv%d):\n%v", d.Regions.Version, d.Regions)
 	return b.String()
 }
 
-func DetectIFD(unknownRegion *rom.Region) []*rom.Region {
+const detectorName = "ifd"
+
+// checkComponents compares the flash size declared by the component
+// densities against the size of the image the descriptor was found in.
+func checkComponents(unknownRegion *rom.Region, h Header, config *Config, diags *rom.Diagnostics) {
+	log.Printf("IFD components: %v", config.Components)
+	if unknownRegion.Parent != nil {
+		// only a full image has to match the chips
+		return
+	}
+	size := config.Components.Size(h.NumComponents())
+	if size != unknownRegion.Size {
+		diags.Warnf(detectorName, unknownRegion.Offset+h.FlashComponentBaseAddress(),
+			"%v component(s) with densities %v declare 0x%x bytes, image is 0x%x bytes",
+			h.NumComponents(), config.Components.Densities, size, unknownRegion.Size)
+	}
+}
+
+// setAddressMap maps the BIOS region of a full image below 4GiB
+func setAddressMap(unknownRegion *rom.Region, ifdRegions Regions) {
+	const biosRegion = 1
+	if unknownRegion.Parent != nil || len(ifdRegions.FlRegs) <= biosRegion ||
+		!ifdRegions.Used(biosRegion) {
+		return
+	}
+	start, end := ifdRegions.Start(biosRegion), ifdRegions.End(biosRegion)
+	if !unknownRegion.Contains(start, end-start) {
+		return
+	}
+	unknownRegion.SetAddressMap(rom.AddressMap{Offset: start, Size: end - start})
+	log.Printf("IFD: BIOS region 0x%08x - 0x%08x is mapped below 4GiB", start, end)
+}
+
+func DetectIFD(unknownRegion *rom.Region) ([]*rom.Region, rom.Diagnostics) {
 	bs := bytes.NewReader(unknownRegion.Raw)
+	var diags rom.Diagnostics
 
 	// check 0x00 for signature
 	var sig, sigOff uint32
-	binary.Read(bs, binary.LittleEndian, &sig)
+	if err := binary.Read(bs, binary.LittleEndian, &sig); err != nil {
+		return nil, nil
+	}
 	if sig != ifdSignature {
 		// check 0x10 for signature
 		sigOff = 0x10
 		bs.Seek(0x10, io.SeekStart)
-		binary.Read(bs, binary.LittleEndian, &sig)
+		if err := binary.Read(bs, binary.LittleEndian, &sig); err != nil {
+			return nil, nil
+		}
 	}
 
 	if sig != ifdSignature {
-		return nil
+		return nil, nil
 	}
 	var ifdHeader Header
-	binary.Read(bs, binary.LittleEndian, &ifdHeader)
+	if err := binary.Read(bs, binary.LittleEndian, &ifdHeader); err != nil {
+		diags.Errorf(detectorName, unknownRegion.Offset+sigOff,
+			"truncated descriptor header: err=%v", err)
+		return nil, diags
+	}
 
-	bs.Seek(int64(ifdHeader.FlashRegionBaseAddress()), io.SeekStart)
-	var ifdRegions Regions
-	binary.Read(bs, binary.LittleEndian, &ifdRegions)
+	raw := unknownRegion.Raw
+	if len(raw) > descriptorSize {
+		raw = raw[:descriptorSize]
+	}
+	// the regions only need the FLMAPs and FLCOMP, the rest of the
+	// descriptor is checked by decoding the config
+	version := Version1
+	if flcomp, err := readDwords(raw, section{"components", ifdHeader.FlashComponentBaseAddress(), 1}); err == nil {
+		version = versionFromFlcomp(uint32(flcomp[0]))
+	}
+	regionSection := section{"regions", ifdHeader.FlashRegionBaseAddress(), version.numRegions(ifdHeader)}
+	regionDwords, err := readDwords(raw, regionSection)
+	if err != nil {
+		diags.Errorf(detectorName, unknownRegion.Offset+ifdHeader.FlashRegionBaseAddress(),
+			"invalid flash region table: err=%v", err)
+		return nil, diags
+	}
+	ifdRegions := Regions{Version: version, FlRegs: uint32s(regionDwords)}
 
 	desc := Descriptor{
 		SigOffset: sigOff,
@@ -200,32 +334,45 @@ func DetectIFD(unknownRegion *rom.Region) []*rom.Region {
 		Regions:   &ifdRegions,
 	}
 	log.Printf("\nIFD:\n%v", desc)
+	if config, err := DecodeConfig(raw); err != nil {
+		diags.Warnf(detectorName, unknownRegion.Offset+sigOff,
+			"failed to decode descriptor, keeping its regions: err=%v", err)
+	} else {
+		checkComponents(unknownRegion, ifdHeader, config, &diags)
+	}
+	setAddressMap(unknownRegion, ifdRegions)
 
 	regions := []*rom.Region{}
-	nr := int(ifdHeader.NumRegions())
-	for n, name := range RegionNames {
-		if nr > 0 && n > nr {
-			break
-		}
-
-		base := ifdRegions.Base(n)
-		if base == 0x7fff {
+	names := version.regionNames()
+	for n := range ifdRegions.FlRegs {
+		name := names[n]
+		if !ifdRegions.Used(n) {
 			continue
 		}
 
 		start, end := ifdRegions.Start(n), ifdRegions.End(n)
+		if !unknownRegion.Contains(start, end-start) {
+			diags.Warnf(detectorName, unknownRegion.Offset+ifdHeader.FlashRegionBaseAddress()+uint32(n)*4,
+				"region %v/%v (0x%08x - 0x%08x) is outside of the image, skipping",
+				n, name, start, end)
+			continue
+		}
 		regionType := "unknown"
 		if n == 0 {
-			// for now use raw handler
-			// TODO: transition to typed IFD struct w/ all non-FF data
-			regionType = "raw"
+			regionType = "ifd"
 		}
 
 		ifdRegion := unknownRegion.Child(start, end-start, regionType, name)
+		if n == 0 {
+			ifdRegion.Metadata = map[string]string{
+				"version": fmt.Sprintf("IFDv%d", version),
+				"chipset": detectChipset(ifdHeader, version),
+			}
+		}
 
 		log.Printf("IFD %v/%v: %v %v", n, name, ifdRegion.Type, ifdRegion.Offset)
 		regions = append(regions, ifdRegion)
 	}
 
-	return regions
+	return regions, diags
 }
@@ -0,0 +1,220 @@
+package ifd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/flammit/fwtools/pkg/rom"
+)
+
+// LayoutEntry is one line of an ifdtool/flashrom layout file:
+// "start:end name" with inclusive hex flash addresses.
+type LayoutEntry struct {
+	Start uint32
+	End   uint32
+	Name  string
+}
+
+func (e LayoutEntry) String() string {
+	return fmt.Sprintf("%08x:%08x %v", e.Start, e.End, e.Name)
+}
+
+// ifdtool calls the descriptor region "fd"
+const layoutDescriptorName = "fd"
+
+func parseLayoutAddress(s string) (uint32, error) {
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "0x"), "0X")
+	v, err := strconv.ParseUint(s, 16, 32)
+	return uint32(v), err
+}
+
+func ParseLayout(r io.Reader) ([]LayoutEntry, error) {
+	entries := []LayoutEntry{}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if n := strings.Index(text, "#"); n >= 0 {
+			text = text[:n]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		addrs := strings.Split(fields[0], ":")
+		if len(fields) != 2 || len(addrs) != 2 {
+			return nil, fmt.Errorf("layout: line %v: expected 'start:end name', got '%v'",
+				line, scanner.Text())
+		}
+		start, err := parseLayoutAddress(addrs[0])
+		if err != nil {
+			return nil, fmt.Errorf("layout: line %v: invalid start '%v'", line, addrs[0])
+		}
+		end, err := parseLayoutAddress(addrs[1])
+		if err != nil {
+			return nil, fmt.Errorf("layout: line %v: invalid end '%v'", line, addrs[1])
+		}
+		if end < start {
+			return nil, fmt.Errorf("layout: line %v: end 0x%08x is before start 0x%08x",
+				line, end, start)
+		}
+		entries = append(entries, LayoutEntry{Start: start, End: end, Name: fields[1]})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func WriteLayout(w io.Writer, entries []LayoutEntry) error {
+	for _, entry := range entries {
+		if _, err := fmt.Fprintln(w, entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Layout lists the used flash regions with ifdtool names.
+func (c Config) Layout() []LayoutEntry {
+	entries := []LayoutEntry{}
+	for n, region := range c.Regions {
+		if !c.regionUsed(n) {
+			continue
+		}
+		name := region.Name
+		if n == regionDescriptor {
+			name = layoutDescriptorName
+		}
+		entries = append(entries, LayoutEntry{
+			Start: uint32(region.Base),
+			End:   uint32(region.Limit),
+			Name:  name,
+		})
+	}
+	return entries
+}
+
+func (c Config) layoutRegionIndex(name string) (int, error) {
+	if name == layoutDescriptorName {
+		return regionDescriptor, nil
+	}
+	n, err := c.Version().regionIndex(name)
+	if err != nil {
+		return 0, err
+	}
+	if n >= len(c.Regions) {
+		return 0, fmt.Errorf("ifd: descriptor only has %v regions, can't place %v",
+			len(c.Regions), name)
+	}
+	return n, nil
+}
+
+// Relayout moves the flash regions of romBytes to the placement in
+// entries and returns an image of newSize bytes.  Regions not listed keep
+// their placement.  Region contents move with their base, the BIOS region
+// stays aligned to its end as it holds the reset vector.  Shrinking a
+// region fails if it would drop non-empty bytes.
+func Relayout(romBytes []byte, entries []LayoutEntry, newSize uint32) ([]byte, error) {
+	c, err := ReadConfig(romBytes)
+	if err != nil {
+		return nil, err
+	}
+	if newSize < descriptorSize {
+		return nil, fmt.Errorf("ifd: image size 0x%x is too small for a descriptor", newSize)
+	}
+	old := append([]RegionConfig{}, c.Regions...)
+
+	// data outside of all regions has nowhere to go
+	coverage := rom.NewCoverage(uint32(len(romBytes)))
+	for n, region := range old {
+		if c.regionUsed(n) {
+			coverage.Cover(uint32(region.Base), uint32(region.Limit-region.Base)+1)
+		}
+	}
+	if chunks := coverage.Chunks(romBytes); len(chunks) > 0 {
+		return nil, fmt.Errorf("ifd: image has non-empty data outside of the flash regions at 0x%08x",
+			uint32(chunks[0].Offset))
+	}
+
+	for _, entry := range entries {
+		n, err := c.layoutRegionIndex(entry.Name)
+		if err != nil {
+			return nil, err
+		}
+		if entry.Start&0xfff != 0 || entry.End&0xfff != 0xfff {
+			return nil, fmt.Errorf("ifd: region %v (%v) is not 4K aligned", entry.Name, entry)
+		}
+		if n == regionDescriptor && entry.Start != 0 {
+			return nil, fmt.Errorf("ifd: descriptor region must start at 0, got %v", entry)
+		}
+		c.Regions[n].Base = rom.Hex32(entry.Start)
+		c.Regions[n].Limit = rom.Hex32(entry.End)
+	}
+
+	// overflow and overlap
+	for n, region := range c.Regions {
+		if !c.regionUsed(n) {
+			continue
+		}
+		if uint64(region.Limit) >= uint64(newSize) {
+			return nil, fmt.Errorf("ifd: region %v (0x%08x - 0x%08x) overflows image size 0x%x",
+				region.Name, uint32(region.Base), uint32(region.Limit), newSize)
+		}
+		for m := n + 1; m < len(c.Regions); m++ {
+			other := c.Regions[m]
+			if c.regionUsed(m) && region.Base <= other.Limit && other.Base <= region.Limit {
+				return nil, fmt.Errorf("ifd: region %v (0x%08x - 0x%08x) overlaps %v (0x%08x - 0x%08x)",
+					region.Name, uint32(region.Base), uint32(region.Limit),
+					other.Name, uint32(other.Base), uint32(other.Limit))
+			}
+		}
+	}
+
+	newRomBytes := rom.EmptyBytes(newSize)
+	for n, region := range c.Regions {
+		if !c.regionUsed(n) {
+			continue
+		}
+		newStart, newEnd := uint32(region.Base), uint32(region.Limit)+1
+		if n >= len(old) || old[n].Base > old[n].Limit {
+			log.Printf("ifd: region %v is new, leaving it empty", region.Name)
+			continue
+		}
+		oldStart, oldEnd := uint32(old[n].Base), uint32(old[n].Limit)+1
+		if uint64(oldEnd) > uint64(len(romBytes)) {
+			return nil, fmt.Errorf("ifd: region %v (0x%08x - 0x%08x) is outside of the image",
+				region.Name, oldStart, oldEnd-1)
+		}
+		src := romBytes[oldStart:oldEnd]
+		dst := newRomBytes[newStart:newEnd]
+
+		// the part of src that fits into dst
+		keep := src
+		var dropped []byte
+		if len(src) > len(dst) {
+			if n == regionBios {
+				keep, dropped = src[len(src)-len(dst):], src[:len(src)-len(dst)]
+			} else {
+				keep, dropped = src[:len(dst)], src[len(dst):]
+			}
+		}
+		if !(rom.Region{Raw: dropped}).Empty() {
+			return nil, fmt.Errorf("ifd: shrinking region %v from 0x%x to 0x%x bytes would drop non-empty data",
+				region.Name, len(src), len(dst))
+		}
+		if n == regionBios {
+			copy(dst[len(dst)-len(keep):], keep)
+		} else {
+			copy(dst, keep)
+		}
+	}
+
+	if err := WriteConfig(newRomBytes, c); err != nil {
+		return nil, err
+	}
+	return newRomBytes, nil
+}
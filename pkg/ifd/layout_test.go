@@ -0,0 +1,212 @@
+package ifd
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/flammit/fwtools/pkg/rom"
+)
+
+func TestParseLayout(t *testing.T) {
+	layout := `# ifdtool -f
+00000000:00000fff fd
+0x1000:0x1FFFFF me   # ME region
+
+00200000:00ffffff bios
+`
+	entries, err := ParseLayout(strings.NewReader(layout))
+	if err != nil {
+		t.Fatalf("ParseLayout() err=%v", err)
+	}
+	want := []LayoutEntry{
+		{Start: 0, End: 0xfff, Name: "fd"},
+		{Start: 0x1000, End: 0x1fffff, Name: "me"},
+		{Start: 0x200000, End: 0xffffff, Name: "bios"},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("ParseLayout() = %v, want %v", entries, want)
+	}
+	for n := range want {
+		if entries[n] != want[n] {
+			t.Errorf("entry %v = %v, want %v", n, entries[n], want[n])
+		}
+	}
+
+	var b bytes.Buffer
+	if err := WriteLayout(&b, entries); err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != "00000000:00000fff fd\n00001000:001fffff me\n00200000:00ffffff bios\n" {
+		t.Errorf("WriteLayout() = %q", b.String())
+	}
+
+	for _, tt := range []struct {
+		line string
+		err  string
+	}{
+		{"00000000 fd", "expected 'start:end name'"},
+		{"00000000:00000fff", "expected 'start:end name'"},
+		{"00000000:00000fff fd bios", "expected 'start:end name'"},
+		{"0:1:2 fd", "expected 'start:end name'"},
+		{"xyz:00000fff fd", "invalid start"},
+		{"00000000:-1 fd", "invalid end"},
+		{"100000000:1ffffffff fd", "invalid start"},
+		{"00002000:00000fff fd", "is before start"},
+	} {
+		_, err := ParseLayout(strings.NewReader("00000000:00000fff fd\n" + tt.line))
+		if err == nil || !strings.Contains(err.Error(), tt.err) || !strings.Contains(err.Error(), "line 2") {
+			t.Errorf("ParseLayout(%q) err=%v, want an error containing '%v' on line 2", tt.line, err, tt.err)
+		}
+	}
+}
+
+// testImage is a 16MiB image with testDescriptor: the ME region at
+// 0x1000 - 0x1fffff and the BIOS region at 0x200000 - 0xffffff, both with
+// data at their start and the BIOS with its reset vector at the end.
+func testImage() []byte {
+	raw := rom.EmptyBytes(0x1000000)
+	copy(raw, testDescriptor())
+	copy(raw[0x1000:], "$FPT")
+	copy(raw[0x200000:], "BIOS start")
+	copy(raw[0xfffff0:], "reset vector")
+	return raw
+}
+
+func TestRelayout(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		layout  string
+		size    uint32
+		regions map[string][2]uint32
+		// image offsets of the test data after the relayout, the BIOS
+		// start is erased before the relayout when biosStart is 0
+		fpt, biosStart, resetVector uint32
+	}{
+		{
+			name:        "ME shrunk",
+			layout:      "00001000:000fffff me\n00100000:00ffffff bios",
+			size:        0x1000000,
+			regions:     map[string][2]uint32{"me": {0x1000, 0xfffff}, "bios": {0x100000, 0xffffff}},
+			fpt:         0x1000,
+			biosStart:   0x200000,
+			resetVector: 0xfffff0,
+		},
+		{
+			name:        "BIOS shrunk",
+			layout:      "00001000:007fffff me\n00800000:00ffffff bios",
+			size:        0x1000000,
+			regions:     map[string][2]uint32{"me": {0x1000, 0x7fffff}, "bios": {0x800000, 0xffffff}},
+			fpt:         0x1000,
+			resetVector: 0xfffff0,
+		},
+		{
+			name:        "smaller image",
+			layout:      "00200000:007fffff bios",
+			size:        0x800000,
+			regions:     map[string][2]uint32{"me": {0x1000, 0x1fffff}, "bios": {0x200000, 0x7fffff}},
+			fpt:         0x1000,
+			resetVector: 0x7ffff0,
+		},
+		{
+			name:        "regions swapped",
+			layout:      "00001000:00001fff bios\n00002000:00ffffff me",
+			size:        0x1000000,
+			regions:     map[string][2]uint32{"me": {0x2000, 0xffffff}, "bios": {0x1000, 0x1fff}},
+			fpt:         0x2000,
+			resetVector: 0x1ff0,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := testImage()
+			data := map[uint32]string{tt.fpt: "$FPT", tt.resetVector: "reset vector"}
+			if tt.biosStart == 0 {
+				copy(raw[0x200000:], rom.EmptyBytes(0x10))
+			} else {
+				data[tt.biosStart] = "BIOS start"
+			}
+			entries, err := ParseLayout(strings.NewReader(tt.layout))
+			if err != nil {
+				t.Fatal(err)
+			}
+			relaid, err := Relayout(raw, entries, tt.size)
+			if err != nil {
+				t.Fatalf("Relayout() err=%v", err)
+			}
+			if uint32(len(relaid)) != tt.size {
+				t.Fatalf("Relayout() returned 0x%x bytes, want 0x%x", len(relaid), tt.size)
+			}
+
+			c, err := ReadConfig(relaid)
+			if err != nil {
+				t.Fatalf("ReadConfig() err=%v", err)
+			}
+			for _, region := range c.Regions {
+				if want, ok := tt.regions[region.Name]; ok &&
+					(uint32(region.Base) != want[0] || uint32(region.Limit) != want[1]) {
+					t.Errorf("region %v = 0x%08x - 0x%08x, want 0x%08x - 0x%08x",
+						region.Name, uint32(region.Base), uint32(region.Limit), want[0], want[1])
+				}
+			}
+
+			// the test data moved and nothing else is left after the descriptor
+			rest := append([]byte{}, relaid...)
+			for offset, s := range data {
+				if got := string(relaid[offset : offset+uint32(len(s))]); got != s {
+					t.Errorf("0x%08x = %q, want %q", offset, got, s)
+				}
+				copy(rest[offset:], rom.EmptyBytes(uint32(len(s))))
+			}
+			if !(rom.Region{Raw: rest[descriptorSize:]}).Empty() {
+				t.Errorf("Relayout() left data outside of the moved regions")
+			}
+		})
+	}
+}
+
+func TestRelayoutRefused(t *testing.T) {
+	meData := testImage()
+	meData[0x1ff000] = 0x42
+
+	// ME moved up, leaving $FPT outside of all regions
+	outside := testImage()
+	c, err := ReadConfig(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Regions[regionMe].Base = 0x2000
+	if err := WriteConfig(outside, c); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		raw    []byte
+		layout string
+		size   uint32
+		err    string
+	}{
+		{"overlap", testImage(), "00001000:002fffff me", 0x1000000, "overlaps"},
+		{"overflow", testImage(), "00200000:01ffffff bios", 0x1000000, "overflows image size"},
+		{"smaller image", testImage(), "", 0x800000, "overflows image size"},
+		{"unaligned start", testImage(), "00001800:001fffff me", 0x1000000, "not 4K aligned"},
+		{"unaligned end", testImage(), "00001000:001ffffe me", 0x1000000, "not 4K aligned"},
+		{"descriptor moved", testImage(), "00001000:00001fff fd", 0x1000000, "must start at 0"},
+		{"unknown region", testImage(), "00001000:00001fff ec", 0x1000000, "unknown region"},
+		{"ME data dropped", meData, "00001000:000fffff me", 0x1000000, "would drop non-empty data"},
+		{"BIOS data dropped", testImage(), "00001000:00ffefff me\n00fff000:00ffffff bios", 0x1000000,
+			"would drop non-empty data"},
+		{"data outside of the regions", outside, "", 0x1000000, "outside of the flash regions"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, err := ParseLayout(strings.NewReader(tt.layout))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = Relayout(tt.raw, entries, tt.size)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Relayout() err=%v, want an error containing '%v'", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,300 @@
+package ifd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/flammit/fwtools/pkg/rom"
+)
+
+type Version int
+
+const (
+	Version1 = Version(1)
+	Version2 = Version(2)
+)
+
+// Version guesses the descriptor layout version from the FLCOMP read
+// clock frequency.
+func (c Config) Version() Version {
+	return c.Components.version()
+}
+
+var (
+	// FLMSTR1..FLMSTR5
+	MasterNames = []string{
+		"bios",
+		"me",
+		"gbe",
+		"res4",
+		"ec",
+	}
+)
+
+func masterName(n int) string {
+	if n < len(MasterNames) {
+		return MasterNames[n]
+	}
+	return fmt.Sprintf("master%d", n+1)
+}
+
+func (v Version) regionName(n int) string {
+	if names := v.regionNames(); n < len(names) {
+		return names[n]
+	}
+	return fmt.Sprintf("region%d", n)
+}
+
+func (v Version) regionIndex(name string) (int, error) {
+	for n := 0; n < 16; n++ {
+		if v.regionName(n) == name {
+			return n, nil
+		}
+	}
+	return 0, fmt.Errorf("ifd: unknown region '%v'", name)
+}
+
+// masterLayout describes where FLMSTR keeps the read and write bits
+type masterLayout struct {
+	readShift, writeShift uint
+	regions               int
+	// IFDv2 keeps access to regions 12-15 in the low byte
+	extended bool
+}
+
+func (v Version) masterLayout() masterLayout {
+	if v == Version2 {
+		return masterLayout{readShift: 8, writeShift: 20, regions: 12, extended: true}
+	}
+	return masterLayout{readShift: 16, writeShift: 24, regions: 8}
+}
+
+func (v Version) numMasters(h Header) uint32 {
+	if v == Version2 && h.NumMasters()+1 < uint32(len(MasterNames)) {
+		return uint32(len(MasterNames))
+	}
+	return h.NumMasters() + 1
+}
+
+// MasterConfig is a decoded FLMSTR register: the regions a flash master
+// can read and write.  Requester ID is only used by IFDv1, Reserved holds
+// the remaining bits.
+type MasterConfig struct {
+	Name        string
+	Read        []string
+	Write       []string
+	RequesterID rom.Hex16 `json:",omitempty"`
+	Reserved    rom.Hex32 `json:",omitempty"`
+}
+
+func (m MasterConfig) String() string {
+	s := fmt.Sprintf("%-5v read: %-40v write: %v",
+		m.Name, strings.Join(m.Read, " "), strings.Join(m.Write, " "))
+	if m.RequesterID != 0 {
+		s += fmt.Sprintf(" (requester id 0x%04x)", uint16(m.RequesterID))
+	}
+	return s
+}
+
+func (v Version) decodeMaster(n int, flmstr uint32) MasterConfig {
+	layout := v.masterLayout()
+	m := MasterConfig{
+		Name:  masterName(n),
+		Read:  []string{},
+		Write: []string{},
+	}
+	used := uint32(0)
+	access := func(bit uint, region int, list *[]string) {
+		used |= 1 << bit
+		if flmstr&(1<<bit) != 0 {
+			*list = append(*list, v.regionName(region))
+		}
+	}
+	for region := 0; region < layout.regions; region++ {
+		access(layout.readShift+uint(region), region, &m.Read)
+	}
+	for region := 0; region < layout.regions; region++ {
+		access(layout.writeShift+uint(region), region, &m.Write)
+	}
+	if layout.extended {
+		for region := 12; region < 16; region++ {
+			access(uint(region-12), region, &m.Read)
+			access(uint(region-12)+4, region, &m.Write)
+		}
+	} else {
+		m.RequesterID = rom.Hex16(flmstr)
+		used |= 0xffff
+	}
+	m.Reserved = rom.Hex32(flmstr &^ used)
+	return m
+}
+
+func (v Version) accessBit(region int, write bool) (uint, error) {
+	layout := v.masterLayout()
+	switch {
+	case region < layout.regions && write:
+		return layout.writeShift + uint(region), nil
+	case region < layout.regions:
+		return layout.readShift + uint(region), nil
+	case layout.extended && region < 16 && write:
+		return uint(region-12) + 4, nil
+	case layout.extended && region < 16:
+		return uint(region - 12), nil
+	}
+	return 0, fmt.Errorf("ifd: region %v has no access bits in IFDv%d", v.regionName(region), v)
+}
+
+func (v Version) encodeMaster(m MasterConfig) (uint32, error) {
+	flmstr := uint32(m.Reserved)
+	if !v.masterLayout().extended {
+		flmstr |= uint32(m.RequesterID)
+	}
+	for _, list := range []struct {
+		names []string
+		write bool
+	}{{m.Read, false}, {m.Write, true}} {
+		for _, name := range list.names {
+			region, err := v.regionIndex(name)
+			if err != nil {
+				return 0, err
+			}
+			bit, err := v.accessBit(region, list.write)
+			if err != nil {
+				return 0, err
+			}
+			flmstr |= 1 << bit
+		}
+	}
+	return flmstr, nil
+}
+
+func (c Config) masterDwords() ([]rom.Hex32, error) {
+	v := c.Version()
+	dwords := []rom.Hex32{}
+	for _, m := range c.Masters {
+		flmstr, err := v.encodeMaster(m)
+		if err != nil {
+			return nil, fmt.Errorf("ifd: master %v: %v", m.Name, err)
+		}
+		dwords = append(dwords, rom.Hex32(flmstr))
+	}
+	return dwords, nil
+}
+
+func (c *Config) setMasterDwords(dwords []rom.Hex32) {
+	v := c.Version()
+	c.Masters = []MasterConfig{}
+	for n, flmstr := range dwords {
+		c.Masters = append(c.Masters, v.decodeMaster(n, uint32(flmstr)))
+	}
+}
+
+// regionUsed is true if the FLREG of the region describes a non-empty range
+func (c Config) regionUsed(n int) bool {
+	return n < len(c.Regions) && c.Regions[n].Base <= c.Regions[n].Limit
+}
+
+const (
+	regionDescriptor = 0
+	regionBios       = 1
+	regionMe         = 2
+	regionGbe        = 3
+	regionPlatform   = 4
+	regionEc         = 8
+
+	masterBios = 0
+	masterMe   = 1
+	masterGbe  = 2
+	masterEc   = 4
+)
+
+// Lock restricts the flash masters to the default access rights of a
+// production image, the equivalent of ifdtool -l.
+func (c *Config) Lock() error {
+	v := c.Version()
+	flmstr, err := c.masterDwords()
+	if err != nil {
+		return err
+	}
+	if len(flmstr) < 3 || (v == Version2 && len(flmstr) < 5) {
+		return fmt.Errorf("ifd: descriptor has too few masters to lock: %v", len(flmstr))
+	}
+
+	if v == Version2 {
+		// clear non-reserved bits
+		for _, n := range []int{masterBios, masterMe, masterGbe, masterEc} {
+			flmstr[n] &= 0xff
+		}
+	} else {
+		flmstr[masterBios] = 0
+		flmstr[masterMe] = 0
+		// requester id
+		flmstr[masterGbe] = 0x118
+	}
+
+	grant := func(master, region int, write bool) {
+		bit, _ := v.accessBit(region, write)
+		flmstr[master] |= 1 << bit
+	}
+	// CPU/BIOS can read descriptor and BIOS, write BIOS
+	grant(masterBios, regionDescriptor, false)
+	grant(masterBios, regionBios, false)
+	grant(masterBios, regionBios, true)
+	// ME can read descriptor, ME and BIOS, write ME
+	grant(masterMe, regionDescriptor, false)
+	grant(masterMe, regionMe, false)
+	grant(masterMe, regionBios, false)
+	grant(masterMe, regionMe, true)
+	if c.regionUsed(regionGbe) {
+		// BIOS can read/write GbE, ME can read GbE
+		grant(masterBios, regionGbe, false)
+		grant(masterBios, regionGbe, true)
+		grant(masterMe, regionGbe, false)
+		// GbE can read descriptor and read/write GbE
+		grant(masterGbe, regionDescriptor, false)
+		grant(masterGbe, regionGbe, false)
+		grant(masterGbe, regionGbe, true)
+	}
+	if c.regionUsed(regionPlatform) {
+		// BIOS can read/write PDR
+		grant(masterBios, regionPlatform, false)
+		grant(masterBios, regionPlatform, true)
+	}
+	if v == Version2 && c.regionUsed(regionEc) {
+		// BIOS can read EC, EC can read descriptor and read/write EC
+		grant(masterBios, regionEc, false)
+		grant(masterEc, regionDescriptor, false)
+		grant(masterEc, regionEc, false)
+		grant(masterEc, regionEc, true)
+	}
+
+	c.setMasterDwords(flmstr)
+	return nil
+}
+
+// Unlock gives every flash master read and write access to all regions,
+// the equivalent of ifdtool -u.
+func (c *Config) Unlock() error {
+	v := c.Version()
+	flmstr, err := c.masterDwords()
+	if err != nil {
+		return err
+	}
+	if len(flmstr) < 3 || (v == Version2 && len(flmstr) < 5) {
+		return fmt.Errorf("ifd: descriptor has too few masters to unlock: %v", len(flmstr))
+	}
+
+	if v == Version2 {
+		for _, n := range []int{masterBios, masterMe, masterGbe, masterEc} {
+			flmstr[n] = 0xffffff00 | (flmstr[n] & 0xff)
+		}
+	} else {
+		flmstr[masterBios] = 0xffff0000
+		flmstr[masterMe] = 0xffff0000
+		// keep chipset specific requester id
+		flmstr[masterGbe] = 0x08080000 | (flmstr[masterGbe] & 0xffff)
+	}
+
+	c.setMasterDwords(flmstr)
+	return nil
+}
@@ -0,0 +1,88 @@
+package ifd
+
+import (
+	"fmt"
+)
+
+// ComponentSizes returns the size of each flash chip declared by the
+// descriptor.
+func (c Config) ComponentSizes() ([]uint32, error) {
+	sizes := []uint32{}
+	nc := int(c.header().NumComponents())
+	if nc > len(c.Components.Densities) {
+		return nil, fmt.Errorf("ifd: descriptor declares %v components, only %v densities are known",
+			nc, len(c.Components.Densities))
+	}
+	for n := 0; n < nc; n++ {
+		size := DensityBytes(c.Components.Densities[n])
+		if size == 0 {
+			return nil, fmt.Errorf("ifd: component %v has no usable density '%v'",
+				n, c.Components.Densities[n])
+		}
+		sizes = append(sizes, size)
+	}
+	return sizes, nil
+}
+
+func checkComponentSizes(sizes []uint32, imageSize int) error {
+	total := uint64(0)
+	for _, size := range sizes {
+		total += uint64(size)
+	}
+	if total != uint64(imageSize) {
+		return fmt.Errorf("ifd: components %v add up to 0x%x bytes, image is 0x%x bytes",
+			sizes, total, imageSize)
+	}
+	return nil
+}
+
+// Split cuts a full image into one image per flash component.
+func Split(romBytes []byte) ([][]byte, error) {
+	c, err := ReadConfig(romBytes)
+	if err != nil {
+		return nil, err
+	}
+	sizes, err := c.ComponentSizes()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkComponentSizes(sizes, len(romBytes)); err != nil {
+		return nil, err
+	}
+	chips := [][]byte{}
+	offset := uint32(0)
+	for _, size := range sizes {
+		chips = append(chips, append([]byte{}, romBytes[offset:offset+size]...))
+		offset += size
+	}
+	return chips, nil
+}
+
+// Join combines per component images into a full image, the descriptor is
+// read from the first chip.
+func Join(chips [][]byte) ([]byte, error) {
+	if len(chips) == 0 {
+		return nil, fmt.Errorf("ifd: no chips to join")
+	}
+	c, err := ReadConfig(chips[0])
+	if err != nil {
+		return nil, err
+	}
+	sizes, err := c.ComponentSizes()
+	if err != nil {
+		return nil, err
+	}
+	if len(sizes) != len(chips) {
+		return nil, fmt.Errorf("ifd: descriptor declares %v components, got %v chip images",
+			len(sizes), len(chips))
+	}
+	romBytes := []byte{}
+	for n, chip := range chips {
+		if uint32(len(chip)) != sizes[n] {
+			return nil, fmt.Errorf("ifd: chip %v is 0x%x bytes, descriptor declares 0x%x",
+				n, len(chip), sizes[n])
+		}
+		romBytes = append(romBytes, chip...)
+	}
+	return romBytes, nil
+}
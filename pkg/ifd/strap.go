@@ -0,0 +1,270 @@
+package ifd
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/flammit/fwtools/pkg/rom"
+)
+
+// StrapSection tells which strap section of the descriptor a field lives in
+type StrapSection string
+
+const (
+	PchStrap = StrapSection("PCHSTRP")
+	// MCH straps on ICH8-10, CPU straps on later chipsets
+	CpuStrap = StrapSection("CPUSTRP")
+)
+
+// StrapField names the bits Lsb..Msb of one strap dword.  Values optionally
+// names the field values, fields without names are shown as hex.
+type StrapField struct {
+	Name        string
+	Section     StrapSection
+	Dword       int
+	Lsb, Msb    uint
+	Description string
+	Values      map[uint32]string
+}
+
+func (f StrapField) mask() uint32 {
+	return uint32((uint64(1)<<(f.Msb-f.Lsb+1) - 1) << f.Lsb)
+}
+
+func (f StrapField) Location() string {
+	dword := fmt.Sprintf("%v%d", f.Section, f.Dword)
+	if f.Lsb == f.Msb {
+		return fmt.Sprintf("%v[%d]", dword, f.Lsb)
+	}
+	return fmt.Sprintf("%v[%d:%d]", dword, f.Msb, f.Lsb)
+}
+
+func (f StrapField) bits(dword uint32) uint32 {
+	return (dword & f.mask()) >> f.Lsb
+}
+
+func (f StrapField) decode(dword uint32) string {
+	v := f.bits(dword)
+	if name, ok := f.Values[v]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%x", v)
+}
+
+func (f StrapField) encode(dword uint32, value string) (uint32, error) {
+	v, found := uint32(0), false
+	for fieldValue, name := range f.Values {
+		if name == value {
+			v, found = fieldValue, true
+			break
+		}
+	}
+	if !found {
+		parsed, err := strconv.ParseUint(value, 0, 32)
+		if err != nil {
+			return 0, fmt.Errorf("ifd: strap %v: unknown value '%v'", f.Name, value)
+		}
+		v = uint32(parsed)
+	}
+	if v > f.mask()>>f.Lsb {
+		return 0, fmt.Errorf("ifd: strap %v: value '%v' doesn't fit %v", f.Name, value, f.Location())
+	}
+	return dword&^f.mask() | v<<f.Lsb, nil
+}
+
+// Chipset is a set of strap definitions for one PCH generation.
+type Chipset struct {
+	Name        string
+	Description string
+	Version     Version
+	Straps      []StrapField
+}
+
+func (c Chipset) field(name string) (StrapField, bool) {
+	for _, f := range c.Straps {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return StrapField{}, false
+}
+
+func LookupChipset(name string) (*Chipset, error) {
+	for _, chipset := range Chipsets {
+		if chipset.Name == name {
+			return chipset, nil
+		}
+	}
+	names := []string{}
+	for _, chipset := range Chipsets {
+		names = append(names, chipset.Name)
+	}
+	return nil, fmt.Errorf("ifd: unknown chipset '%v', known chipsets are %v", name, names)
+}
+
+// StrapValue is a decoded strap field.  Stored holds the field bits at
+// decode, it tells an edit of Value from an edit of the strap dwords.
+// Location and Description are there for the reader.
+type StrapValue struct {
+	Name        string
+	Value       string
+	Stored      *rom.Hex32 `json:",omitempty"`
+	Location    string     `json:",omitempty"`
+	Description string     `json:",omitempty"`
+}
+
+// strapSections are the dwords of each strap section of a descriptor
+type strapSections map[StrapSection][]uint32
+
+// decodeStraps renders all fields of the chipset that exist in the strap
+// sections of this descriptor.
+func (c Chipset) decodeStraps(sections strapSections) []StrapValue {
+	values := []StrapValue{}
+	for _, f := range c.Straps {
+		dwords := sections[f.Section]
+		if f.Dword >= len(dwords) {
+			continue
+		}
+		stored := rom.Hex32(f.bits(dwords[f.Dword]))
+		values = append(values, StrapValue{
+			Name:        f.Name,
+			Value:       f.decode(dwords[f.Dword]),
+			Stored:      &stored,
+			Location:    f.Location(),
+			Description: f.Description,
+		})
+	}
+	return values
+}
+
+// encodeStraps writes the named strap values edited since decode over the
+// bits of the strap dwords in place.  Values without Stored bits count as
+// edited.  A value and dword bits that were both changed, to different
+// values, are refused.
+func (c Chipset) encodeStraps(values []StrapValue, sections strapSections) error {
+	for _, value := range values {
+		f, ok := c.field(value.Name)
+		if !ok {
+			return fmt.Errorf("ifd: chipset %v has no strap named '%v'", c.Name, value.Name)
+		}
+		dwords := sections[f.Section]
+		if f.Dword >= len(dwords) {
+			return fmt.Errorf("ifd: strap %v at %v is outside of the %v dwords in the descriptor",
+				f.Name, f.Location(), len(dwords))
+		}
+		dword, err := f.encode(dwords[f.Dword], value.Value)
+		if err != nil {
+			return err
+		}
+		named, raw := f.bits(dword), f.bits(dwords[f.Dword])
+		switch {
+		case named == raw:
+		case value.Stored == nil || raw == uint32(*value.Stored):
+			dwords[f.Dword] = dword
+		case named != uint32(*value.Stored):
+			return fmt.Errorf("ifd: strap %v is '%v' but %v was changed to '%v', edit only one of them",
+				f.Name, value.Value, f.Location(), f.decode(dwords[f.Dword]))
+		}
+	}
+	return nil
+}
+
+// detectChipset guesses the PCH generation from the descriptor maps as
+// done by ifdtool and flashrom: IFDv1 chipsets by the ICC register init
+// base and the strap lengths, IFDv2 ones by the ICC register init base and
+// the CPU strap section.  Ice Point descriptors look like Cannon Point
+// ones and share the cnp definitions, unknown layouts use the generic
+// definitions of their version.
+func detectChipset(h Header, v Version) string {
+	iccriba := (h.FlMap2 >> 16) & 0xff
+	fmsba := h.FlMap2 & 0xff
+	msl := h.CpuStrapLength()
+	isl := h.PchStrapLength()
+	if v == Version2 {
+		switch {
+		case iccriba < 0x34:
+			return "spt"
+		case iccriba == 0x34:
+			return "cnp"
+		case msl == 0x11 && fmsba == 0x68:
+			return "tgp"
+		case msl == 0x11 && fmsba == 0x40:
+			return "adp"
+		}
+		return "ifd2"
+	}
+	switch {
+	case iccriba == 0 && isl <= 10:
+		return "ich"
+	case iccriba == 0:
+		// ifdtool assumes Ibex Peak for larger strap sections
+		return "ibx"
+	case iccriba < 0x31 && fmsba < 0x30:
+		switch {
+		case msl == 0 && isl <= 17:
+			// Bay Trail
+			return "ifd1"
+		case msl <= 1 && isl <= 18:
+			return "cpt"
+		}
+		// Lynx Point, and Wildcat Point for larger strap sections
+		return "lpt"
+	}
+	return "ifd1"
+}
+
+// SetStrap changes the value of a named strap field of the chipset and
+// its bits in the strap dwords.
+func (c *Config) SetStrap(name, value string) error {
+	chipset, err := LookupChipset(c.Chipset)
+	if err != nil {
+		return err
+	}
+	f, ok := chipset.field(name)
+	if !ok {
+		return fmt.Errorf("ifd: chipset %v has no strap named '%v'", c.Chipset, name)
+	}
+	dwords := map[StrapSection][]rom.Hex32{
+		PchStrap: c.PchStraps,
+		CpuStrap: c.CpuStraps,
+	}[f.Section]
+	if f.Dword >= len(dwords) {
+		return fmt.Errorf("ifd: strap %v at %v is outside of the %v dwords in the descriptor",
+			f.Name, f.Location(), len(dwords))
+	}
+	dword, err := f.encode(uint32(dwords[f.Dword]), value)
+	if err != nil {
+		return err
+	}
+	dwords[f.Dword] = rom.Hex32(dword)
+
+	for n := range c.Straps {
+		if c.Straps[n].Name == name {
+			c.Straps[n].Value = value
+			return nil
+		}
+	}
+	c.Straps = append(c.Straps, StrapValue{
+		Name:        name,
+		Value:       value,
+		Location:    f.Location(),
+		Description: f.Description,
+	})
+	return nil
+}
+
+// DisableMe sets the strap that disables the ME after bring-up: HAP on
+// chipsets that have it, AltMeDisable on older ones.  It returns the name
+// of the strap.
+func (c *Config) DisableMe() (string, error) {
+	chipset, err := LookupChipset(c.Chipset)
+	if err != nil {
+		return "", err
+	}
+	for _, f := range []StrapField{hap, meDisable} {
+		if _, ok := chipset.field(f.Name); ok {
+			return f.Name, c.SetStrap(f.Name, f.Values[1])
+		}
+	}
+	return "", fmt.Errorf("ifd: chipset %v has no ME disable strap", c.Chipset)
+}
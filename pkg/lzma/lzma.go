@@ -0,0 +1,403 @@
+// Package lzma decodes LZMA "alone" streams: a 13 byte header with the
+// properties, dictionary size and uncompressed size followed by the range
+// coded data.  It follows the reference decoder in the LZMA SDK
+// (LzmaSpec.cpp) and only supports decompression.
+package lzma
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	HeaderSize = 13
+
+	// uncompressed size of streams that end with an end marker
+	unknownSize = ^uint64(0)
+	// refuse to allocate more than this for a single stream
+	maxSize = 1 << 28
+
+	numBitModelTotalBits = 11
+	bitModelTotal        = 1 << numBitModelTotalBits
+	numMoveBits          = 5
+	probInit             = bitModelTotal / 2
+
+	numStates          = 12
+	numPosBitsMax      = 4
+	numLenToPosStates  = 4
+	numAlignBits       = 4
+	startPosModelIndex = 4
+	endPosModelIndex   = 14
+	numFullDistances   = 1 << (endPosModelIndex >> 1)
+	matchMinLen        = 2
+)
+
+// Header is the LZMA alone header.  Props packs the lc, lp and pb
+// parameters as (pb * 5 + lp) * 9 + lc.
+type Header struct {
+	Props    uint8
+	DictSize uint32
+	Size     uint64
+}
+
+func (h Header) params() (lc, lp, pb uint, err error) {
+	d := uint(h.Props)
+	if d >= 9*5*5 {
+		return 0, 0, 0, fmt.Errorf("lzma: invalid properties 0x%02x", h.Props)
+	}
+	return d % 9, (d / 9) % 5, d / 45, nil
+}
+
+// SizeKnown is false for streams that end with an end marker
+func (h Header) SizeKnown() bool {
+	return h.Size != unknownSize
+}
+
+func ParseHeader(data []byte) (Header, error) {
+	if len(data) < HeaderSize {
+		return Header{}, fmt.Errorf("lzma: stream too short for a header: %v bytes", len(data))
+	}
+	h := Header{
+		Props:    data[0],
+		DictSize: binary.LittleEndian.Uint32(data[1:]),
+		Size:     binary.LittleEndian.Uint64(data[5:]),
+	}
+	if _, _, _, err := h.params(); err != nil {
+		return Header{}, err
+	}
+	if h.SizeKnown() && h.Size > maxSize {
+		return Header{}, fmt.Errorf("lzma: uncompressed size 0x%x is too large", h.Size)
+	}
+	return h, nil
+}
+
+type rangeDecoder struct {
+	data []byte
+	pos  int
+	rng  uint32
+	code uint32
+	err  error
+}
+
+func (rc *rangeDecoder) next() byte {
+	if rc.pos >= len(rc.data) {
+		if rc.err == nil {
+			rc.err = fmt.Errorf("lzma: compressed data is truncated")
+		}
+		return 0
+	}
+	b := rc.data[rc.pos]
+	rc.pos++
+	return b
+}
+
+func (rc *rangeDecoder) init() {
+	if rc.next() != 0 {
+		rc.err = fmt.Errorf("lzma: invalid range coder start")
+	}
+	rc.rng = 0xffffffff
+	for n := 0; n < 4; n++ {
+		rc.code = rc.code<<8 | uint32(rc.next())
+	}
+	if rc.code == rc.rng {
+		rc.err = fmt.Errorf("lzma: invalid range coder start")
+	}
+}
+
+func (rc *rangeDecoder) normalize() {
+	if rc.rng < 1<<24 {
+		rc.rng <<= 8
+		rc.code = rc.code<<8 | uint32(rc.next())
+	}
+}
+
+func (rc *rangeDecoder) directBits(numBits uint) uint32 {
+	res := uint32(0)
+	for ; numBits > 0; numBits-- {
+		rc.rng >>= 1
+		rc.code -= rc.rng
+		t := 0 - (rc.code >> 31)
+		rc.code += rc.rng & t
+		if rc.code == rc.rng {
+			rc.err = fmt.Errorf("lzma: corrupted data")
+		}
+		rc.normalize()
+		res = res<<1 + t + 1
+	}
+	return res
+}
+
+func (rc *rangeDecoder) bit(prob *uint16) uint32 {
+	bound := (rc.rng >> numBitModelTotalBits) * uint32(*prob)
+	var symbol uint32
+	if rc.code < bound {
+		*prob += (bitModelTotal - *prob) >> numMoveBits
+		rc.rng = bound
+		symbol = 0
+	} else {
+		*prob -= *prob >> numMoveBits
+		rc.code -= bound
+		rc.rng -= bound
+		symbol = 1
+	}
+	rc.normalize()
+	return symbol
+}
+
+func newProbs(n int) []uint16 {
+	probs := make([]uint16, n)
+	for i := range probs {
+		probs[i] = probInit
+	}
+	return probs
+}
+
+func (rc *rangeDecoder) bitTree(probs []uint16, numBits uint) uint32 {
+	m := uint32(1)
+	for n := uint(0); n < numBits; n++ {
+		m = m<<1 + rc.bit(&probs[m])
+	}
+	return m - 1<<numBits
+}
+
+func (rc *rangeDecoder) reverseBitTree(probs []uint16, numBits uint) uint32 {
+	m, symbol := uint32(1), uint32(0)
+	for n := uint(0); n < numBits; n++ {
+		bit := rc.bit(&probs[m])
+		m = m<<1 + bit
+		symbol |= bit << n
+	}
+	return symbol
+}
+
+type lenDecoder struct {
+	choice  uint16
+	choice2 uint16
+	low     [1 << numPosBitsMax][]uint16
+	mid     [1 << numPosBitsMax][]uint16
+	high    []uint16
+}
+
+func newLenDecoder() *lenDecoder {
+	d := &lenDecoder{
+		choice:  probInit,
+		choice2: probInit,
+		high:    newProbs(1 << 8),
+	}
+	for n := range d.low {
+		d.low[n] = newProbs(1 << 3)
+		d.mid[n] = newProbs(1 << 3)
+	}
+	return d
+}
+
+func (d *lenDecoder) decode(rc *rangeDecoder, posState uint32) uint32 {
+	if rc.bit(&d.choice) == 0 {
+		return rc.bitTree(d.low[posState], 3)
+	}
+	if rc.bit(&d.choice2) == 0 {
+		return 8 + rc.bitTree(d.mid[posState], 3)
+	}
+	return 16 + rc.bitTree(d.high, 8)
+}
+
+type decoder struct {
+	rc      rangeDecoder
+	out     []byte
+	lc, lp  uint
+	pb      uint
+	literal []uint16
+
+	posSlot   [numLenToPosStates][]uint16
+	posProbs  []uint16
+	align     []uint16
+	lenDec    *lenDecoder
+	repLenDec *lenDecoder
+
+	isMatch    []uint16
+	isRep      []uint16
+	isRepG0    []uint16
+	isRepG1    []uint16
+	isRepG2    []uint16
+	isRep0Long []uint16
+}
+
+func (d *decoder) literalByte(state uint32, rep0 uint32) {
+	prevByte := uint32(0)
+	if len(d.out) > 0 {
+		prevByte = uint32(d.out[len(d.out)-1])
+	}
+	litState := (uint32(len(d.out))&(1<<d.lp-1))<<d.lc + prevByte>>(8-d.lc)
+	probs := d.literal[0x300*litState:]
+
+	symbol := uint32(1)
+	if state >= 7 {
+		matchByte := uint32(d.out[len(d.out)-int(rep0)-1])
+		for symbol < 0x100 {
+			matchBit := (matchByte >> 7) & 1
+			matchByte <<= 1
+			bit := d.rc.bit(&probs[(1+matchBit)<<8+symbol])
+			symbol = symbol<<1 | bit
+			if matchBit != bit {
+				break
+			}
+		}
+	}
+	for symbol < 0x100 {
+		symbol = symbol<<1 | d.rc.bit(&probs[symbol])
+	}
+	d.out = append(d.out, byte(symbol))
+}
+
+func (d *decoder) distance(length uint32) uint32 {
+	lenState := length
+	if lenState > numLenToPosStates-1 {
+		lenState = numLenToPosStates - 1
+	}
+	posSlot := d.rc.bitTree(d.posSlot[lenState], 6)
+	if posSlot < startPosModelIndex {
+		return posSlot
+	}
+	numDirectBits := uint(posSlot>>1) - 1
+	dist := (2 | posSlot&1) << numDirectBits
+	if posSlot < endPosModelIndex {
+		return dist + d.rc.reverseBitTree(d.posProbs[dist-posSlot:], numDirectBits)
+	}
+	dist += d.rc.directBits(numDirectBits-numAlignBits) << numAlignBits
+	return dist + d.rc.reverseBitTree(d.align, numAlignBits)
+}
+
+// Decompress decodes an LZMA alone stream.  Streams with an unknown size
+// must end with an end marker, data after the end of the stream is
+// ignored.
+func Decompress(data []byte) ([]byte, error) {
+	h, err := ParseHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	lc, lp, pb, _ := h.params()
+	d := &decoder{
+		rc:         rangeDecoder{data: data[HeaderSize:]},
+		lc:         lc,
+		lp:         lp,
+		pb:         pb,
+		literal:    newProbs(0x300 << (lc + lp)),
+		posProbs:   newProbs(1 + numFullDistances - endPosModelIndex),
+		align:      newProbs(1 << numAlignBits),
+		lenDec:     newLenDecoder(),
+		repLenDec:  newLenDecoder(),
+		isMatch:    newProbs(numStates << numPosBitsMax),
+		isRep:      newProbs(numStates),
+		isRepG0:    newProbs(numStates),
+		isRepG1:    newProbs(numStates),
+		isRepG2:    newProbs(numStates),
+		isRep0Long: newProbs(numStates << numPosBitsMax),
+	}
+	for n := range d.posSlot {
+		d.posSlot[n] = newProbs(1 << 6)
+	}
+	if h.SizeKnown() {
+		d.out = make([]byte, 0, h.Size)
+	}
+	if err := d.decode(h); err != nil {
+		return nil, err
+	}
+	return d.out, nil
+}
+
+func (d *decoder) decode(h Header) error {
+	rc := &d.rc
+	rc.init()
+	state := uint32(0)
+	var rep0, rep1, rep2, rep3 uint32
+	for rc.err == nil {
+		if h.SizeKnown() && uint64(len(d.out)) >= h.Size {
+			return nil
+		}
+		if len(d.out) > maxSize {
+			return fmt.Errorf("lzma: uncompressed data is larger than 0x%x bytes", maxSize)
+		}
+		posState := uint32(len(d.out)) & (1<<d.pb - 1)
+
+		if rc.bit(&d.isMatch[state<<numPosBitsMax+posState]) == 0 {
+			d.literalByte(state, rep0)
+			switch {
+			case state < 4:
+				state = 0
+			case state < 10:
+				state -= 3
+			default:
+				state -= 6
+			}
+			continue
+		}
+
+		var length uint32
+		if rc.bit(&d.isRep[state]) != 0 {
+			if len(d.out) == 0 {
+				return fmt.Errorf("lzma: repeated match at the start of the stream")
+			}
+			if rc.bit(&d.isRepG0[state]) == 0 {
+				if rc.bit(&d.isRep0Long[state<<numPosBitsMax+posState]) == 0 {
+					// short rep: a single byte at rep0
+					if state < 7 {
+						state = 9
+					} else {
+						state = 11
+					}
+					d.out = append(d.out, d.out[len(d.out)-int(rep0)-1])
+					continue
+				}
+			} else {
+				var dist uint32
+				if rc.bit(&d.isRepG1[state]) == 0 {
+					dist = rep1
+				} else {
+					if rc.bit(&d.isRepG2[state]) == 0 {
+						dist = rep2
+					} else {
+						dist = rep3
+						rep3 = rep2
+					}
+					rep2 = rep1
+				}
+				rep1 = rep0
+				rep0 = dist
+			}
+			length = d.repLenDec.decode(rc, posState)
+			if state < 7 {
+				state = 8
+			} else {
+				state = 11
+			}
+		} else {
+			rep3, rep2, rep1 = rep2, rep1, rep0
+			length = d.lenDec.decode(rc, posState)
+			if state < 7 {
+				state = 7
+			} else {
+				state = 10
+			}
+			rep0 = d.distance(length)
+			if rep0 == 0xffffffff {
+				// end marker
+				if h.SizeKnown() && uint64(len(d.out)) != h.Size {
+					return fmt.Errorf("lzma: end marker after 0x%x of 0x%x bytes", len(d.out), h.Size)
+				}
+				return rc.err
+			}
+			if rep0 >= uint32(len(d.out)) {
+				return fmt.Errorf("lzma: match distance 0x%x is outside of the window", rep0+1)
+			}
+		}
+
+		length += matchMinLen
+		if h.SizeKnown() && uint64(len(d.out))+uint64(length) > h.Size {
+			return fmt.Errorf("lzma: match runs past the uncompressed size 0x%x", h.Size)
+		}
+		for n := uint32(0); n < length; n++ {
+			d.out = append(d.out, d.out[len(d.out)-int(rep0)-1])
+		}
+	}
+	return rc.err
+}
@@ -0,0 +1,81 @@
+package lzma
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// "fwtools lzma fwtools lzma fwtools lzma!\n" compressed by liblzma as an
+// LZMA alone stream with an unknown size and an end marker, lc=3 lp=0 pb=2
+const (
+	vectorData   = "fwtools lzma fwtools lzma fwtools lzma!\n"
+	vectorStream = "5d00000100ffffffffffffffff00331dcad5f345d8d0b27c971e61cd48d34c8ce0e951fffffa96e000"
+)
+
+func vector(t *testing.T) []byte {
+	data, err := hex.DecodeString(vectorStream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func withSize(data []byte, size uint64) []byte {
+	data = append([]byte{}, data...)
+	binary.LittleEndian.PutUint64(data[5:], size)
+	return data
+}
+
+func TestDecompress(t *testing.T) {
+	v := vector(t)
+	// the first range coder byte changed so the first match is far
+	// outside of the data decoded so far
+	farMatch := append([]byte{}, v...)
+	farMatch[HeaderSize+1] = 0
+
+	for _, tt := range []struct {
+		name   string
+		stream []byte
+		want   string
+		err    string
+	}{
+		{name: "end marker", stream: v, want: vectorData},
+		{name: "known size", stream: withSize(v, uint64(len(vectorData))), want: vectorData},
+		{name: "end marker before size", stream: withSize(v, uint64(len(vectorData))+1), err: "end marker after"},
+		{name: "truncated", stream: v[:HeaderSize+16], err: "truncated"},
+		{name: "short header", stream: v[:HeaderSize-1], err: "too short"},
+		{name: "distance outside of the window", stream: farMatch, err: "outside of the window"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Decompress(tt.stream)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("Decompress() err=%v, want an error containing '%v'", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Decompress() err=%v", err)
+			}
+			if !bytes.Equal(got, []byte(tt.want)) {
+				t.Errorf("Decompress() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseHeader(t *testing.T) {
+	h, err := ParseHeader(withSize(vector(t), 0x28))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Props != 0x5d || !h.SizeKnown() || h.Size != 0x28 {
+		t.Errorf("ParseHeader() = %+v", h)
+	}
+	if h, _ := ParseHeader(vector(t)); h.SizeKnown() {
+		t.Errorf("ParseHeader() of an end marker stream has a known size")
+	}
+}
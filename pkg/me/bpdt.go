@@ -0,0 +1,212 @@
+package me
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+
+	"github.com/flammit/fwtools/pkg/rom"
+)
+
+// Boot Partition Descriptor Tables of IFWI images (Apollo Lake and newer),
+// as described by coreboot's ifwitool.  A boot partition starts with a
+// BPDT listing its subpartitions, an S_BPDT entry points to a secondary
+// table with more of them.  All offsets are relative to the start of the
+// boot partition.
+
+var (
+	bpdtSignatures = []uint32{
+		0x000055aa,
+		// recovery copy
+		0x00aa55aa,
+	}
+)
+
+type BpdtHeader struct {
+	Signature     uint32
+	NumEntries    uint16
+	Version       uint16
+	XorChecksum   uint32
+	IfwiVersion   uint32
+	FitToolMajor  uint16
+	FitToolMinor  uint16
+	FitToolHotfix uint16
+	FitToolBuild  uint16
+}
+
+func (h BpdtHeader) Valid() bool {
+	for _, signature := range bpdtSignatures {
+		if h.Signature == signature {
+			return (h.Version == 1 || h.Version == 2) && h.NumEntries <= maxBpdtEntries
+		}
+	}
+	return false
+}
+
+type BpdtEntry struct {
+	Type   uint16
+	Flags  uint16
+	Offset uint32
+	Size   uint32
+}
+
+const (
+	bpdtHeaderSize = 0x18
+	bpdtEntrySize  = 0xc
+	maxBpdtEntries = 64
+	bpdtTypeSbpdt  = 5
+	bpdtAlign      = 0x1000
+)
+
+// BpdtType names a subpartition: Name is the name used in the directory
+// of the subpartition, Description the ifwitool name.
+type BpdtType struct {
+	Name        string
+	Description string
+}
+
+var (
+	BpdtTypes = []BpdtType{
+		{"SMIP", "SMIP"},
+		{"RBEP", "CSE_RBE"},
+		{"FTPR", "CSE_BUP"},
+		{"UCOD", "UCODE"},
+		{"IBBP", "IBB"},
+		{"S_BPDT", "S_BPDT"},
+		{"OBBP", "OBB"},
+		{"NFTP", "CSE_MAIN"},
+		{"ISHP", "ISH"},
+		{"DLMP", "CSE_IDLM"},
+		{"IFP_OVERRIDE", "IFP_OVERRIDE"},
+		{"DEBUG_TOKENS", "DEBUG_TOKENS"},
+		{"UFS_PHY", "UFS_PHY"},
+		{"UFS_GPP", "UFS_GPP"},
+		{"PMCP", "PMC"},
+		{"IUNP", "IUNIT"},
+		{"NVM_CONFIG", "NVM_CONFIG"},
+		{"UEP", "UEP"},
+		{"UFS_RATE_B", "UFS_RATE_B"},
+	}
+)
+
+func bpdtType(t uint16) BpdtType {
+	if int(t) < len(BpdtTypes) {
+		return BpdtTypes[t]
+	}
+	name := fmt.Sprintf("type_%d", t)
+	return BpdtType{name, name}
+}
+
+func (e BpdtEntry) String() string {
+	return fmt.Sprintf("Type %v: Offset=0x%08x, Size=0x%08x, Flags=0x%04x",
+		bpdtType(e.Type).Name, e.Offset, e.Size, e.Flags)
+}
+
+// readBpdt reads the table at offset of raw
+func readBpdt(raw []byte, offset uint32) (*BpdtHeader, []BpdtEntry, error) {
+	if uint64(offset)+bpdtHeaderSize > uint64(len(raw)) {
+		return nil, nil, fmt.Errorf("me: BPDT at 0x%x is outside of the region", offset)
+	}
+	bs := bytes.NewReader(raw[offset:])
+	var h BpdtHeader
+	binary.Read(bs, binary.LittleEndian, &h)
+	if !h.Valid() {
+		return nil, nil, fmt.Errorf("me: no valid BPDT at 0x%x", offset)
+	}
+	entries := make([]BpdtEntry, h.NumEntries)
+	if err := binary.Read(bs, binary.LittleEndian, entries); err != nil {
+		return nil, nil, fmt.Errorf("me: truncated BPDT entries at 0x%x: err=%v", offset, err)
+	}
+	return &h, entries, nil
+}
+
+// DetectBPDT splits an IFWI boot partition into its tables and
+// subpartitions.  Code subpartitions are split by their $CPD directory like
+// ME partitions.  Data following the boot partition is left for the next
+// detection pass.
+func DetectBPDT(unknownRegion *rom.Region) ([]*rom.Region, rom.Diagnostics) {
+	var diags rom.Diagnostics
+	var header *BpdtHeader
+	var entries []BpdtEntry
+	offset := uint32(0)
+	// boot partitions start on a 4K boundary, e.g. BP2 after BP1
+	for ; uint64(offset)+bpdtHeaderSize <= uint64(unknownRegion.Size); offset += bpdtAlign {
+		var err error
+		header, entries, err = readBpdt(unknownRegion.Raw, offset)
+		if err == nil && (offset == 0 || len(entries) > 0) {
+			break
+		}
+		header = nil
+	}
+	if header == nil {
+		return nil, nil
+	}
+	baseOffset := unknownRegion.Offset + offset
+	log.Printf("ME BPDT Header: %#v", *header)
+
+	partitions := []*partition{{
+		name:   "BPDT",
+		offset: baseOffset,
+		size:   bpdtHeaderSize + uint32(len(entries))*bpdtEntrySize,
+	}}
+	names := map[string]bool{}
+	add := func(entry BpdtEntry) {
+		log.Printf("ME BPDT Entry: %v", entry)
+		t := bpdtType(entry.Type)
+		if entry.Size == 0 || entry.Offset == 0 {
+			return
+		}
+		if !unknownRegion.Contains(baseOffset+entry.Offset, entry.Size) {
+			diags.Warnf(detectorName, baseOffset+entry.Offset,
+				"subpartition %v (len=0x%08x) is outside of the region, skipping",
+				t.Name, entry.Size)
+			return
+		}
+		name := t.Name
+		for n := 1; names[name]; n++ {
+			name = fmt.Sprintf("%v_%d", t.Name, n)
+		}
+		names[name] = true
+		partitions = append(partitions, &partition{
+			name:     name,
+			offset:   baseOffset + entry.Offset,
+			size:     entry.Size,
+			metadata: map[string]string{"type": t.Description},
+		})
+	}
+	for _, entry := range entries {
+		add(entry)
+		if entry.Type != bpdtTypeSbpdt || entry.Size == 0 {
+			continue
+		}
+		_, sEntries, err := readBpdt(unknownRegion.Raw, offset+entry.Offset)
+		if err != nil {
+			diags.Warnf(detectorName, baseOffset+entry.Offset, "invalid S-BPDT: err=%v", err)
+			continue
+		}
+		for _, sEntry := range sEntries {
+			if sEntry.Type != bpdtTypeSbpdt {
+				add(sEntry)
+			}
+		}
+	}
+
+	end := uint32(0)
+	for _, p := range partitions {
+		if p.offset+p.size > end {
+			end = p.offset + p.size
+		}
+	}
+	size := uint32(rom.AlignUp(uint64(end-baseOffset), bpdtAlign))
+	if !unknownRegion.Contains(baseOffset, size) {
+		size = end - baseOffset
+	}
+	bp := &partition{
+		name:   fmt.Sprintf("BP_%08x", baseOffset),
+		offset: baseOffset,
+		size:   size,
+		nested: nestPartitions(partitions, &diags),
+	}
+	return []*rom.Region{bp.region(unknownRegion, &diags)}, diags
+}
@@ -0,0 +1,210 @@
+package me
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/flammit/fwtools/pkg/rom"
+)
+
+// Partitions and $CPD modules needed by the ME to complete platform
+// bring-up, the same choice as me_cleaner makes for CSE 11+.
+var (
+	CleanPartitions = []string{"FTPR"}
+	CleanModules    = []string{"rbe", "kernel", "syslib", "bup"}
+)
+
+const (
+	cleanAlign = 0x1000
+	emptyByte  = 0xff
+)
+
+// CleanReport lists what Clean kept and removed.
+type CleanReport struct {
+	KeptPartitions    []string
+	RemovedPartitions []string
+	KeptModules       []string
+	RemovedModules    []string
+	// bytes at the start of the ME region still in use
+	Size uint32
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func fill(raw []byte, b byte) {
+	for n := range raw {
+		raw[n] = b
+	}
+}
+
+// cleanPartition is a kept partition with its modules cleaned, where it
+// was and where it goes.
+type cleanPartition struct {
+	entry          *FptEntryConfig
+	partition      []byte
+	from, fromSize uint32
+	offset         uint32
+}
+
+// Clean strips a CSE (ME 11+) region in place, me_cleaner style:
+// partitions other than FTPR are erased and dropped from the FPT and the
+// non-essential $CPD modules of FTPR are erased.  The module entries stay
+// in the directory so the manifest still matches.  FTPR is shortened to
+// the end of its last kept entry and, with relocate, moved next to the FPT.
+// Everything after it is erased, Size tells how much of the region is
+// left.  Pre-CSE regions, whose FTPR has a $MN2 module table and Huffman
+// lookup tables instead of a $CPD directory, are refused.  raw is only
+// written once the new layout is known to fit.
+func Clean(raw []byte, relocate bool) (*CleanReport, error) {
+	if len(raw) < fptRegionSize {
+		return nil, fmt.Errorf("me: region is too small for FPT: size=0x%08x", len(raw))
+	}
+	fpt, err := DecodeFptConfig(raw[:fptRegionSize])
+	if err != nil {
+		return nil, err
+	}
+
+	report := &CleanReport{
+		KeptPartitions:    []string{},
+		RemovedPartitions: []string{},
+		KeptModules:       []string{},
+		RemovedModules:    []string{},
+	}
+	kept := []FptEntryConfig{}
+	removed := []FptEntryConfig{}
+	for _, entry := range fpt.Entries {
+		name := strings.TrimRight(entry.Name, "\000")
+		offset, length := uint32(entry.Offset), uint32(entry.Length)
+		inside := offset != 0xffffffff && uint64(offset)+uint64(length) <= uint64(len(raw))
+		if contains(CleanPartitions, name) {
+			if !inside {
+				return nil, fmt.Errorf("me: partition %v is outside of the ME region", name)
+			}
+			report.KeptPartitions = append(report.KeptPartitions, name)
+			kept = append(kept, entry)
+			continue
+		}
+		report.RemovedPartitions = append(report.RemovedPartitions, name)
+		if inside && offset >= fptRegionSize {
+			removed = append(removed, entry)
+		}
+	}
+	if len(kept) != len(CleanPartitions) {
+		return nil, fmt.Errorf("me: FPT is missing partitions %v, found %v",
+			CleanPartitions, report.KeptPartitions)
+	}
+
+	// lay out the cleaned partitions, in place or next to the FPT
+	sort.SliceStable(kept, func(i, j int) bool { return kept[i].Offset < kept[j].Offset })
+	layout := []cleanPartition{}
+	end := uint32(rom.AlignUp(fptRegionSize, cleanAlign))
+	for n := range kept {
+		entry := &kept[n]
+		offset, length := uint32(entry.Offset), uint32(entry.Length)
+		partition := append([]byte{}, raw[offset:offset+length]...)
+		used, err := cleanModules(partition, strings.TrimRight(entry.Name, "\000"), report)
+		if err != nil {
+			return nil, err
+		}
+		length = uint32(rom.AlignUp(uint64(used), cleanAlign))
+		if length < uint32(len(partition)) {
+			partition = partition[:length]
+		}
+		if !relocate {
+			end = offset
+		}
+		layout = append(layout, cleanPartition{
+			entry:     entry,
+			partition: partition,
+			from:      offset,
+			fromSize:  uint32(entry.Length),
+			offset:    end,
+		})
+		end += uint32(rom.AlignUp(uint64(len(partition)), cleanAlign))
+	}
+	if end > uint32(len(raw)) {
+		return nil, fmt.Errorf("me: cleaned partitions don't fit in the ME region")
+	}
+
+	fpt.Entries = kept
+	for _, p := range layout {
+		p.entry.Offset = rom.Hex32(p.offset)
+		p.entry.Length = rom.Hex32(len(p.partition))
+	}
+	fptBytes, err := fpt.Encode(fptRegionSize)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range removed {
+		fill(raw[entry.Offset:entry.Offset+entry.Length], emptyByte)
+	}
+	for _, p := range layout {
+		fill(raw[p.from:p.from+p.fromSize], emptyByte)
+	}
+	for _, p := range layout {
+		copy(raw[p.offset:], p.partition)
+	}
+	fill(raw[end:], emptyByte)
+	copy(raw, fptBytes)
+	report.Size = end
+	return report, nil
+}
+
+// cleanModules erases the non-essential modules of a $CPD partition and
+// returns the end of the last entry left.  Entries outside of the
+// partition are refused, the partition is corrupt and can't be cleaned.
+func cleanModules(partition []byte, partitionName string, report *CleanReport) (uint32, error) {
+	bs := bytes.NewReader(partition)
+	var header CpdHeader
+	if err := binary.Read(bs, binary.LittleEndian, &header); err != nil || !header.Valid() {
+		return 0, fmt.Errorf("me: partition %v has no $CPD directory, only CSE (ME 11+) regions can be cleaned",
+			partitionName)
+	}
+	size := uint32(len(partition))
+	used := uint32(header.HeaderLength) + header.NumEntries*cpdEntrySize
+	if header.HeaderLength < cpdHeaderLengthMin || header.NumEntries > maxCpdEntries || used > size {
+		return 0, fmt.Errorf("me: partition %v has an invalid $CPD header: length=0x%x entries=%v",
+			partitionName, header.HeaderLength, header.NumEntries)
+	}
+	bs.Seek(int64(header.HeaderLength), 0)
+	entries := make([]CpdEntry, header.NumEntries)
+	if err := binary.Read(bs, binary.LittleEndian, entries); err != nil {
+		return 0, fmt.Errorf("me: partition %v has truncated $CPD entries: err=%v", partitionName, err)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Offset() < entries[j].Offset()
+	})
+	for n, entry := range entries {
+		name := entry.EntryName()
+		offset, length := entry.Offset(), cpdEntryLength(entries, n, size)
+		if uint64(offset)+uint64(length) > uint64(size) {
+			return 0, fmt.Errorf("me: $CPD entry %v of partition %v (0x%x - 0x%x) is outside of the partition",
+				name, partitionName, offset, uint64(offset)+uint64(length))
+		}
+		isModule := !strings.HasSuffix(name, ".man") && !strings.HasSuffix(name, ".met")
+		if isModule && !contains(CleanModules, name) {
+			report.RemovedModules = append(report.RemovedModules, name)
+			fill(partition[offset:offset+length], emptyByte)
+			continue
+		}
+		if isModule {
+			report.KeptModules = append(report.KeptModules, name)
+		}
+		if offset+length > used {
+			used = offset + length
+		}
+	}
+	return used, nil
+}
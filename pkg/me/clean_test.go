@@ -0,0 +1,147 @@
+package me
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/flammit/fwtools/pkg/rom"
+)
+
+type testCpdEntry struct {
+	name           string
+	offset, length uint32
+}
+
+// testCpdEntries are the FTPR entries of testMeRegion, pm is the only
+// module Clean removes
+var testCpdEntries = []testCpdEntry{
+	{"FTPR.man", 0x100, 0x100},
+	{"rbe", 0x1000, 0x800},
+	{"kernel", 0x2000, 0x1000},
+	{"pm", 0x3000, 0x1000},
+	{"bup", 0x4000, 0x1000},
+}
+
+// testMeRegion is a 128KiB CSE region with an FTPR partition at 0x4000 and
+// an MFS partition at 0x10000, partition data is filled with 0x11.
+func testMeRegion(t *testing.T, entries []testCpdEntry) []byte {
+	raw := bytes.Repeat([]byte{0xff}, 0x20000)
+	fpt := FptConfig{
+		RomBypass:     make(rom.HexBytes, 16),
+		HeaderVersion: 0x20,
+		EntryVersion:  0x10,
+		HeaderLength:  fptHeaderSize - fptMarkerOffset,
+		Entries: []FptEntryConfig{
+			{Name: "FTPR", Offset: 0x4000, Length: 0x8000, Type: "code", Valid: true},
+			{Name: "MFS", Offset: 0x10000, Length: 0x4000, Type: "data", Valid: true},
+		},
+	}
+	fptBytes, err := fpt.Encode(fptRegionSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(raw, fptBytes)
+	copy(raw[0x4000:0xc000], bytes.Repeat([]byte{0x11}, 0x8000))
+	copy(raw[0x10000:0x14000], bytes.Repeat([]byte{0x11}, 0x4000))
+
+	var cpd bytes.Buffer
+	binary.Write(&cpd, binary.LittleEndian, CpdHeader{
+		Marker:        cpdSignature,
+		NumEntries:    uint32(len(entries)),
+		HeaderVersion: 2,
+		EntryVersion:  1,
+		HeaderLength:  cpdHeaderLengthMin,
+		PartitionName: [4]byte{'F', 'T', 'P', 'R'},
+	})
+	for _, e := range entries {
+		entry := CpdEntry{OffsetAttrib: e.offset, Length: e.length}
+		copy(entry.Name[:], e.name)
+		binary.Write(&cpd, binary.LittleEndian, entry)
+	}
+	copy(raw[0x4000:], cpd.Bytes())
+	return raw
+}
+
+func erased(raw []byte) bool {
+	return len(bytes.Trim(raw, "\xff")) == 0
+}
+
+func TestClean(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		relocate bool
+		ftpr     uint32
+	}{
+		{"in place", false, 0x4000},
+		{"relocate", true, 0x1000},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := testMeRegion(t, testCpdEntries)
+			report, err := Clean(raw, tt.relocate)
+			if err != nil {
+				t.Fatalf("Clean() err=%v", err)
+			}
+			if strings.Join(report.KeptModules, " ") != "rbe kernel bup" ||
+				strings.Join(report.RemovedModules, " ") != "pm" ||
+				strings.Join(report.RemovedPartitions, " ") != "MFS" {
+				t.Errorf("Clean() = %+v", report)
+			}
+			// FTPR ends with bup
+			if report.Size != tt.ftpr+0x5000 {
+				t.Errorf("Clean() size = 0x%x, want 0x%x", report.Size, tt.ftpr+0x5000)
+			}
+
+			fpt, err := DecodeFptConfig(raw[:fptRegionSize])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(fpt.Entries) != 1 || fpt.Entries[0].Offset != rom.Hex32(tt.ftpr) || fpt.Entries[0].Length != 0x5000 {
+				t.Errorf("cleaned FPT entries = %+v", fpt.Entries)
+			}
+			ftpr := raw[tt.ftpr:]
+			if binary.LittleEndian.Uint32(ftpr) != cpdSignature {
+				t.Errorf("no $CPD at 0x%x", tt.ftpr)
+			}
+			if !erased(ftpr[0x3000:0x4000]) || erased(ftpr[0x2000:0x3000]) || erased(ftpr[0x4000:0x5000]) {
+				t.Errorf("only the pm module should be erased")
+			}
+			if !erased(raw[report.Size:]) {
+				t.Errorf("region isn't erased after 0x%x", report.Size)
+			}
+		})
+	}
+}
+
+func TestCleanRefused(t *testing.T) {
+	outside := append([]testCpdEntry{}, testCpdEntries...)
+	outside[3].offset = 0x5000 // ends past the 0x8000 byte partition
+	outside[3].length = 0x4000
+	empty := append([]testCpdEntry{}, testCpdEntries...)
+	empty[3].offset, empty[3].length = 0x10000, 0
+
+	preCSE := testMeRegion(t, testCpdEntries)
+	copy(preCSE[0x4000:], []byte("$MN2"))
+
+	for _, tt := range []struct {
+		name string
+		raw  []byte
+		err  string
+	}{
+		{"entry past the partition", testMeRegion(t, outside), "outside of the partition"},
+		{"empty entry past the partition", testMeRegion(t, empty), "outside of the partition"},
+		{"pre-CSE", preCSE, "no $CPD directory"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			orig := append([]byte{}, tt.raw...)
+			_, err := Clean(tt.raw, true)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("Clean() err=%v, want an error containing '%v'", err, tt.err)
+			}
+			if !bytes.Equal(tt.raw, orig) {
+				t.Errorf("Clean() changed the region before failing")
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package me
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/flammit/fwtools/pkg/rom"
+)
+
+// CpdHeader is the code partition directory header of CSE 11+ partitions.
+// Version 1 headers are 0x10 bytes and end after PartitionName, version 2
+// headers add a CRC32 Checksum and are 0x14 bytes.
+type CpdHeader struct {
+	Marker        uint32
+	NumEntries    uint32
+	HeaderVersion uint8
+	EntryVersion  uint8
+	HeaderLength  uint8
+	Checksum      uint8
+	PartitionName [4]byte
+}
+
+func (h CpdHeader) Valid() bool {
+	return h.Marker == cpdSignature
+}
+
+type CpdEntry struct {
+	Name         [12]byte
+	OffsetAttrib uint32
+	Length       uint32
+	Reserved     uint32
+}
+
+const (
+	cpdEntrySize       = 0x18
+	cpdOffsetMask      = 0x1ffffff
+	cpdHuffmanFlag     = 1 << 25
+	cpdHeaderLengthMin = 0x10
+	maxCpdEntries      = 256
+)
+
+func (e CpdEntry) EntryName() string {
+	name := e.Name[:]
+	if n := bytes.IndexByte(name, 0); n >= 0 {
+		name = name[:n]
+	}
+	return string(name)
+}
+
+// Offset is relative to the start of the $CPD header
+func (e CpdEntry) Offset() uint32 {
+	return e.OffsetAttrib & cpdOffsetMask
+}
+
+// Huffman is set for modules stored with the ME Huffman compression, their
+// Length is the uncompressed size.
+func (e CpdEntry) Huffman() bool {
+	return e.OffsetAttrib&cpdHuffmanFlag != 0
+}
+
+func (e CpdEntry) String() string {
+	return fmt.Sprintf("Name '%v': Offset=0x%08x, Length=0x%08x, Huffman=%v",
+		e.EntryName(), e.Offset(), e.Length, e.Huffman())
+}
+
+// cpdEntryLength is the size of entry n of the entries sorted by offset.
+// Huffman modules only give the uncompressed length, their data ends where
+// the next entry starts.
+func cpdEntryLength(sorted []CpdEntry, n int, partitionSize uint32) uint32 {
+	entry := sorted[n]
+	if !entry.Huffman() {
+		return entry.Length
+	}
+	for _, next := range sorted[n+1:] {
+		if next.Offset() > entry.Offset() {
+			return next.Offset() - entry.Offset()
+		}
+	}
+	return partitionSize - entry.Offset()
+}
+
+// DetectCPD splits a code partition into its $CPD header and directory,
+// the manifest, metadata files and modules.
+func DetectCPD(unknownRegion *rom.Region) ([]*rom.Region, rom.Diagnostics) {
+	bs := bytes.NewReader(unknownRegion.Raw)
+	baseOffset := unknownRegion.Offset
+	var diags rom.Diagnostics
+
+	var header CpdHeader
+	if err := binary.Read(bs, binary.LittleEndian, &header); err != nil {
+		return nil, nil
+	}
+	if !header.Valid() {
+		return nil, nil
+	}
+	partitionName := strings.TrimRight(string(header.PartitionName[:]), "\000")
+	log.Printf("ME CPD Header %v: %#v", partitionName, header)
+
+	if header.HeaderLength < cpdHeaderLengthMin || header.NumEntries > maxCpdEntries {
+		diags.Errorf(detectorName, baseOffset,
+			"invalid $CPD header: length=0x%x entries=%v", header.HeaderLength, header.NumEntries)
+		return nil, diags
+	}
+	directorySize := uint32(header.HeaderLength) + header.NumEntries*cpdEntrySize
+	if !unknownRegion.Contains(baseOffset, directorySize) {
+		diags.Errorf(detectorName, baseOffset,
+			"$CPD directory (0x%x bytes) is larger than the partition", directorySize)
+		return nil, diags
+	}
+
+	bs.Seek(int64(header.HeaderLength), 0)
+	entries := make([]CpdEntry, header.NumEntries)
+	if err := binary.Read(bs, binary.LittleEndian, entries); err != nil {
+		diags.Errorf(detectorName, baseOffset, "truncated $CPD entries: err=%v", err)
+		return nil, diags
+	}
+
+	regions := []*rom.Region{
+		unknownRegion.Child(baseOffset, directorySize, "raw", "CPD"),
+	}
+
+	sorted := append([]CpdEntry{}, entries...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Offset() < sorted[j].Offset()
+	})
+	end := directorySize
+	// uncompressed sizes of the Huffman modules
+	huffman := map[string]uint32{}
+	for n, entry := range sorted {
+		log.Printf("ME CPD Entry: %v", entry)
+		offset, length := entry.Offset(), cpdEntryLength(sorted, n, unknownRegion.Size)
+		if length == 0 {
+			continue
+		}
+		if offset < end {
+			diags.Warnf(detectorName, baseOffset+offset,
+				"$CPD entry %v (0x%x - 0x%x) overlaps the previous entry, skipping",
+				entry.EntryName(), offset, offset+length)
+			continue
+		}
+		if !unknownRegion.Contains(baseOffset+offset, length) {
+			diags.Warnf(detectorName, baseOffset+offset,
+				"$CPD entry %v (len=0x%08x) is outside of the partition, skipping",
+				entry.EntryName(), length)
+			continue
+		}
+		end = offset + length
+		entryRegion := unknownRegion.Child(baseOffset+offset, length, "raw", entry.EntryName())
+		if strings.HasSuffix(entry.EntryName(), ".man") {
+			addManifestMetadata(entryRegion, &diags)
+		}
+		regions = append(regions, entryRegion)
+		if entry.Huffman() {
+			huffman[entry.EntryName()] = entry.Length
+		}
+	}
+
+	// modules are described by the .met file of the same name
+	met := map[string][]byte{}
+	for _, r := range regions {
+		if name := filepath.Base(r.Name); strings.HasSuffix(name, ".met") {
+			met[strings.TrimSuffix(name, ".met")] = r.Raw
+		}
+	}
+	for _, r := range regions[1:] {
+		name := filepath.Base(r.Name)
+		if strings.HasSuffix(name, ".man") || strings.HasSuffix(name, ".met") {
+			continue
+		}
+		addModuleMetadata(r, met[name], huffman[name], &diags)
+	}
+
+	return regions, diags
+}
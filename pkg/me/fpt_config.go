@@ -0,0 +1,344 @@
+package me
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"strings"
+
+	"github.com/flammit/fwtools/pkg/rom"
+)
+
+func init() {
+	rom.RegisterHandler("fpt", rom.StructHandler{
+		New: func() interface{} { return &FptConfig{} },
+		Decode: func(r *rom.Region) (interface{}, error) {
+			return DecodeFptConfig(r.Raw)
+		},
+		Encode: func(r *rom.Region, v interface{}) ([]byte, error) {
+			return v.(*FptConfig).Encode(r.Size)
+		},
+	})
+}
+
+const (
+	fptHeaderSize   = 0x30
+	fptEntrySize    = 0x20
+	fptMarkerOffset = 0x10
+
+	fptHeaderVersionOffset = 0x18
+	fptHeaderLengthOffset  = 0x1a
+	fptChecksumOffset      = 0x1b
+	fptCrcOffset           = 0x24
+)
+
+// FptConfig is the editable form of the $FPT partition table.  NumEntries
+// follows the Entries list and the header checksum is recomputed on encode,
+// a stored checksum that didn't match is kept in BadChecksum and written
+// back only while the header is unchanged.  Header version 2.1 has Flags
+// in place of the 8-bit checksum and stores a CRC32 in place of
+// FlashLayout.
+type FptConfig struct {
+	RomBypass     rom.HexBytes
+	HeaderVersion rom.Hex8
+	EntryVersion  rom.Hex8
+	HeaderLength  rom.Hex8
+	Flags         rom.Hex8     `json:",omitempty"`
+	BadChecksum   *BadChecksum `json:",omitempty"`
+	TicksToAdd    rom.Hex16
+	TokensToAdd   rom.Hex16
+	Reserved      rom.Hex32
+	FlashLayout   rom.Hex32
+	FitcMajor     uint16
+	FitcMinor     uint16
+	FitcHotfix    uint16
+	FitcBuild     uint16
+	Entries       []FptEntryConfig
+	Extra         []rom.Chunk `json:",omitempty"`
+}
+
+// BadChecksum is a stored checksum and the one its header sums to.
+// Expected is unset for header versions without a known checksum.
+type BadChecksum struct {
+	Stored   rom.Hex32
+	Expected *rom.Hex32 `json:",omitempty"`
+}
+
+// FptEntryConfig is an FPT entry with decoded attributes.  Offset is
+// relative to the start of the ME region.
+type FptEntryConfig struct {
+	Name             string
+	Offset           rom.Hex32
+	Length           rom.Hex32
+	Type             string
+	CopyToDramCache  bool
+	BuiltWithLength1 bool
+	BuiltWithLength2 bool
+	Valid            bool
+	// unknown attribute bits and reserved dwords
+	AttributesReserved rom.Hex32 `json:",omitempty"`
+	Reserved           rom.Hex32 `json:",omitempty"`
+	Reserved1          rom.Hex32 `json:",omitempty"`
+	Reserved2          rom.Hex32 `json:",omitempty"`
+	Reserved3          rom.Hex32 `json:",omitempty"`
+}
+
+// FPT partition types from attributes bits 6:0
+var (
+	PartitionTypes = []string{
+		"code",
+		"data",
+		"nvram",
+		"generic",
+		"effs",
+		"rom",
+	}
+)
+
+const (
+	attrTypeMask        = 0x7f
+	attrCopyToDramCache = 1 << 7
+	attrBuiltWithLen1   = 1 << 15
+	attrBuiltWithLen2   = 1 << 16
+	attrValidShift      = 24
+	attrInvalid         = 0xff
+	attrKnownMask       = attrTypeMask | attrCopyToDramCache | attrBuiltWithLen1 | attrBuiltWithLen2
+)
+
+func partitionTypeName(t uint32) string {
+	if t < uint32(len(PartitionTypes)) {
+		return PartitionTypes[t]
+	}
+	return fmt.Sprintf("0x%02x", t)
+}
+
+func parsePartitionType(name string) (uint32, error) {
+	for t, typeName := range PartitionTypes {
+		if name == typeName {
+			return uint32(t), nil
+		}
+	}
+	var t uint32
+	if _, err := fmt.Sscanf(name, "0x%x", &t); err != nil || t > attrTypeMask {
+		return 0, fmt.Errorf("me: unknown partition type '%v'", name)
+	}
+	return t, nil
+}
+
+func decodeFptEntry(e FptEntry) FptEntryConfig {
+	valid := e.Attributes >> attrValidShift
+	reserved := e.Attributes &^ attrKnownMask &^ (0xff << attrValidShift)
+	if valid != attrInvalid {
+		// keep valid markers other than 0
+		reserved |= valid << attrValidShift
+	}
+	return FptEntryConfig{
+		Name:               strings.TrimRight(string(e.Name[:]), "\000"),
+		Offset:             rom.Hex32(e.Offset),
+		Length:             rom.Hex32(e.Length),
+		Type:               partitionTypeName(e.Attributes & attrTypeMask),
+		CopyToDramCache:    e.Attributes&attrCopyToDramCache != 0,
+		BuiltWithLength1:   e.Attributes&attrBuiltWithLen1 != 0,
+		BuiltWithLength2:   e.Attributes&attrBuiltWithLen2 != 0,
+		Valid:              valid != attrInvalid,
+		AttributesReserved: rom.Hex32(reserved),
+		Reserved:           rom.Hex32(e.Reserved),
+		Reserved1:          rom.Hex32(e.Reserved1),
+		Reserved2:          rom.Hex32(e.Reserved2),
+		Reserved3:          rom.Hex32(e.Reserved3),
+	}
+}
+
+func (c FptEntryConfig) encode() (FptEntry, error) {
+	e := FptEntry{
+		Offset:    uint32(c.Offset),
+		Length:    uint32(c.Length),
+		Reserved:  uint32(c.Reserved),
+		Reserved1: uint32(c.Reserved1),
+		Reserved2: uint32(c.Reserved2),
+		Reserved3: uint32(c.Reserved3),
+	}
+	if len(c.Name) > len(e.Name) {
+		return e, fmt.Errorf("me: partition name '%v' is longer than %v bytes", c.Name, len(e.Name))
+	}
+	copy(e.Name[:], c.Name)
+
+	t, err := parsePartitionType(c.Type)
+	if err != nil {
+		return e, err
+	}
+	e.Attributes = t | uint32(c.AttributesReserved)
+	if c.CopyToDramCache {
+		e.Attributes |= attrCopyToDramCache
+	}
+	if c.BuiltWithLength1 {
+		e.Attributes |= attrBuiltWithLen1
+	}
+	if c.BuiltWithLength2 {
+		e.Attributes |= attrBuiltWithLen2
+	}
+	if !c.Valid {
+		e.Attributes |= attrInvalid << attrValidShift
+	}
+	return e, nil
+}
+
+// fptChecksum computes the header checksum of an FPT starting at raw[0]
+// (including the ROM bypass vector) and returns where it is stored.
+// Header versions 1.0 and 2.0 keep an 8-bit sum in HeaderChecksum, 2.1
+// keeps a CRC32 in place of FlashLayout.  ok is false for unknown header
+// versions.
+func fptChecksum(raw []byte) (sum uint32, offset, size int, ok bool) {
+	if len(raw) < fptHeaderSize {
+		return 0, 0, 0, false
+	}
+	headerLen := int(raw[fptHeaderLengthOffset])
+	if headerLen < fptHeaderSize-fptMarkerOffset || fptMarkerOffset+headerLen > len(raw) {
+		return 0, 0, 0, false
+	}
+	header := append([]byte{}, raw[fptMarkerOffset:fptMarkerOffset+headerLen]...)
+	switch raw[fptHeaderVersionOffset] {
+	case 0x10, 0x20:
+		header[fptChecksumOffset-fptMarkerOffset] = 0
+		var sum8 uint8
+		for _, b := range header {
+			sum8 += b
+		}
+		return uint32(-sum8), fptChecksumOffset, 1, true
+	case 0x21:
+		copy(header[fptCrcOffset-fptMarkerOffset:], []byte{0, 0, 0, 0})
+		return crc32.ChecksumIEEE(header), fptCrcOffset, 4, true
+	}
+	return 0, 0, 0, false
+}
+
+func storedFptChecksum(raw []byte, offset, size int) uint32 {
+	if size == 1 {
+		return uint32(raw[offset])
+	}
+	return binary.LittleEndian.Uint32(raw[offset:])
+}
+
+// VerifyFptChecksum reports whether the FPT header checksum is valid.
+func VerifyFptChecksum(raw []byte) (valid, known bool) {
+	sum, offset, size, ok := fptChecksum(raw)
+	if !ok {
+		return false, false
+	}
+	return storedFptChecksum(raw, offset, size) == sum, true
+}
+
+func DecodeFptConfig(raw []byte) (*FptConfig, error) {
+	bs := bytes.NewReader(raw)
+	var h FptHeader
+	if err := binary.Read(bs, binary.LittleEndian, &h); err != nil {
+		return nil, err
+	}
+	if !h.Valid() {
+		return nil, fmt.Errorf("me: missing $FPT signature")
+	}
+	if uint64(h.NumEntries)*fptEntrySize+fptHeaderSize > uint64(len(raw)) {
+		return nil, fmt.Errorf("me: %v FPT entries don't fit in 0x%x bytes", h.NumEntries, len(raw))
+	}
+
+	c := &FptConfig{
+		RomBypass:     rom.HexBytes(h.RomBypass[:]),
+		HeaderVersion: rom.Hex8(h.HeaderVersion),
+		EntryVersion:  rom.Hex8(h.EntryVersion),
+		HeaderLength:  rom.Hex8(h.HeaderLength),
+		TicksToAdd:    rom.Hex16(h.TicksToAdd),
+		TokensToAdd:   rom.Hex16(h.TokensToAdd),
+		Reserved:      rom.Hex32(h.Reserved),
+		FlashLayout:   rom.Hex32(h.FlashLayout),
+		FitcMajor:     h.FitcMajor,
+		FitcMinor:     h.FitcMinor,
+		FitcHotfix:    h.FitcHotfix,
+		FitcBuild:     h.FitcBuild,
+		Entries:       []FptEntryConfig{},
+	}
+	if sum, offset, size, ok := fptChecksum(raw); ok {
+		if stored := storedFptChecksum(raw, offset, size); stored != sum {
+			expected := rom.Hex32(sum)
+			c.BadChecksum = &BadChecksum{Stored: rom.Hex32(stored), Expected: &expected}
+		}
+		if size == 4 {
+			c.Flags = rom.Hex8(h.HeaderChecksum)
+			c.FlashLayout = 0
+		}
+	} else {
+		c.BadChecksum = &BadChecksum{Stored: rom.Hex32(h.HeaderChecksum)}
+	}
+	for n := uint32(0); n < h.NumEntries; n++ {
+		var e FptEntry
+		if err := binary.Read(bs, binary.LittleEndian, &e); err != nil {
+			return nil, err
+		}
+		c.Entries = append(c.Entries, decodeFptEntry(e))
+	}
+
+	coverage := rom.NewCoverage(uint32(len(raw)))
+	coverage.Cover(0, fptHeaderSize+h.NumEntries*fptEntrySize)
+	c.Extra = coverage.Chunks(raw)
+	return c, nil
+}
+
+func (c FptConfig) Encode(size uint32) ([]byte, error) {
+	if uint64(len(c.Entries))*fptEntrySize+fptHeaderSize > uint64(size) {
+		return nil, fmt.Errorf("me: %v FPT entries don't fit in 0x%x bytes", len(c.Entries), size)
+	}
+	h := FptHeader{
+		Marker:        fptSignature,
+		NumEntries:    uint32(len(c.Entries)),
+		HeaderVersion: uint8(c.HeaderVersion),
+		EntryVersion:  uint8(c.EntryVersion),
+		HeaderLength:  uint8(c.HeaderLength),
+		// only kept for header version 2.1, overwritten by the checksum otherwise
+		HeaderChecksum: uint8(c.Flags),
+		TicksToAdd:     uint16(c.TicksToAdd),
+		TokensToAdd:    uint16(c.TokensToAdd),
+		Reserved:       uint32(c.Reserved),
+		FlashLayout:    uint32(c.FlashLayout),
+		FitcMajor:      c.FitcMajor,
+		FitcMinor:      c.FitcMinor,
+		FitcHotfix:     c.FitcHotfix,
+		FitcBuild:      c.FitcBuild,
+	}
+	if len(c.RomBypass) != len(h.RomBypass) {
+		return nil, fmt.Errorf("me: ROM bypass must be %v bytes", len(h.RomBypass))
+	}
+	copy(h.RomBypass[:], c.RomBypass)
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, h)
+	for _, entry := range c.Entries {
+		e, err := entry.encode()
+		if err != nil {
+			return nil, err
+		}
+		binary.Write(&buf, binary.LittleEndian, e)
+	}
+
+	raw := rom.EmptyBytes(size)
+	copy(raw, buf.Bytes())
+	if err := rom.ApplyChunks(raw, c.Extra); err != nil {
+		return nil, err
+	}
+	sum, offset, sumSize, ok := fptChecksum(raw)
+	if !ok {
+		offset, sumSize = fptChecksumOffset, 1
+		if c.BadChecksum == nil {
+			return nil, fmt.Errorf("me: can't compute the checksum of FPT header version 0x%02x",
+				uint8(c.HeaderVersion))
+		}
+	}
+	if bad := c.BadChecksum; bad != nil && (!ok || bad.Expected != nil && uint32(*bad.Expected) == sum) {
+		sum = uint32(bad.Stored)
+	}
+	if sumSize == 1 {
+		raw[offset] = uint8(sum)
+	} else {
+		binary.LittleEndian.PutUint32(raw[offset:], sum)
+	}
+	return raw, nil
+}
@@ -0,0 +1,94 @@
+package me
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// testFpt is a 4KiB FPT with an FTPR code and an MFS data partition and a
+// valid header checksum for the header version.
+func testFpt(headerVersion uint8) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, FptHeader{
+		Marker:        fptSignature,
+		NumEntries:    2,
+		HeaderVersion: headerVersion,
+		EntryVersion:  0x10,
+		HeaderLength:  fptHeaderSize - fptMarkerOffset,
+		TicksToAdd:    0x20,
+		TokensToAdd:   0x10,
+		FitcMajor:     11,
+		FitcMinor:     8,
+		FitcBuild:     1234,
+	})
+	for _, e := range []FptEntry{
+		{Name: [4]byte{'F', 'T', 'P', 'R'}, Offset: 0x1000, Length: 0x10000, Attributes: 0x00000000},
+		{Name: [4]byte{'M', 'F', 'S', 0}, Offset: 0x11000, Length: 0x8000, Attributes: 0x00000001},
+	} {
+		binary.Write(&b, binary.LittleEndian, e)
+	}
+	raw := append(b.Bytes(), bytes.Repeat([]byte{0xff}, 0x1000-b.Len())...)
+	sum, offset, size, _ := fptChecksum(raw)
+	if size == 1 {
+		raw[offset] = uint8(sum)
+	} else {
+		binary.LittleEndian.PutUint32(raw[offset:], sum)
+	}
+	return raw
+}
+
+func fptRoundTrip(t *testing.T, raw []byte) (*FptConfig, []byte) {
+	c, err := DecodeFptConfig(raw)
+	if err != nil {
+		t.Fatalf("DecodeFptConfig() err=%v", err)
+	}
+	encoded, err := c.Encode(uint32(len(raw)))
+	if err != nil {
+		t.Fatalf("Encode() err=%v", err)
+	}
+	return c, encoded
+}
+
+func TestFptRoundTrip(t *testing.T) {
+	for _, version := range []uint8{0x20, 0x21} {
+		raw := testFpt(version)
+		if valid, known := VerifyFptChecksum(raw); !valid || !known {
+			t.Fatalf("header version 0x%02x: VerifyFptChecksum() = %v, %v", version, valid, known)
+		}
+		c, encoded := fptRoundTrip(t, raw)
+		if !bytes.Equal(encoded, raw) {
+			t.Errorf("header version 0x%02x: Encode(DecodeFptConfig()) = %x, want %x",
+				version, encoded[:0x70], raw[:0x70])
+		}
+		if len(c.Entries) != 2 || c.Entries[0].Name != "FTPR" || c.Entries[1].Type != "data" || c.BadChecksum != nil {
+			t.Errorf("header version 0x%02x: DecodeFptConfig() = %+v", version, c)
+		}
+	}
+}
+
+func TestFptChecksum(t *testing.T) {
+	raw := testFpt(0x20)
+	raw[fptChecksumOffset]++
+	c, encoded := fptRoundTrip(t, raw)
+	if c.BadChecksum == nil || !bytes.Equal(encoded, raw) {
+		t.Fatalf("bad checksum isn't kept: %+v", c.BadChecksum)
+	}
+
+	// an edited header gets a new checksum
+	c.FitcBuild++
+	encoded, err := c.Encode(uint32(len(raw)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if valid, _ := VerifyFptChecksum(encoded); !valid {
+		t.Errorf("edited header has an invalid checksum")
+	}
+
+	// unknown header versions keep the stored byte
+	raw = testFpt(0x30)
+	raw[fptChecksumOffset] = 0x5a
+	if _, encoded := fptRoundTrip(t, raw); !bytes.Equal(encoded, raw) {
+		t.Errorf("header version 0x30 doesn't round trip")
+	}
+}
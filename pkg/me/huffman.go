@@ -0,0 +1,197 @@
+package me
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ME Huffman modules are split into 4KiB chunks that are compressed on
+// their own, as described by unhuffme and MEAnalyzer.  The module starts
+// with a table of one dword per chunk: the offset of the chunk data in the
+// module and the dictionary its codes are looked up in.  Chunk data is a
+// bit stream, most significant bit first, of variable length codes that
+// each stand for a short run of bytes.
+//
+// The dictionaries are in the ME boot ROM, not in the flash, so they
+// aren't part of fwtools: LoadHuffmanDictionaries reads them from a text
+// file with one code per line,
+//
+//	<dictionary> <code bits> <hex bytes>
+//
+// e.g. "0 0101110 488b45", blank lines and lines starting with '#' are
+// skipped.
+
+const (
+	HuffmanChunkSize   = 0x1000
+	huffmanOffsetMask  = 0x1ffffff
+	huffmanDictShift   = 25
+	huffmanDictMask    = 0x3
+	huffmanMaxCodeBits = 32
+)
+
+type huffmanCode struct {
+	bits uint
+	code uint32
+}
+
+// HuffmanDictionary maps the codes of one dictionary to their bytes
+type HuffmanDictionary struct {
+	codes            map[huffmanCode][]byte
+	minBits, maxBits uint
+}
+
+func (d *HuffmanDictionary) add(bits string, data []byte) error {
+	if len(bits) == 0 || len(bits) > huffmanMaxCodeBits {
+		return fmt.Errorf("code '%v' must have 1 to %d bits", bits, huffmanMaxCodeBits)
+	}
+	code, err := strconv.ParseUint(bits, 2, 32)
+	if err != nil {
+		return fmt.Errorf("invalid code '%v'", bits)
+	}
+	if len(data) == 0 {
+		return fmt.Errorf("code '%v' has no bytes", bits)
+	}
+	if d.codes == nil {
+		d.codes = map[huffmanCode][]byte{}
+		d.minBits = huffmanMaxCodeBits
+	}
+	n := uint(len(bits))
+	d.codes[huffmanCode{n, uint32(code)}] = data
+	if n < d.minBits {
+		d.minBits = n
+	}
+	if n > d.maxBits {
+		d.maxBits = n
+	}
+	return nil
+}
+
+// huffmanDictionaries are used to decompress Huffman modules during
+// detection, modules stay compressed while there are none.
+var huffmanDictionaries []HuffmanDictionary
+
+// SetHuffmanDictionaries sets the dictionaries used by DetectCPD
+func SetHuffmanDictionaries(dicts []HuffmanDictionary) {
+	huffmanDictionaries = dicts
+}
+
+// LoadHuffmanDictionaries reads dictionaries in the text format above
+func LoadHuffmanDictionaries(path string) ([]HuffmanDictionary, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	dicts := []HuffmanDictionary{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("me: %v:%d: expected '<dictionary> <code bits> <hex bytes>'", path, line)
+		}
+		n, err := strconv.ParseUint(fields[0], 0, 8)
+		if err != nil || n > huffmanDictMask {
+			return nil, fmt.Errorf("me: %v:%d: invalid dictionary '%v'", path, line, fields[0])
+		}
+		data, err := hex.DecodeString(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("me: %v:%d: invalid bytes '%v'", path, line, fields[2])
+		}
+		for int(n) >= len(dicts) {
+			dicts = append(dicts, HuffmanDictionary{})
+		}
+		if err := dicts[n].add(fields[1], data); err != nil {
+			return nil, fmt.Errorf("me: %v:%d: %v", path, line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return dicts, nil
+}
+
+// huffmanBits reads a bit stream most significant bit first
+type huffmanBits struct {
+	data []byte
+	pos  uint
+}
+
+func (b *huffmanBits) peek(n uint) (uint32, bool) {
+	if b.pos+n > uint(len(b.data))*8 {
+		return 0, false
+	}
+	v := uint32(0)
+	for i := b.pos; i < b.pos+n; i++ {
+		v = v<<1 | uint32(b.data[i/8]>>(7-i%8))&1
+	}
+	return v, true
+}
+
+func (d HuffmanDictionary) decodeChunk(data []byte) ([]byte, error) {
+	out := make([]byte, 0, HuffmanChunkSize)
+	bits := &huffmanBits{data: data}
+	for len(out) < HuffmanChunkSize {
+		found := false
+		for n := d.minBits; n <= d.maxBits && !found; n++ {
+			code, ok := bits.peek(n)
+			if !ok {
+				return nil, fmt.Errorf("truncated at 0x%x of 0x%x bytes", len(out), HuffmanChunkSize)
+			}
+			if symbol, ok := d.codes[huffmanCode{n, code}]; ok {
+				out = append(out, symbol...)
+				bits.pos += n
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown code at bit %d", bits.pos)
+		}
+	}
+	if len(out) != HuffmanChunkSize {
+		return nil, fmt.Errorf("decodes to 0x%x bytes", len(out))
+	}
+	return out, nil
+}
+
+// DecompressHuffman expands a Huffman module of size uncompressed bytes
+func DecompressHuffman(raw []byte, size uint32, dicts []HuffmanDictionary) ([]byte, error) {
+	if size == 0 || size%HuffmanChunkSize != 0 {
+		return nil, fmt.Errorf("me: Huffman module size 0x%x isn't a multiple of 0x%x", size, HuffmanChunkSize)
+	}
+	chunks := int(size / HuffmanChunkSize)
+	if chunks*4 > len(raw) {
+		return nil, fmt.Errorf("me: Huffman chunk table of %d chunks doesn't fit in 0x%x bytes", chunks, len(raw))
+	}
+	out := make([]byte, 0, size)
+	for n := 0; n < chunks; n++ {
+		entry := binary.LittleEndian.Uint32(raw[n*4:])
+		start := entry & huffmanOffsetMask
+		end := uint32(len(raw))
+		if n+1 < chunks {
+			end = binary.LittleEndian.Uint32(raw[(n+1)*4:]) & huffmanOffsetMask
+		}
+		if start < uint32(chunks*4) || start > end || end > uint32(len(raw)) {
+			return nil, fmt.Errorf("me: Huffman chunk %d at 0x%x - 0x%x is outside of the module", n, start, end)
+		}
+		dict := int(entry >> huffmanDictShift & huffmanDictMask)
+		if dict >= len(dicts) || dicts[dict].codes == nil {
+			return nil, fmt.Errorf("me: Huffman chunk %d uses the missing dictionary %d", n, dict)
+		}
+		data, err := dicts[dict].decodeChunk(raw[start:end])
+		if err != nil {
+			return nil, fmt.Errorf("me: Huffman chunk %d: %v", n, err)
+		}
+		out = append(out, data...)
+	}
+	return out, nil
+}
@@ -0,0 +1,130 @@
+package me
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// a made-up dictionary, the ME ones can't be shipped
+const testDictionaries = `# dictionary code bytes
+0 0   00
+0 10  ff
+0 110 4889e5
+0 111 c3
+1 1   00
+1 01  90
+`
+
+func loadTestDictionaries(t *testing.T) []HuffmanDictionary {
+	path := filepath.Join(t.TempDir(), "huffman.txt")
+	if err := os.WriteFile(path, []byte(testDictionaries), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dicts, err := LoadHuffmanDictionaries(path)
+	if err != nil {
+		t.Fatalf("LoadHuffmanDictionaries() err=%v", err)
+	}
+	return dicts
+}
+
+// bitWriter writes codes most significant bit first
+type bitWriter struct {
+	data []byte
+	pos  uint
+}
+
+func (w *bitWriter) write(code string) {
+	for _, c := range code {
+		if w.pos%8 == 0 {
+			w.data = append(w.data, 0)
+		}
+		if c == '1' {
+			w.data[len(w.data)-1] |= 0x80 >> (w.pos % 8)
+		}
+		w.pos++
+	}
+}
+
+// chunkCodes fills a chunk with the codes in order, repeating the last
+func chunkCodes(dict HuffmanDictionary, codes ...string) ([]byte, []byte) {
+	w := &bitWriter{}
+	out := []byte{}
+	for n := 0; len(out) < HuffmanChunkSize; n++ {
+		code := codes[len(codes)-1]
+		if n < len(codes) {
+			code = codes[n]
+		}
+		w.write(code)
+		out = append(out, dict.codes[huffmanCode{uint(len(code)), parseBits(code)}]...)
+	}
+	return w.data, out
+}
+
+func parseBits(code string) uint32 {
+	v := uint32(0)
+	for _, c := range code {
+		v = v<<1 | uint32(c-'0')
+	}
+	return v
+}
+
+func TestDecompressHuffman(t *testing.T) {
+	dicts := loadTestDictionaries(t)
+	chunk0, want0 := chunkCodes(dicts[0], "110", "111", "10", "0")
+	chunk1, want1 := chunkCodes(dicts[1], "01", "1")
+
+	// chunk table, then the chunks
+	module := make([]byte, 8)
+	binary.LittleEndian.PutUint32(module[0:], uint32(len(module)))
+	binary.LittleEndian.PutUint32(module[4:], uint32(len(module)+len(chunk0))|1<<huffmanDictShift)
+	module = append(append(module, chunk0...), chunk1...)
+
+	got, err := DecompressHuffman(module, 2*HuffmanChunkSize, dicts)
+	if err != nil {
+		t.Fatalf("DecompressHuffman() err=%v", err)
+	}
+	if want := append(want0, want1...); !bytes.Equal(got, want) {
+		t.Errorf("DecompressHuffman() = %x..., want %x...", got[:16], want[:16])
+	}
+
+	for _, tt := range []struct {
+		name   string
+		module []byte
+		size   uint32
+		dicts  []HuffmanDictionary
+		err    string
+	}{
+		{"unaligned size", module, HuffmanChunkSize + 1, dicts, "isn't a multiple"},
+		{"missing dictionary", module, 2 * HuffmanChunkSize, dicts[:1], "missing dictionary 1"},
+		{"truncated", module[:len(module)-1], 2 * HuffmanChunkSize, dicts, "truncated"},
+		{"chunk table", module[:4], 2 * HuffmanChunkSize, dicts, "doesn't fit"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := DecompressHuffman(tt.module, tt.size, tt.dicts)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("DecompressHuffman() err=%v, want an error containing '%v'", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestLoadHuffmanDictionariesErrors(t *testing.T) {
+	for _, line := range []string{
+		"0 012 00",
+		"0 01",
+		"4 01 00",
+		"0 01 0g",
+	} {
+		path := filepath.Join(t.TempDir(), "huffman.txt")
+		if err := os.WriteFile(path, []byte(line+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadHuffmanDictionaries(path); err == nil {
+			t.Errorf("LoadHuffmanDictionaries(%q) succeeded", line)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package me
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/flammit/fwtools/pkg/rom"
+)
+
+// ManifestHeader is the signed $MN2 manifest header found at the start of
+// ME code partitions (and .man files in CSE 11+ $CPD directories).  The
+// RSA public key modulus starts at 0x80 followed by the exponent and the
+// signature, their sizes are given in dwords.
+type ManifestHeader struct {
+	HeaderType    uint32
+	HeaderLength  uint32
+	HeaderVersion uint32
+	Flags         uint32
+	Vendor        uint32
+	Date          uint32 // BCD: year << 16 | month << 8 | day
+	Size          uint32
+	Marker        uint32
+	Reserved0     uint32
+	Major         uint16
+	Minor         uint16
+	Hotfix        uint16
+	Build         uint16
+	SVN           uint32
+	Reserved1     [0x48]uint8
+	KeySize       uint32
+	ExponentSize  uint32
+}
+
+const (
+	manifestKeyOffset = 0x80
+)
+
+func (h ManifestHeader) Valid() bool {
+	return h.Marker == cpdManifestSignature
+}
+
+func (h ManifestHeader) Version() string {
+	return fmt.Sprintf("%d.%d.%d.%d", h.Major, h.Minor, h.Hotfix, h.Build)
+}
+
+func (h ManifestHeader) DateString() string {
+	return fmt.Sprintf("%04x-%02x-%02x", h.Date>>16, (h.Date>>8)&0xff, h.Date&0xff)
+}
+
+// Manifest is a decoded $MN2 header with its signing key.
+type Manifest struct {
+	Header    ManifestHeader
+	Modulus   []byte
+	Exponent  []byte
+	Signature []byte
+}
+
+func ParseManifest(raw []byte) (*Manifest, error) {
+	var h ManifestHeader
+	if err := binary.Read(bytes.NewReader(raw), binary.LittleEndian, &h); err != nil {
+		return nil, fmt.Errorf("me: truncated manifest header: err=%v", err)
+	}
+	if !h.Valid() {
+		return nil, fmt.Errorf("me: missing $MN2 signature")
+	}
+	keySize, expSize := uint64(h.KeySize)*4, uint64(h.ExponentSize)*4
+	end := manifestKeyOffset + 2*keySize + expSize
+	if keySize == 0 || expSize == 0 || end > uint64(len(raw)) {
+		return nil, fmt.Errorf("me: manifest key (0x%x/0x%x bytes) doesn't fit in 0x%x bytes",
+			keySize, expSize, len(raw))
+	}
+	m := &Manifest{Header: h}
+	off := uint64(manifestKeyOffset)
+	m.Modulus = append([]byte{}, raw[off:off+keySize]...)
+	off += keySize
+	m.Exponent = append([]byte{}, raw[off:off+expSize]...)
+	off += expSize
+	m.Signature = append([]byte{}, raw[off:off+keySize]...)
+	return m, nil
+}
+
+// KeyHash is the SHA-256 of the public key modulus and exponent as they
+// are stored in the manifest, as reported by Intel tools.
+func (m Manifest) KeyHash() string {
+	h := sha256.New()
+	h.Write(m.Modulus)
+	h.Write(m.Exponent)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (m Manifest) Metadata() map[string]string {
+	exponent := uint64(0)
+	for n := len(m.Exponent) - 1; n >= 0; n-- {
+		exponent = exponent<<8 | uint64(m.Exponent[n])
+	}
+	return map[string]string{
+		"version":      m.Header.Version(),
+		"svn":          fmt.Sprintf("%d", m.Header.SVN),
+		"vendor":       fmt.Sprintf("0x%04x", m.Header.Vendor),
+		"date":         m.Header.DateString(),
+		"key_size":     fmt.Sprintf("%d", len(m.Modulus)*8),
+		"key_exponent": fmt.Sprintf("0x%x", exponent),
+		"key_hash":     m.KeyHash(),
+	}
+}
+
+// addManifestMetadata records the manifest of a region in its metadata,
+// regions without a $MN2 header are left alone.
+func addManifestMetadata(r *rom.Region, diags *rom.Diagnostics) {
+	if len(r.Raw) < 0x20 || binary.LittleEndian.Uint32(r.Raw[0x1c:]) != cpdManifestSignature {
+		return
+	}
+	m, err := ParseManifest(r.Raw)
+	if err != nil {
+		diags.Warnf(detectorName, r.Offset, "invalid manifest: err=%v", err)
+		return
+	}
+	if r.Metadata == nil {
+		r.Metadata = map[string]string{}
+	}
+	for k, v := range m.Metadata() {
+		r.Metadata[k] = v
+	}
+}
@@ -55,43 +55,198 @@ func (e FptEntry) String() string {
 		e.Name, e.Offset, e.Length, e.Attributes)
 }
 
-func DetectME(unknownRegion *rom.Region) []*rom.Region {
+const (
+	detectorName  = "me"
+	maxFptEntries = 128
+	// $FPT header, entries and footer
+	fptRegionSize = 0xe00
+)
+
+// mfsRegion types the MFS partition so its files are extracted, partitions
+// that don't parse stay raw.
+func mfsRegion(unknownRegion *rom.Region, offset, size uint32, diags *rom.Diagnostics) *rom.Region {
+	r := unknownRegion.Child(offset, size, "raw", "MFS")
+	m, err := ParseMFS(r.Raw)
+	if err != nil {
+		diags.Warnf(detectorName, offset, "failed to parse MFS, saving raw: err=%v", err)
+		return r
+	}
+	numFiles := 0
+	for _, data := range m.Files {
+		if data != nil {
+			numFiles++
+		}
+	}
+	r.Type = "mfs"
+	r.Metadata = map[string]string{
+		"files": fmt.Sprintf("%d", numFiles),
+	}
+	return r
+}
+
+// partition is an FPT entry, partitions like FTUP are containers for the
+// entries that lie within them (NFTP, WCOD and LOCL).
+type partition struct {
+	name         string
+	offset, size uint32
+	nested       []*partition
+	// metadata of the partition region, e.g. the BPDT type
+	metadata map[string]string
+}
+
+func (p partition) contains(other *partition) bool {
+	return other.offset >= p.offset && other.offset+other.size <= p.offset+p.size
+}
+
+// nestPartitions builds the partition hierarchy: an entry that lies within
+// a larger one becomes its child.  Entries that partially overlap another
+// one can't be represented and are skipped.
+func nestPartitions(partitions []*partition, diags *rom.Diagnostics) []*partition {
+	sort.SliceStable(partitions, func(i, j int) bool {
+		if partitions[i].offset != partitions[j].offset {
+			return partitions[i].offset < partitions[j].offset
+		}
+		return partitions[i].size > partitions[j].size
+	})
+	top := []*partition{}
+	// containers enclosing the current offset, innermost last
+	stack := []*partition{}
+	for _, p := range partitions {
+		for len(stack) > 0 && p.offset >= stack[len(stack)-1].offset+stack[len(stack)-1].size {
+			stack = stack[:len(stack)-1]
+		}
+		if len(stack) == 0 {
+			top = append(top, p)
+			stack = append(stack, p)
+			continue
+		}
+		parent := stack[len(stack)-1]
+		if !parent.contains(p) || p.offset == parent.offset && p.size == parent.size {
+			diags.Warnf(detectorName, p.offset,
+				"partition %v (len=0x%08x) overlaps partition %v, skipping",
+				p.name, p.size, parent.name)
+			continue
+		}
+		parent.nested = append(parent.nested, p)
+		stack = append(stack, p)
+	}
+	return top
+}
+
+// region creates the region of a partition within parent, containers are
+// detected into their nested partitions and the gaps between them.
+func (p partition) region(parent *rom.Region, diags *rom.Diagnostics) *rom.Region {
+	r := p.detect(parent, diags)
+	for k, v := range p.metadata {
+		if r.Metadata == nil {
+			r.Metadata = map[string]string{}
+		}
+		r.Metadata[k] = v
+	}
+	return r
+}
+
+func (p partition) detect(parent *rom.Region, diags *rom.Diagnostics) *rom.Region {
+	if len(p.nested) > 0 {
+		r := parent.Child(p.offset, p.size, "unknown", p.name)
+		nested := []*rom.Region{}
+		for _, n := range p.nested {
+			nested = append(nested, n.region(r, diags))
+		}
+		return rom.DetectRegions([]rom.Detector{
+			func(u *rom.Region) ([]*rom.Region, rom.Diagnostics) {
+				if u != r {
+					// gaps between nested partitions
+					return nil, nil
+				}
+				return nested, nil
+			},
+		}, r)
+	}
+	if p.name == "MFS" {
+		return mfsRegion(parent, p.offset, p.size, diags)
+	}
+	r := parent.Child(p.offset, p.size, "unknown", p.name)
+	r = rom.DetectRegions([]rom.Detector{DetectCPD}, r)
+	if r.Type == "raw" {
+		// pre-CSE code partitions start with their manifest
+		addManifestMetadata(r, diags)
+	}
+	return r
+}
+
+func DetectME(unknownRegion *rom.Region) ([]*rom.Region, rom.Diagnostics) {
 	bs := bytes.NewReader(unknownRegion.Raw)
 	baseOffset := unknownRegion.Offset
+	var diags rom.Diagnostics
 
 	var fptHeader FptHeader
-	binary.Read(bs, binary.LittleEndian, &fptHeader)
+	if err := binary.Read(bs, binary.LittleEndian, &fptHeader); err != nil {
+		return nil, nil
+	}
 
 	if !fptHeader.Valid() {
-		return nil
+		return nil, nil
 	}
 
 	log.Printf("ME FPT Header:\n%#v\n", fptHeader)
+	if fptHeader.NumEntries > maxFptEntries {
+		diags.Errorf(detectorName, baseOffset+0x14,
+			"FPT has too many entries: %v", fptHeader.NumEntries)
+		return nil, diags
+	}
 	fptEntries := make([]FptEntry, fptHeader.NumEntries)
 	for n := uint32(0); n < fptHeader.NumEntries; n++ {
-		binary.Read(bs, binary.LittleEndian, &fptEntries[n])
+		if err := binary.Read(bs, binary.LittleEndian, &fptEntries[n]); err != nil {
+			diags.Errorf(detectorName, baseOffset+0x30+n*0x20,
+				"truncated FPT entry %v: err=%v", n, err)
+			return nil, diags
+		}
 		log.Printf("ME FPT Entry: %v", fptEntries[n])
 	}
 
+	if !unknownRegion.Contains(baseOffset, fptRegionSize) {
+		diags.Errorf(detectorName, baseOffset,
+			"region is too small for FPT: size=0x%08x", unknownRegion.Size)
+		return nil, diags
+	}
+
+	fptRegion := unknownRegion.Child(baseOffset, fptRegionSize, "fpt", "FPT")
+	if valid, known := VerifyFptChecksum(fptRegion.Raw); !known {
+		diags.Infof(detectorName, baseOffset+fptChecksumOffset,
+			"FPT header version 0x%02x checksum can't be verified", fptHeader.HeaderVersion)
+	} else if !valid {
+		diags.Warnf(detectorName, baseOffset+fptChecksumOffset,
+			"FPT header checksum is invalid")
+	}
+
 	regions := []*rom.Region{}
-	// $FPT
-	// TODO: replace with typed FptHeader+FptEntry+??Footer??
-	// TODO: need to figure out the footer at 0xd80[0x8]
-	regions = append(regions, unknownRegion.Child(
-		baseOffset, 0xe00, "raw", "FPT"))
+	// $FPT, the footer at 0xd80[0x8] is kept as extra data
+	regions = append(regions, fptRegion)
 
+	partitions := []*partition{}
 	for _, fptEntry := range fptEntries {
 		offset, len := fptEntry.Offset, fptEntry.Length
 		fptName := strings.TrimRight(string(fptEntry.Name[:4]), "\000")
-		// FTUP is NFTP + WCOD + LOCL
-		// TODO: make them parents / children
-		if (offset == 0 && len == 0) || fptName == "FTUP" || offset == 0xffffffff {
+		if (offset == 0 && len == 0) || offset == 0xffffffff {
 			continue
 		}
-		regions = append(regions, unknownRegion.Child(
-			baseOffset+offset, len, "raw", fptName))
+		if offset >= unknownRegion.Size || !unknownRegion.Contains(baseOffset+offset, len) {
+			diags.Warnf(detectorName, baseOffset+offset,
+				"partition %v (len=0x%08x) is outside of the ME region, skipping",
+				fptName, len)
+			continue
+		}
+		partitions = append(partitions, &partition{
+			name:   fptName,
+			offset: baseOffset + offset,
+			size:   len,
+		})
+	}
+	for _, p := range nestPartitions(partitions, &diags) {
+		regions = append(regions, p.region(unknownRegion, &diags))
 	}
 
 	sort.Sort(rom.ByOffset(regions))
-	return regions
+	return regions, diags
 }
@@ -0,0 +1,340 @@
+package me
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// ME File System as described in "Intel ME: Flash File System Explained"
+// (Sklyarov, Black Hat Europe 2017).  The partition is split in 0x2000 byte
+// pages, one in twelve holds the system area (volume header and file
+// allocation table) and the rest hold file data, one page is kept erased
+// as a spare.  Pages store 0x40 byte chunks protected by a CRC16 that also
+// covers the chunk index.
+
+const (
+	mfsPageSize          = 0x2000
+	mfsPageSignature     = 0xaa557887
+	mfsPageHeaderSize    = 0x12
+	mfsChunkSize         = 0x40
+	mfsChunkStride       = mfsChunkSize + 2
+	mfsSysChunksPerPage  = 120
+	mfsDataChunksPerPage = 122
+	mfsSysChunksOffset   = mfsPageHeaderSize + (mfsSysChunksPerPage+1)*2
+	mfsDataChunksOffset  = mfsPageHeaderSize + mfsDataChunksPerPage
+	mfsVolumeSignature   = 0x724f6201
+	mfsVolumeHeaderSize  = 14
+	mfsChunkFree         = 0xff
+	mfsIndexEnd          = 0xffff
+
+	// FAT values of files that don't exist, and of empty files
+	mfsFileAbsent = 0xffff
+	mfsFileNone   = 0x0000
+	mfsFileEmpty  = 0xfffe
+)
+
+type MfsPageHeader struct {
+	Signature  uint32
+	USN        uint32
+	NumErase   uint32
+	NextErase  uint16
+	FirstChunk uint16
+	Checksum   uint8
+	Reserved   uint8
+}
+
+type MfsVolumeHeader struct {
+	Signature  uint32
+	Version    uint32
+	TotalBytes uint32
+	NumFiles   uint16
+}
+
+var mfsCrcTable = func() [256]uint16 {
+	var table [256]uint16
+	for n := range table {
+		crc := uint16(n) << 8
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		table[n] = crc
+	}
+	return table
+}()
+
+func mfsCrc(crc uint16, data ...byte) uint16 {
+	for _, b := range data {
+		crc = crc<<8 ^ mfsCrcTable[byte(crc>>8)^b]
+	}
+	return crc
+}
+
+// mfsChunkCrc is the CRC16 of a chunk followed by its little-endian index
+func mfsChunkCrc(data []byte, index int) uint16 {
+	return mfsCrc(mfsCrc(0x3fff, data...), byte(index), byte(index>>8))
+}
+
+// mfsSlot is where a chunk is stored in the partition
+type mfsSlot struct {
+	offset int
+	// data chunks: offset of the aFree byte of the slot
+	free int
+	usn  uint32
+}
+
+// MFS is a parsed ME file system.  Files are indexed by file number, nil
+// files do not exist.
+type MFS struct {
+	Volume MfsVolumeHeader
+	Files  [][]byte
+
+	raw         []byte
+	numSysPages int
+	sysChunks   int
+	dataChunks  int
+	sysSlots    map[int]mfsSlot
+	dataSlots   map[int]mfsSlot
+}
+
+func (m *MFS) sysArea() ([]byte, error) {
+	area := []byte{}
+	for n := 0; n < m.sysChunks; n++ {
+		slot, ok := m.sysSlots[n]
+		if !ok {
+			break
+		}
+		area = append(area, m.raw[slot.offset:slot.offset+mfsChunkSize]...)
+	}
+	if len(area) < mfsVolumeHeaderSize {
+		return nil, fmt.Errorf("me: MFS system area is missing")
+	}
+	return area, nil
+}
+
+func ParseMFS(raw []byte) (*MFS, error) {
+	numPages := len(raw) / mfsPageSize
+	m := &MFS{
+		raw:         raw,
+		numSysPages: numPages / 12,
+		sysSlots:    map[int]mfsSlot{},
+		dataSlots:   map[int]mfsSlot{},
+	}
+	if m.numSysPages == 0 {
+		return nil, fmt.Errorf("me: MFS partition is too small: 0x%x", len(raw))
+	}
+	m.sysChunks = m.numSysPages * mfsSysChunksPerPage
+	m.dataChunks = (numPages - m.numSysPages - 1) * mfsDataChunksPerPage
+
+	for page := 0; page < numPages; page++ {
+		base := page * mfsPageSize
+		var h MfsPageHeader
+		binary.Read(bytes.NewReader(raw[base:]), binary.LittleEndian, &h)
+		if h.Signature != mfsPageSignature {
+			continue
+		}
+		if h.FirstChunk == 0 {
+			m.readSysPage(base, h)
+		} else {
+			m.readDataPage(base, h)
+		}
+	}
+
+	area, err := m.sysArea()
+	if err != nil {
+		return nil, err
+	}
+	binary.Read(bytes.NewReader(area), binary.LittleEndian, &m.Volume)
+	if m.Volume.Signature != mfsVolumeSignature {
+		return nil, fmt.Errorf("me: invalid MFS volume signature 0x%08x", m.Volume.Signature)
+	}
+	numFiles := int(m.Volume.NumFiles)
+	if numFiles <= mfsChunkSize {
+		// FAT links must be told apart from last chunk sizes
+		return nil, fmt.Errorf("me: MFS volume has too few files: %v", numFiles)
+	}
+	fatSize := (numFiles + m.dataChunks) * 2
+	if mfsVolumeHeaderSize+fatSize > len(area) {
+		return nil, fmt.Errorf("me: MFS allocation table for %v files is truncated", numFiles)
+	}
+	fat := make([]uint16, numFiles+m.dataChunks)
+	binary.Read(bytes.NewReader(area[mfsVolumeHeaderSize:]), binary.LittleEndian, fat)
+
+	m.Files = make([][]byte, numFiles)
+	for file := range m.Files {
+		data, err := m.readFile(fat, file)
+		if err != nil {
+			return nil, err
+		}
+		m.Files[file] = data
+	}
+	return m, nil
+}
+
+// readSysPage finds the index of every system chunk by its CRC, newer
+// pages replace the chunks of older ones.
+func (m *MFS) readSysPage(base int, h MfsPageHeader) {
+	for n := 0; n < mfsSysChunksPerPage; n++ {
+		index := binary.LittleEndian.Uint16(m.raw[base+mfsPageHeaderSize+n*2:])
+		if index == mfsIndexEnd {
+			break
+		}
+		offset := base + mfsSysChunksOffset + n*mfsChunkStride
+		data := m.raw[offset : offset+mfsChunkSize]
+		crc := binary.LittleEndian.Uint16(m.raw[offset+mfsChunkSize:])
+		dataCrc := mfsCrc(0x3fff, data...)
+		for chunk := 0; chunk < m.sysChunks; chunk++ {
+			if mfsCrc(dataCrc, byte(chunk), byte(chunk>>8)) != crc {
+				continue
+			}
+			if old, ok := m.sysSlots[chunk]; !ok || old.usn <= h.USN {
+				m.sysSlots[chunk] = mfsSlot{offset: offset, usn: h.USN}
+			}
+			break
+		}
+	}
+}
+
+func (m *MFS) readDataPage(base int, h MfsPageHeader) {
+	for n := 0; n < mfsDataChunksPerPage; n++ {
+		chunk := int(h.FirstChunk) + n - m.sysChunks
+		if chunk < 0 || chunk >= m.dataChunks {
+			continue
+		}
+		m.dataSlots[chunk] = mfsSlot{
+			offset: base + mfsDataChunksOffset + n*mfsChunkStride,
+			free:   base + mfsPageHeaderSize + n,
+			usn:    h.USN,
+		}
+	}
+}
+
+func (m *MFS) dataChunk(chunk int) ([]byte, error) {
+	slot, ok := m.dataSlots[chunk]
+	if !ok || m.raw[slot.free] == mfsChunkFree {
+		return nil, fmt.Errorf("me: MFS data chunk %v is not allocated", chunk)
+	}
+	data := m.raw[slot.offset : slot.offset+mfsChunkSize]
+	crc := binary.LittleEndian.Uint16(m.raw[slot.offset+mfsChunkSize:])
+	if mfsChunkCrc(data, chunk+m.sysChunks) != crc {
+		return nil, fmt.Errorf("me: MFS data chunk %v has an invalid CRC", chunk)
+	}
+	return data, nil
+}
+
+// readFile follows the FAT chain of a file: values of at least NumFiles
+// point to the next data chunk, the last value is the number of bytes used
+// in the last chunk.
+func (m *MFS) readFile(fat []uint16, file int) ([]byte, error) {
+	numFiles := len(m.Files)
+	next := fat[file]
+	switch next {
+	case mfsFileAbsent, mfsFileNone:
+		return nil, nil
+	case mfsFileEmpty:
+		return []byte{}, nil
+	}
+	data := []byte{}
+	for steps := 0; ; steps++ {
+		chunk := int(next) - numFiles
+		if chunk < 0 || chunk >= m.dataChunks || steps > m.dataChunks {
+			return nil, fmt.Errorf("me: MFS file %v has a broken chain at 0x%04x", file, next)
+		}
+		chunkData, err := m.dataChunk(chunk)
+		if err != nil {
+			return nil, fmt.Errorf("me: MFS file %v: %v", file, err)
+		}
+		next = fat[numFiles+chunk]
+		if int(next) <= mfsChunkSize {
+			return append(data, chunkData[:next]...), nil
+		}
+		data = append(data, chunkData...)
+	}
+}
+
+// Encode writes files back into the partition.  Pages keep their place and
+// headers, the allocation table and all file data are rewritten with files
+// stored in consecutive data chunks.
+func (m *MFS) Encode(files [][]byte) ([]byte, error) {
+	numFiles := int(m.Volume.NumFiles)
+	if len(files) != numFiles {
+		return nil, fmt.Errorf("me: MFS volume has %v files, got %v", numFiles, len(files))
+	}
+	raw := append([]byte{}, m.raw...)
+	fat := make([]uint16, numFiles+m.dataChunks)
+	for n := range fat {
+		fat[n] = mfsFileAbsent
+	}
+
+	dataChunks := []int{}
+	for chunk := range m.dataSlots {
+		dataChunks = append(dataChunks, chunk)
+	}
+	sort.Ints(dataChunks)
+	used := map[int]bool{}
+	next := 0
+	for file, data := range files {
+		switch {
+		case data == nil:
+			continue
+		case len(data) == 0:
+			fat[file] = mfsFileEmpty
+			continue
+		}
+		chunks := []int{}
+		for off := 0; off < len(data); off += mfsChunkSize {
+			if next >= len(dataChunks) {
+				return nil, fmt.Errorf("me: MFS files don't fit in %v data chunks", len(dataChunks))
+			}
+			chunk := dataChunks[next]
+			next++
+			chunks = append(chunks, chunk)
+			used[chunk] = true
+
+			chunkData := make([]byte, mfsChunkSize)
+			copy(chunkData, data[off:])
+			slot := m.dataSlots[chunk]
+			copy(raw[slot.offset:], chunkData)
+			binary.LittleEndian.PutUint16(raw[slot.offset+mfsChunkSize:],
+				mfsChunkCrc(chunkData, chunk+m.sysChunks))
+			raw[slot.free] = 0
+		}
+		fat[file] = uint16(numFiles + chunks[0])
+		for n, chunk := range chunks {
+			if n+1 < len(chunks) {
+				fat[numFiles+chunk] = uint16(numFiles + chunks[n+1])
+			} else {
+				fat[numFiles+chunk] = uint16(len(data) - n*mfsChunkSize)
+			}
+		}
+	}
+	for _, chunk := range dataChunks {
+		if slot := m.dataSlots[chunk]; !used[chunk] {
+			raw[slot.free] = mfsChunkFree
+			for n := slot.offset; n < slot.offset+mfsChunkStride; n++ {
+				raw[n] = mfsChunkFree
+			}
+		}
+	}
+
+	var area bytes.Buffer
+	binary.Write(&area, binary.LittleEndian, m.Volume)
+	binary.Write(&area, binary.LittleEndian, fat)
+	areaBytes := area.Bytes()
+	for chunk := 0; chunk*mfsChunkSize < len(areaBytes); chunk++ {
+		slot, ok := m.sysSlots[chunk]
+		if !ok {
+			return nil, fmt.Errorf("me: MFS system chunk %v has no slot", chunk)
+		}
+		chunkData := make([]byte, mfsChunkSize)
+		copy(chunkData, areaBytes[chunk*mfsChunkSize:])
+		copy(raw[slot.offset:], chunkData)
+		binary.LittleEndian.PutUint16(raw[slot.offset+mfsChunkSize:], mfsChunkCrc(chunkData, chunk))
+	}
+	return raw, nil
+}
@@ -0,0 +1,96 @@
+package me
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"path"
+)
+
+// CfgRecord is an entry of the intel.cfg/fitc.cfg archives stored in MFS
+// files on CSE 11+ ("MFS over FIT").  Directory records are followed by
+// their contents and closed by a ".." record, Offset is relative to the
+// start of the archive.
+type CfgRecord struct {
+	Name     [12]byte
+	Reserved uint16
+	Mode     uint16
+	Options  uint16
+	Size     uint16
+	Uid      uint16
+	Gid      uint16
+	Offset   uint32
+}
+
+const (
+	cfgModeDirectory = 0x1000
+	cfgRecordSize    = 0x1c
+	maxCfgRecords    = 0x1000
+)
+
+func (r CfgRecord) RecordName() string {
+	name := r.Name[:]
+	if n := bytes.IndexByte(name, 0); n >= 0 {
+		name = name[:n]
+	}
+	return string(name)
+}
+
+// CfgFile is a file or directory of a cfg archive with its full path.
+type CfgFile struct {
+	Path   string
+	Record CfgRecord
+	Data   []byte
+}
+
+func (f CfgFile) Directory() bool {
+	return f.Record.Mode&cfgModeDirectory != 0
+}
+
+// MFS file numbers of the CSE 11+ cfg archives
+var (
+	CfgFileNames = map[int]string{
+		6: "intel.cfg",
+		7: "fitc.cfg",
+	}
+)
+
+func ParseCfg(data []byte) ([]CfgFile, error) {
+	bs := bytes.NewReader(data)
+	var count uint32
+	if err := binary.Read(bs, binary.LittleEndian, &count); err != nil {
+		return nil, err
+	}
+	if count > maxCfgRecords || 4+uint64(count)*cfgRecordSize > uint64(len(data)) {
+		return nil, fmt.Errorf("me: invalid cfg archive with %v records", count)
+	}
+	records := make([]CfgRecord, count)
+	if err := binary.Read(bs, binary.LittleEndian, records); err != nil {
+		return nil, err
+	}
+
+	files := []CfgFile{}
+	dir := "/"
+	for _, record := range records {
+		name := record.RecordName()
+		if name == ".." {
+			dir = path.Dir(dir)
+			continue
+		}
+		if name == "" || name == "." || bytes.ContainsAny([]byte(name), "/\\") {
+			return nil, fmt.Errorf("me: invalid cfg record name '%v'", name)
+		}
+		file := CfgFile{Path: path.Join(dir, name), Record: record}
+		if file.Directory() {
+			dir = file.Path
+		} else {
+			end := uint64(record.Offset) + uint64(record.Size)
+			if end > uint64(len(data)) {
+				return nil, fmt.Errorf("me: cfg file %v is outside of the archive", file.Path)
+			}
+			file.Data = data[record.Offset:end]
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
@@ -0,0 +1,116 @@
+package me
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/flammit/fwtools/pkg/rom"
+)
+
+func init() {
+	rom.RegisterHandler("mfs", MfsHandler{})
+}
+
+// MfsHandler stores an MFS partition as raw data and extracts its files
+// next to it into Name + ".files": one file_NNN per MFS file, plus a
+// read-only view of the cfg archives.  On build, changed file_NNN files are
+// written back into the partition.  MFS files are chains of chunks with
+// their own CRCs rather than byte ranges of the partition, so they can't
+// be child regions.
+type MfsHandler struct{}
+
+func mfsFilesPath(r *rom.Region, layoutPath string) string {
+	return filepath.Join(layoutPath, r.Name+".files")
+}
+
+func mfsFileName(file int) string {
+	return fmt.Sprintf("file_%03d", file)
+}
+
+func (MfsHandler) Save(r *rom.Region, layoutPath string) error {
+	if err := (rom.RawHandler{}).Save(r, layoutPath); err != nil {
+		return err
+	}
+	m, err := ParseMFS(r.Raw)
+	if err != nil {
+		return err
+	}
+	filesPath := mfsFilesPath(r, layoutPath)
+	os.MkdirAll(filesPath, os.ModePerm)
+	for file, data := range m.Files {
+		if data == nil {
+			continue
+		}
+		path := filepath.Join(filesPath, mfsFileName(file))
+		if err := ioutil.WriteFile(path, data, os.ModePerm); err != nil {
+			return fmt.Errorf("mfs: failed to write file '%v': err=%v", path, err)
+		}
+
+		name, ok := CfgFileNames[file]
+		if !ok {
+			continue
+		}
+		cfgFiles, err := ParseCfg(data)
+		if err != nil {
+			r.Diagnostics.Warnf(detectorName, r.Offset, "failed to parse %v: err=%v", name, err)
+			continue
+		}
+		for _, cfgFile := range cfgFiles {
+			path := filepath.Join(filesPath, name, filepath.FromSlash(cfgFile.Path))
+			if cfgFile.Directory() {
+				os.MkdirAll(path, os.ModePerm)
+				continue
+			}
+			os.MkdirAll(filepath.Dir(path), os.ModePerm)
+			if err := ioutil.WriteFile(path, cfgFile.Data, os.ModePerm); err != nil {
+				return fmt.Errorf("mfs: failed to write file '%v': err=%v", path, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (MfsHandler) Load(r *rom.Region, layoutPath string) error {
+	if err := (rom.RawHandler{}).Load(r, layoutPath); err != nil {
+		return err
+	}
+	filesPath := mfsFilesPath(r, layoutPath)
+	if _, err := os.Stat(filesPath); err != nil {
+		// no extracted files, keep the raw partition
+		return nil
+	}
+	m, err := ParseMFS(r.Raw)
+	if err != nil {
+		return err
+	}
+
+	files := make([][]byte, len(m.Files))
+	changed := false
+	for file := range files {
+		data, err := ioutil.ReadFile(filepath.Join(filesPath, mfsFileName(file)))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err == nil {
+			files[file] = data
+		}
+		if (files[file] == nil) != (m.Files[file] == nil) || !bytes.Equal(files[file], m.Files[file]) {
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	log.Printf("mfs: %v: files changed, rewriting the file system", r.Name)
+	raw, err := m.Encode(files)
+	if err != nil {
+		return fmt.Errorf("mfs: %v: %v", r.Name, err)
+	}
+	r.Raw = raw
+	return nil
+}
@@ -0,0 +1,97 @@
+package me
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+const testMfsFiles = 256
+
+// testMfs formats a 12 page MFS partition: a system page holding the
+// volume header and an allocation table without files, ten empty data
+// pages and the spare page.
+func testMfs() []byte {
+	raw := bytes.Repeat([]byte{0xff}, 12*mfsPageSize)
+	writePageHeader := func(page int, firstChunk uint16) {
+		var h bytes.Buffer
+		binary.Write(&h, binary.LittleEndian, MfsPageHeader{
+			Signature:  mfsPageSignature,
+			USN:        uint32(page + 1),
+			NextErase:  0xffff,
+			FirstChunk: firstChunk,
+		})
+		copy(raw[page*mfsPageSize:], h.Bytes())
+	}
+
+	writePageHeader(0, 0)
+	sysChunks := mfsSysChunksPerPage
+	dataChunks := 10 * mfsDataChunksPerPage
+	var area bytes.Buffer
+	binary.Write(&area, binary.LittleEndian, MfsVolumeHeader{
+		Signature:  mfsVolumeSignature,
+		Version:    1,
+		TotalBytes: uint32(len(raw)),
+		NumFiles:   testMfsFiles,
+	})
+	fat := make([]uint16, testMfsFiles+dataChunks)
+	for n := range fat {
+		fat[n] = mfsFileAbsent
+	}
+	binary.Write(&area, binary.LittleEndian, fat)
+	for chunk := 0; chunk*mfsChunkSize < area.Len(); chunk++ {
+		data := make([]byte, mfsChunkSize)
+		copy(data, area.Bytes()[chunk*mfsChunkSize:])
+		binary.LittleEndian.PutUint16(raw[mfsPageHeaderSize+chunk*2:], uint16(chunk))
+		offset := mfsSysChunksOffset + chunk*mfsChunkStride
+		copy(raw[offset:], data)
+		binary.LittleEndian.PutUint16(raw[offset+mfsChunkSize:], mfsChunkCrc(data, chunk))
+	}
+
+	for page := 1; page <= 10; page++ {
+		writePageHeader(page, uint16(sysChunks+(page-1)*mfsDataChunksPerPage))
+	}
+	return raw
+}
+
+func TestMfsRoundTrip(t *testing.T) {
+	m, err := ParseMFS(testMfs())
+	if err != nil {
+		t.Fatalf("ParseMFS() err=%v", err)
+	}
+	if len(m.Files) != testMfsFiles {
+		t.Fatalf("ParseMFS() found %v files, want %v", len(m.Files), testMfsFiles)
+	}
+
+	files := make([][]byte, testMfsFiles)
+	files[6] = bytes.Repeat([]byte("intel.cfg "), 30)
+	files[7] = []byte{}
+	files[8] = bytes.Repeat([]byte{0x5a}, mfsChunkSize)
+	encoded, err := m.Encode(files)
+	if err != nil {
+		t.Fatalf("Encode() err=%v", err)
+	}
+
+	m, err = ParseMFS(encoded)
+	if err != nil {
+		t.Fatalf("ParseMFS(Encode()) err=%v", err)
+	}
+	for file := range files {
+		if (m.Files[file] == nil) != (files[file] == nil) || !bytes.Equal(m.Files[file], files[file]) {
+			t.Errorf("file %v = %x, want %x", file, m.Files[file], files[file])
+		}
+	}
+	again, err := m.Encode(m.Files)
+	if err != nil {
+		t.Fatalf("Encode() err=%v", err)
+	}
+	if !bytes.Equal(again, encoded) {
+		t.Errorf("Encode(ParseMFS()) differs from the partition")
+	}
+
+	// a file that doesn't fit
+	files[9] = make([]byte, 10*mfsDataChunksPerPage*mfsChunkSize)
+	if _, err := m.Encode(files); err == nil {
+		t.Errorf("Encode() of files larger than the partition succeeded")
+	}
+}
@@ -0,0 +1,185 @@
+package me
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+
+	"github.com/flammit/fwtools/pkg/lzma"
+	"github.com/flammit/fwtools/pkg/rom"
+)
+
+// ModuleAttributes is the module attributes extension (type 0x0a) of a
+// CSE 11+ .met file, it tells how the module of the same name is stored.
+type ModuleAttributes struct {
+	Type             uint32
+	Length           uint32
+	Compression      uint8
+	Encryption       uint8
+	Reserved         [2]uint8
+	UncompressedSize uint32
+	CompressedSize   uint32
+	DeviceID         uint16
+	VendorID         uint16
+	Hash             [32]uint8
+}
+
+const (
+	moduleAttributesType = 0x0a
+	metExtensionHeader   = 8
+
+	CompressionNone    = 0
+	CompressionHuffman = 1
+	CompressionLzma    = 2
+)
+
+var (
+	CompressionNames = []string{
+		"none",
+		"huffman",
+		"lzma",
+	}
+)
+
+func compressionName(c uint8) string {
+	if int(c) < len(CompressionNames) {
+		return CompressionNames[c]
+	}
+	return fmt.Sprintf("0x%02x", c)
+}
+
+// ParseModuleAttributes finds the module attributes in the extensions of a
+// .met file.
+func ParseModuleAttributes(met []byte) (*ModuleAttributes, error) {
+	for off := 0; off+metExtensionHeader <= len(met); {
+		extType := binary.LittleEndian.Uint32(met[off:])
+		extLength := int(binary.LittleEndian.Uint32(met[off+4:]))
+		if extLength < metExtensionHeader || off+extLength > len(met) {
+			break
+		}
+		if extType == moduleAttributesType {
+			var attrs ModuleAttributes
+			if err := binary.Read(bytes.NewReader(met[off:off+extLength]), binary.LittleEndian, &attrs); err != nil {
+				return nil, fmt.Errorf("me: truncated module attributes: err=%v", err)
+			}
+			return &attrs, nil
+		}
+		off += extLength
+	}
+	return nil, fmt.Errorf("me: no module attributes in metadata")
+}
+
+// DecompressModule expands an LZMA module.  ME LZMA headers don't always
+// carry the uncompressed size, size is used when the header has none that
+// works, 0 if it isn't known.
+func DecompressModule(raw []byte, size uint32) ([]byte, error) {
+	data, err := lzma.Decompress(raw)
+	if err == nil || size == 0 || len(raw) < lzma.HeaderSize {
+		return data, err
+	}
+	patched := append([]byte{}, raw...)
+	binary.LittleEndian.PutUint64(patched[5:], uint64(size))
+	if data, patchedErr := lzma.Decompress(patched); patchedErr == nil {
+		return data, nil
+	}
+	return nil, err
+}
+
+// moduleSize is the uncompressed size recorded in the module metadata
+func moduleSize(r *rom.Region) uint32 {
+	size, _ := strconv.ParseUint(r.Metadata["size"], 0, 32)
+	return uint32(size)
+}
+
+// looksLzma is true for data starting with the LZMA header ME images use
+// (lc=3 lp=0 pb=2), for modules without attributes.
+func looksLzma(raw []byte) bool {
+	h, err := lzma.ParseHeader(raw)
+	return err == nil && h.Props == 0x5d
+}
+
+// hashMatches compares the module hash of the attributes, stored in either
+// byte order depending on the tool that wrote it, with the module data.
+func hashMatches(hash [32]uint8, data []byte) bool {
+	sum := sha256.Sum256(data)
+	reversed := [32]uint8{}
+	for n, b := range hash {
+		reversed[len(hash)-1-n] = b
+	}
+	return sum == hash || sum == reversed
+}
+
+// decompress expands a module typed by addModuleMetadata
+func decompress(r *rom.Region) ([]byte, error) {
+	if r.Metadata["compression"] == compressionName(CompressionHuffman) {
+		return DecompressHuffman(r.Raw, moduleSize(r), huffmanDictionaries)
+	}
+	return DecompressModule(r.Raw, moduleSize(r))
+}
+
+// addModuleMetadata types compressed $CPD modules.  LZMA modules, and
+// Huffman modules when the ME dictionaries are set, become "me_module"
+// regions that are extracted with a decompressed view.  huffmanSize is the
+// uncompressed size of Huffman modules from the $CPD entry, 0 for others.
+func addModuleMetadata(r *rom.Region, met []byte, huffmanSize uint32, diags *rom.Diagnostics) {
+	compression := uint8(CompressionNone)
+	var attrs *ModuleAttributes
+	if met != nil {
+		if a, err := ParseModuleAttributes(met); err == nil {
+			attrs = a
+			compression = a.Compression
+		}
+	}
+	switch {
+	case huffmanSize != 0:
+		compression = CompressionHuffman
+	case attrs == nil && looksLzma(r.Raw):
+		compression = CompressionLzma
+	}
+	if compression == CompressionNone {
+		return
+	}
+	r.Metadata = map[string]string{
+		"compression": compressionName(compression),
+	}
+
+	size := uint32(0)
+	if attrs != nil {
+		size = attrs.UncompressedSize
+	}
+	var data []byte
+	var err error
+	switch compression {
+	case CompressionHuffman:
+		if huffmanDictionaries == nil {
+			diags.Infof(detectorName, r.Offset,
+				"module %v is Huffman compressed, it can't be decompressed without the ME dictionaries",
+				r.Name)
+			return
+		}
+		if size == 0 {
+			size = huffmanSize
+		}
+		data, err = DecompressHuffman(r.Raw, size, huffmanDictionaries)
+		if err == nil && attrs != nil && !hashMatches(attrs.Hash, data) {
+			err = fmt.Errorf("me: decompressed module doesn't match the hash of its metadata")
+		}
+	case CompressionLzma:
+		data, err = DecompressModule(r.Raw, size)
+	default:
+		diags.Warnf(detectorName, r.Offset, "module %v has unknown compression %v",
+			r.Name, compressionName(compression))
+		return
+	}
+	if err != nil {
+		diags.Warnf(detectorName, r.Offset, "failed to decompress module %v: err=%v", r.Name, err)
+		return
+	}
+	sum := sha256.Sum256(data)
+	r.Type = "me_module"
+	r.Metadata["size"] = fmt.Sprintf("0x%x", len(data))
+	r.Metadata["sha256"] = hex.EncodeToString(sum[:])
+}
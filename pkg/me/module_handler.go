@@ -0,0 +1,59 @@
+package me
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/flammit/fwtools/pkg/rom"
+)
+
+func init() {
+	rom.RegisterHandler("me_module", ModuleHandler{})
+}
+
+// ModuleHandler stores a compressed ME module (LZMA or Huffman) as raw
+// data with its decompressed code next to it in Name + ".decompressed".  The view is
+// only for analysis, builds always use the raw file: replace the raw file
+// to change the module.
+type ModuleHandler struct{}
+
+func modulePath(r *rom.Region, layoutPath string) string {
+	return filepath.Join(layoutPath, r.Name+".decompressed")
+}
+
+func (ModuleHandler) Save(r *rom.Region, layoutPath string) error {
+	if err := (rom.RawHandler{}).Save(r, layoutPath); err != nil {
+		return err
+	}
+	data, err := decompress(r)
+	if err != nil {
+		return fmt.Errorf("me: failed to decompress module %v: err=%v", r.Name, err)
+	}
+	path := modulePath(r, layoutPath)
+	if err := ioutil.WriteFile(path, data, os.ModePerm); err != nil {
+		return fmt.Errorf("me: failed to write module file '%v': err=%v", path, err)
+	}
+	return nil
+}
+
+func (ModuleHandler) Load(r *rom.Region, layoutPath string) error {
+	if err := (rom.RawHandler{}).Load(r, layoutPath); err != nil {
+		return err
+	}
+	view, err := ioutil.ReadFile(modulePath(r, layoutPath))
+	if err != nil {
+		return nil
+	}
+	data, err := decompress(r)
+	if err != nil {
+		log.Printf("me: %v: can't check the decompressed view: err=%v", r.Name, err)
+	} else if !bytes.Equal(data, view) {
+		log.Printf("me: %v: decompressed view doesn't match the module and is ignored, "+
+			"replace %v.raw to change the module", r.Name, filepath.Base(r.Name))
+	}
+	return nil
+}
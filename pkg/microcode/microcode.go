@@ -0,0 +1,234 @@
+package microcode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// Intel microcode updates as described in the SDM Vol. 3A 9.11.  An update
+// is a 48 byte header, the encrypted data and an optional extended
+// signature table listing more processors the update applies to.
+
+type Header struct {
+	HeaderVersion      uint32
+	UpdateRevision     uint32
+	Date               uint32 // BCD: month << 24 | day << 16 | year
+	ProcessorSignature uint32
+	Checksum           uint32
+	LoaderRevision     uint32
+	ProcessorFlags     uint32
+	DataSize           uint32
+	TotalSize          uint32
+	Reserved           [12]uint8
+}
+
+type ExtendedTableHeader struct {
+	Count    uint32
+	Checksum uint32
+	Reserved [12]uint8
+}
+
+type ExtendedSignature struct {
+	ProcessorSignature uint32
+	ProcessorFlags     uint32
+	Checksum           uint32
+}
+
+const (
+	HeaderSize            = 48
+	extendedHeaderSize    = 20
+	extendedSignatureSize = 12
+	headerVersion         = 1
+	loaderRevision        = 1
+	defaultDataSize       = 2000
+	// updates are stored 16 byte aligned
+	Align = 0x10
+	// refuse to parse updates larger than this
+	maxTotalSize = 0x100000
+)
+
+// Size returns the data and total size, 0 in the header means the sizes
+// of the first updates (2000 bytes of data).
+func (h Header) Size() (dataSize, totalSize uint32) {
+	if h.DataSize == 0 {
+		return defaultDataSize, defaultDataSize + HeaderSize
+	}
+	return h.DataSize, h.TotalSize
+}
+
+func (h Header) Valid() bool {
+	dataSize, totalSize := h.Size()
+	return h.HeaderVersion == headerVersion && h.LoaderRevision == loaderRevision &&
+		dataSize%4 == 0 && totalSize%1024 == 0 &&
+		totalSize >= dataSize+HeaderSize && totalSize <= maxTotalSize
+}
+
+func (h Header) DateString() string {
+	return fmt.Sprintf("%04x-%02x-%02x", h.Date&0xffff, h.Date>>24, (h.Date>>16)&0xff)
+}
+
+// Signature is a CPUID(1).EAX processor signature
+type Signature uint32
+
+func (s Signature) Stepping() uint32 {
+	return uint32(s) & 0xf
+}
+
+// Family includes the extended family
+func (s Signature) Family() uint32 {
+	family := (uint32(s) >> 8) & 0xf
+	if family == 0xf {
+		family += (uint32(s) >> 20) & 0xff
+	}
+	return family
+}
+
+// Model includes the extended model
+func (s Signature) Model() uint32 {
+	model := (uint32(s) >> 4) & 0xf
+	if family := (uint32(s) >> 8) & 0xf; family == 0x6 || family == 0xf {
+		model |= ((uint32(s) >> 16) & 0xf) << 4
+	}
+	return model
+}
+
+// String uses the family-model-stepping form of Linux microcode file names
+func (s Signature) String() string {
+	return fmt.Sprintf("%02x-%02x-%02x", s.Family(), s.Model(), s.Stepping())
+}
+
+// Platforms lists the platform IDs (bits of ProcessorFlags) an update
+// applies to.
+func Platforms(flags uint32) string {
+	ids := []string{}
+	for n := uint(0); n < 8; n++ {
+		if flags&(1<<n) != 0 {
+			ids = append(ids, fmt.Sprintf("%d", n))
+		}
+	}
+	return strings.Join(ids, ",")
+}
+
+// Processor is a signature and platform flags pair an update applies to
+type Processor struct {
+	Signature Signature
+	Flags     uint32
+}
+
+func (p Processor) String() string {
+	return fmt.Sprintf("%v (0x%08x) platforms %v (0x%02x)",
+		p.Signature, uint32(p.Signature), Platforms(p.Flags), p.Flags)
+}
+
+// Update is a parsed microcode update.  ChecksumValid covers the whole
+// update, ExtendedChecksumValid the extended signature table.
+type Update struct {
+	Header                Header
+	Extended              []ExtendedSignature
+	ChecksumValid         bool
+	ExtendedChecksumValid bool
+	Raw                   []byte
+}
+
+func sum32(raw []byte) uint32 {
+	sum := uint32(0)
+	for n := 0; n+4 <= len(raw); n += 4 {
+		sum += binary.LittleEndian.Uint32(raw[n:])
+	}
+	return sum
+}
+
+// Parse decodes the update at the start of raw.  Updates with a bad
+// checksum are returned with ChecksumValid unset, malformed headers are
+// an error.
+func Parse(raw []byte) (*Update, error) {
+	var h Header
+	if err := binary.Read(bytes.NewReader(raw), binary.LittleEndian, &h); err != nil {
+		return nil, fmt.Errorf("microcode: truncated header: err=%v", err)
+	}
+	if !h.Valid() {
+		return nil, fmt.Errorf("microcode: invalid header")
+	}
+	dataSize, totalSize := h.Size()
+	if totalSize > uint32(len(raw)) {
+		return nil, fmt.Errorf("microcode: update of 0x%x bytes doesn't fit in 0x%x bytes",
+			totalSize, len(raw))
+	}
+	u := &Update{
+		Header:                h,
+		Extended:              []ExtendedSignature{},
+		ChecksumValid:         sum32(raw[:totalSize]) == 0,
+		ExtendedChecksumValid: true,
+		Raw:                   raw[:totalSize],
+	}
+
+	extOffset := HeaderSize + dataSize
+	if totalSize < extOffset+extendedHeaderSize {
+		return u, nil
+	}
+	var ext ExtendedTableHeader
+	binary.Read(bytes.NewReader(raw[extOffset:]), binary.LittleEndian, &ext)
+	extSize := extendedHeaderSize + uint64(ext.Count)*extendedSignatureSize
+	if uint64(extOffset)+extSize > uint64(totalSize) {
+		return nil, fmt.Errorf("microcode: %v extended signatures don't fit in the update", ext.Count)
+	}
+	u.Extended = make([]ExtendedSignature, ext.Count)
+	binary.Read(bytes.NewReader(raw[extOffset+extendedHeaderSize:]), binary.LittleEndian, u.Extended)
+	u.ExtendedChecksumValid = sum32(raw[extOffset:uint64(extOffset)+extSize]) == 0
+	return u, nil
+}
+
+// Processors lists the main and extended signatures of the update
+func (u Update) Processors() []Processor {
+	processors := []Processor{{
+		Signature: Signature(u.Header.ProcessorSignature),
+		Flags:     u.Header.ProcessorFlags,
+	}}
+	for _, ext := range u.Extended {
+		processors = append(processors, Processor{
+			Signature: Signature(ext.ProcessorSignature),
+			Flags:     ext.ProcessorFlags,
+		})
+	}
+	return processors
+}
+
+func (u Update) Metadata() map[string]string {
+	signatures := []string{}
+	for _, p := range u.Processors() {
+		signatures = append(signatures, fmt.Sprintf("0x%08x", uint32(p.Signature)))
+	}
+	return map[string]string{
+		"signature":      strings.Join(signatures, " "),
+		"revision":       fmt.Sprintf("0x%08x", u.Header.UpdateRevision),
+		"date":           u.Header.DateString(),
+		"platforms":      fmt.Sprintf("0x%02x", u.Header.ProcessorFlags),
+		"size":           fmt.Sprintf("0x%x", len(u.Raw)),
+		"checksum_valid": fmt.Sprintf("%v", u.ChecksumValid && u.ExtendedChecksumValid),
+	}
+}
+
+// Located is an update found at Offset of a larger blob
+type Located struct {
+	*Update
+	Offset uint32
+}
+
+// ParseAll decodes the updates stored one after another at the start of
+// raw, as in microcode blobs and firmware volumes.  Parsing stops at the
+// first aligned position without an update header.
+func ParseAll(raw []byte) []Located {
+	updates := []Located{}
+	for offset := uint32(0); uint64(offset)+HeaderSize <= uint64(len(raw)); {
+		u, err := Parse(raw[offset:])
+		if err != nil {
+			break
+		}
+		updates = append(updates, Located{Update: u, Offset: offset})
+		offset += uint32(len(u.Raw))
+		offset = (offset + Align - 1) &^ (Align - 1)
+	}
+	return updates
+}
@@ -0,0 +1,72 @@
+package rom
+
+// AddressMap converts between flash offsets and the host physical addresses
+// the flash is decoded at.  x86 chipsets map the BIOS region so that it
+// ends at 4GiB and decode at most its top 16MiB.
+type AddressMap struct {
+	// flash offset and size of the BIOS region
+	Offset uint32
+	Size   uint32
+}
+
+const (
+	addressTop = uint64(1) << 32
+	// MaxDecodeSize is the part of the BIOS region decoded below 4GiB
+	MaxDecodeSize = 16 << 20
+)
+
+// window returns the flash offset and size of the decoded part of the BIOS
+// region
+func (m AddressMap) window() (uint32, uint32) {
+	size := m.Size
+	if size > MaxDecodeSize {
+		size = MaxDecodeSize
+	}
+	return m.Offset + m.Size - size, size
+}
+
+// HostAddress returns the host address of a flash offset, false when the
+// offset isn't decoded.
+func (m AddressMap) HostAddress(offset uint32) (uint64, bool) {
+	start, size := m.window()
+	if offset < start || offset-start >= size {
+		return 0, false
+	}
+	return addressTop - uint64(size) + uint64(offset-start), true
+}
+
+// FlashOffset returns the flash offset of size bytes at a host address,
+// false when they aren't all decoded from the flash.
+func (m AddressMap) FlashOffset(address uint64, size uint32) (uint32, bool) {
+	start, window := m.window()
+	base := addressTop - uint64(window)
+	if address < base || address >= addressTop || address+uint64(size) > addressTop {
+		return 0, false
+	}
+	return start + uint32(address-base), true
+}
+
+// Root returns the region of the whole image
+func (r *Region) Root() *Region {
+	cur := r
+	for ; cur.Parent != nil; cur = cur.Parent {
+	}
+	return cur
+}
+
+// SetAddressMap sets the address map of the whole image.  It is stored on
+// the root region, so every region of the image, including ones created
+// before the call, reads it through Root().
+func (r *Region) SetAddressMap(m AddressMap) {
+	r.Root().addressMap = &m
+}
+
+// AddressMap returns the address map of the image, by default the whole
+// image is the BIOS region, as in BIOS region dumps.
+func (r *Region) AddressMap() AddressMap {
+	root := r.Root()
+	if root.addressMap != nil {
+		return *root.addressMap
+	}
+	return AddressMap{Offset: 0, Size: root.Size}
+}
@@ -0,0 +1,83 @@
+package rom
+
+import "fmt"
+
+// Chunk is a run of non-empty bytes within a region that is not described
+// by any typed structure.  Typed configs keep them so that encoding the
+// config reproduces the region byte for byte.
+type Chunk struct {
+	Offset Hex32
+	Data   HexBytes
+}
+
+// chunkMergeGap is the largest run of empty bytes kept inside a chunk
+// instead of starting a new one.
+const chunkMergeGap = 16
+
+// Coverage marks the bytes of a region that are described by typed
+// structures.
+type Coverage []bool
+
+func NewCoverage(size uint32) Coverage {
+	return make(Coverage, size)
+}
+
+func (c Coverage) Cover(offset, size uint32) {
+	for n := uint64(offset); n < uint64(offset)+uint64(size) && n < uint64(len(c)); n++ {
+		c[n] = true
+	}
+}
+
+// Chunks returns the non-empty bytes of raw that are not covered.
+func (c Coverage) Chunks(raw []byte) []Chunk {
+	chunks := []Chunk{}
+	start, end := -1, -1
+	flush := func() {
+		if start >= 0 {
+			chunks = append(chunks, Chunk{
+				Offset: Hex32(start),
+				Data:   HexBytes(append([]byte{}, raw[start:end]...)),
+			})
+		}
+		start, end = -1, -1
+	}
+	for n, b := range raw {
+		if n < len(c) && c[n] {
+			flush()
+			continue
+		}
+		if b == emptyByte {
+			if start >= 0 && n-end >= chunkMergeGap {
+				flush()
+			}
+			continue
+		}
+		if start < 0 {
+			start = n
+		}
+		end = n + 1
+	}
+	flush()
+	return chunks
+}
+
+// ApplyChunks writes chunks back into bs.
+func ApplyChunks(bs []byte, chunks []Chunk) error {
+	for _, chunk := range chunks {
+		if uint64(chunk.Offset)+uint64(len(chunk.Data)) > uint64(len(bs)) {
+			return fmt.Errorf("chunk: 0x%08x+0x%x is outside of region size 0x%x",
+				uint32(chunk.Offset), len(chunk.Data), len(bs))
+		}
+		copy(bs[chunk.Offset:], chunk.Data)
+	}
+	return nil
+}
+
+// EmptyBytes returns size bytes of erased flash.
+func EmptyBytes(size uint32) []byte {
+	bs := make([]byte, size)
+	for n := range bs {
+		bs[n] = emptyByte
+	}
+	return bs
+}
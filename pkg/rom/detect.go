@@ -4,14 +4,19 @@ import (
 	"sort"
 )
 
-type Detector func(*Region) []*Region
+// Detector returns the sub-regions it recognizes in an unknown region along
+// with any diagnostics produced while parsing it.  A detector that does not
+// recognize the region returns no regions.
+type Detector func(*Region) ([]*Region, Diagnostics)
 
 func DetectRegions(detectors []Detector, unknownRegion *Region) *Region {
 	if unknownRegion.Type == "unknown" {
 		// log.Printf("Detect: %08x - %08x", unknownRegion.Offset, unknownRegion.Offset+unknownRegion.Size)
 		regions := []*Region{}
 		for _, detector := range detectors {
-			regions = detector(unknownRegion)
+			var diags Diagnostics
+			regions, diags = detector(unknownRegion)
+			unknownRegion.Diagnostics = append(unknownRegion.Diagnostics, diags...)
 			if len(regions) > 0 {
 				break
 			}
@@ -48,6 +53,11 @@ func DetectRegions(detectors []Detector, unknownRegion *Region) *Region {
 		}
 
 		if len(newRegions) == 1 {
+			// keep the diagnostics of the replaced region
+			if newRegions[0] != unknownRegion {
+				newRegions[0].Diagnostics = append(unknownRegion.Diagnostics,
+					newRegions[0].Diagnostics...)
+			}
 			return newRegions[0]
 		}
 		unknownRegion.Type = "container"
@@ -0,0 +1,48 @@
+package rom
+
+import "fmt"
+
+type Severity string
+
+const (
+	SeverityInfo    = Severity("info")
+	SeverityWarning = Severity("warning")
+	SeverityError   = Severity("error")
+)
+
+// Diagnostic records why a detector skipped, truncated or abandoned the
+// parse of a region, so it can be reported in summary.json and the CLI.
+type Diagnostic struct {
+	Severity Severity
+	Detector string
+	Offset   uint32
+	Message  string
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%v: %v @ 0x%08x: %v", d.Severity, d.Detector, d.Offset, d.Message)
+}
+
+type Diagnostics []Diagnostic
+
+func (d *Diagnostics) add(severity Severity, detector string, offset uint32,
+	format string, args ...interface{}) {
+	*d = append(*d, Diagnostic{
+		Severity: severity,
+		Detector: detector,
+		Offset:   offset,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+func (d *Diagnostics) Infof(detector string, offset uint32, format string, args ...interface{}) {
+	d.add(SeverityInfo, detector, offset, format, args...)
+}
+
+func (d *Diagnostics) Warnf(detector string, offset uint32, format string, args ...interface{}) {
+	d.add(SeverityWarning, detector, offset, format, args...)
+}
+
+func (d *Diagnostics) Errorf(detector string, offset uint32, format string, args ...interface{}) {
+	d.add(SeverityError, detector, offset, format, args...)
+}
@@ -0,0 +1,141 @@
+package rom
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Handler serializes regions of one Type into the layout directory on
+// extract and re-encodes them into Raw on build.  Leaf regions without a
+// registered handler are saved as raw files.  A handler registered for a
+// container is called after its children have been saved or loaded.
+type Handler interface {
+	Save(r *Region, layoutPath string) error
+	Load(r *Region, layoutPath string) error
+}
+
+var (
+	handlers = map[string]Handler{}
+)
+
+// RegisterHandler makes a handler available for all regions of the given
+// type.  It is meant to be called from the init of protocol packages.
+func RegisterHandler(regionType string, handler Handler) {
+	if _, ok := handlers[regionType]; ok {
+		panic("rom: handler registered twice for type " + regionType)
+	}
+	handlers[regionType] = handler
+}
+
+func handlerFor(r *Region) Handler {
+	if handler, ok := handlers[r.Type]; ok {
+		return handler
+	}
+	if len(r.Children) > 0 {
+		return nil
+	}
+	return RawHandler{}
+}
+
+// RawHandler stores a leaf region as a Name + ".raw" file.
+type RawHandler struct{}
+
+func (RawHandler) Save(r *Region, layoutPath string) error {
+	path := filepath.Join(layoutPath, r.Name+".raw")
+	os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err := ioutil.WriteFile(path, r.Raw, os.ModePerm); err != nil {
+		return fmt.Errorf("region: failed to write region file '%v': err=%v", path, err)
+	}
+	return nil
+}
+
+func (RawHandler) Load(r *Region, layoutPath string) error {
+	path := filepath.Join(layoutPath, r.Name+".raw")
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	r.Raw = raw
+	return nil
+}
+
+// StructHandler stores a leaf region as a Name + ".json" document holding
+// a typed config.  Decode builds the config from the region bytes and
+// Encode rebuilds the exact bytes from a config created by New.
+//
+// On save the JSON is checked to rebuild the original bytes; if it does
+// not, the region is downgraded to raw with a diagnostic so that extracted
+// layouts always rebuild byte for byte.
+type StructHandler struct {
+	New    func() interface{}
+	Decode func(r *Region) (interface{}, error)
+	Encode func(r *Region, v interface{}) ([]byte, error)
+}
+
+func (h StructHandler) Save(r *Region, layoutPath string) error {
+	configBytes, err := h.marshal(r)
+	if err != nil {
+		r.Diagnostics.Warnf("rom", r.Offset,
+			"%v handler can't represent region, saving raw: err=%v", r.Type, err)
+		r.Type = "raw"
+		return RawHandler{}.Save(r, layoutPath)
+	}
+
+	path := filepath.Join(layoutPath, r.Name+".json")
+	os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err := ioutil.WriteFile(path, configBytes, os.ModePerm); err != nil {
+		return fmt.Errorf("region: failed to write region file '%v': err=%v", path, err)
+	}
+	return nil
+}
+
+func (h StructHandler) marshal(r *Region) ([]byte, error) {
+	v, err := h.Decode(r)
+	if err != nil {
+		return nil, err
+	}
+	configBytes, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	// check the region can be rebuilt from the JSON alone
+	check := h.New()
+	if err := json.Unmarshal(configBytes, check); err != nil {
+		return nil, err
+	}
+	raw, err := h.Encode(r, check)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(raw, r.Raw) {
+		return nil, fmt.Errorf("encoded config doesn't match region bytes")
+	}
+	return configBytes, nil
+}
+
+func (h StructHandler) Load(r *Region, layoutPath string) error {
+	path := filepath.Join(layoutPath, r.Name+".json")
+	configBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	v := h.New()
+	if err := json.Unmarshal(configBytes, v); err != nil {
+		return fmt.Errorf("region: failed to parse '%v': err=%v", path, err)
+	}
+	raw, err := h.Encode(r, v)
+	if err != nil {
+		return fmt.Errorf("region: failed to encode '%v': err=%v", path, err)
+	}
+	if uint32(len(raw)) != r.Size {
+		return fmt.Errorf("region: '%v' encodes to 0x%x bytes, expected 0x%x",
+			path, len(raw), r.Size)
+	}
+	r.Raw = raw
+	return nil
+}
@@ -0,0 +1,79 @@
+package rom
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Hex8, Hex16, Hex32 and Hex64 are integers that are written to JSON as
+// "0x" prefixed hex strings so typed region configs stay readable next to
+// datasheets and hex dumps.  Plain JSON numbers are accepted on load.
+type Hex8 uint8
+type Hex16 uint16
+type Hex32 uint32
+type Hex64 uint64
+
+func (h Hex8) MarshalJSON() ([]byte, error)  { return json.Marshal(fmt.Sprintf("0x%02x", uint8(h))) }
+func (h Hex16) MarshalJSON() ([]byte, error) { return json.Marshal(fmt.Sprintf("0x%04x", uint16(h))) }
+func (h Hex32) MarshalJSON() ([]byte, error) { return json.Marshal(fmt.Sprintf("0x%08x", uint32(h))) }
+func (h Hex64) MarshalJSON() ([]byte, error) { return json.Marshal(fmt.Sprintf("0x%016x", uint64(h))) }
+
+func (h *Hex8) UnmarshalJSON(bs []byte) error {
+	v, err := unmarshalHex(bs, 8)
+	*h = Hex8(v)
+	return err
+}
+
+func (h *Hex16) UnmarshalJSON(bs []byte) error {
+	v, err := unmarshalHex(bs, 16)
+	*h = Hex16(v)
+	return err
+}
+
+func (h *Hex32) UnmarshalJSON(bs []byte) error {
+	v, err := unmarshalHex(bs, 32)
+	*h = Hex32(v)
+	return err
+}
+
+func (h *Hex64) UnmarshalJSON(bs []byte) error {
+	v, err := unmarshalHex(bs, 64)
+	*h = Hex64(v)
+	return err
+}
+
+func unmarshalHex(bs []byte, bitSize int) (uint64, error) {
+	var s string
+	if err := json.Unmarshal(bs, &s); err != nil {
+		// plain JSON number
+		s = string(bs)
+	}
+	v, err := strconv.ParseUint(strings.TrimSpace(s), 0, bitSize)
+	if err != nil {
+		return 0, fmt.Errorf("hex: invalid %v-bit value %v: err=%v", bitSize, string(bs), err)
+	}
+	return v, nil
+}
+
+// HexBytes is a byte slice written to JSON as a hex string.
+type HexBytes []byte
+
+func (h HexBytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(hex.EncodeToString(h))
+}
+
+func (h *HexBytes) UnmarshalJSON(bs []byte) error {
+	var s string
+	if err := json.Unmarshal(bs, &s); err != nil {
+		return err
+	}
+	data, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		return fmt.Errorf("hex: invalid byte string: err=%v", err)
+	}
+	*h = data
+	return nil
+}
@@ -17,10 +17,18 @@ type Region struct {
 	Raw      []byte    `json:"-"`
 	Parent   *Region   `json:"-"`
 	Children []*Region `json:",omitempty"`
+
+	Diagnostics Diagnostics `json:",omitempty"`
+	// Metadata holds facts detectors found about the region contents,
+	// e.g. format versions, that are not needed to rebuild it
+	Metadata map[string]string `json:",omitempty"`
+
+	// addressMap is only set on the region of the whole image
+	addressMap *AddressMap
 }
 
 func (r Region) AddBytes(bs []byte) {
-	if r.Type == "raw" {
+	if len(r.Children) == 0 {
 		for n := 0; n < int(r.Size); n++ {
 			bs[int(r.Offset)+n] = r.Raw[n]
 		}
@@ -38,7 +46,9 @@ func LoadRegion(layoutPath string) (*Region, error) {
 		return nil, err
 	}
 	var r Region
-	json.Unmarshal(layoutBytes, &r)
+	if err := json.Unmarshal(layoutBytes, &r); err != nil {
+		return nil, fmt.Errorf("region: failed to parse layout file '%v': err=%v", summaryJson, err)
+	}
 	err = r.loadData(nil, layoutPath)
 	if err != nil {
 		return nil, err
@@ -46,7 +56,12 @@ func LoadRegion(layoutPath string) (*Region, error) {
 	return &r, nil
 }
 
-func (r Region) Save(layoutPath string) error {
+func (r *Region) Save(layoutPath string) error {
+	// data first, handlers can fall back to raw for regions they can't encode
+	if err := r.saveData(layoutPath); err != nil {
+		return err
+	}
+
 	layoutBytes, err := json.Marshal(r)
 	if err != nil {
 		return fmt.Errorf("region: failed to marshal layout struct: err=%v", err)
@@ -56,51 +71,37 @@ func (r Region) Save(layoutPath string) error {
 	if err := ioutil.WriteFile(summaryJson, layoutBytes, os.ModePerm); err != nil {
 		return fmt.Errorf("region: failed to write layout file '%v': err=%v", layoutPath, err)
 	}
-
-	return r.saveData(layoutPath)
+	return nil
 }
 
 func (r *Region) loadData(parent *Region, layoutPath string) error {
 	r.Parent = parent
-	if len(r.Children) > 0 {
-		for _, child := range r.Children {
-			if err := child.loadData(r, layoutPath); err != nil {
-				return err
-			}
+	for _, child := range r.Children {
+		if err := child.loadData(r, layoutPath); err != nil {
+			return err
 		}
-		return nil
 	}
 
-	path := filepath.Join(layoutPath, r.Name+".raw")
-	raw, err := ioutil.ReadFile(path)
-	if err != nil {
-		return err
+	handler := handlerFor(r)
+	if handler == nil {
+		return nil
 	}
-	r.Raw = raw
-	return nil
+	return handler.Load(r, layoutPath)
 }
 
-func (r Region) saveData(layoutPath string) error {
-	// write data - only leaves
-	if len(r.Children) > 0 {
-		for _, child := range r.Children {
-			if err := child.saveData(layoutPath); err != nil {
-				return err
-			}
+func (r *Region) saveData(layoutPath string) error {
+	// write data - leaves and containers with handlers
+	for _, child := range r.Children {
+		if err := child.saveData(layoutPath); err != nil {
+			return err
 		}
 	}
-	// TODO: handle with proper casting to region handlers
-	if r.Type != "raw" {
-		return nil
-	}
 
-	path := filepath.Join(layoutPath, r.Name+".raw")
-	os.MkdirAll(filepath.Dir(path), os.ModePerm)
-	if err := ioutil.WriteFile(path, r.Raw, os.ModePerm); err != nil {
-		return fmt.Errorf("region: failed to write region file '%v': err=%v", path, err)
+	handler := handlerFor(r)
+	if handler == nil {
+		return nil
 	}
-
-	return nil
+	return handler.Save(r, layoutPath)
 }
 
 func (r Region) Empty() bool {
@@ -134,7 +135,7 @@ func (r Region) UnknownChild(offset, size uint32) *Region {
 
 func (r Region) Contains(offset, size uint32) bool {
 	return offset >= r.Offset && offset < (r.Offset+r.Size) &&
-		(offset+size) <= (r.Offset+r.Size)
+		uint64(offset)+uint64(size) <= uint64(r.Offset)+uint64(r.Size)
 }
 
 func (r Region) KnownParent() *Region {
@@ -144,6 +145,14 @@ func (r Region) KnownParent() *Region {
 	return cur
 }
 
+// Walk calls fn for the region and all of its descendants in order.
+func (r *Region) Walk(fn func(*Region)) {
+	fn(r)
+	for _, child := range r.Children {
+		child.Walk(fn)
+	}
+}
+
 func (r Region) FullSize() uint32 {
 	cur := &r
 	for ; cur.Parent != nil; cur = cur.Parent {
@@ -0,0 +1,42 @@
+package rom
+
+import "fmt"
+
+// Span is the part of a region stored on one chip of an image that is split
+// across several flash components.  Offset is relative to the chip.
+type Span struct {
+	Chip   int
+	Offset uint32
+	Size   uint32
+}
+
+func (s Span) String() string {
+	return fmt.Sprintf("chip%d 0x%08x - 0x%08x", s.Chip, s.Offset, s.Offset+s.Size-1)
+}
+
+// Spans maps the region onto chips of the given sizes laid out back to
+// back, a region crossing a chip boundary has a span on each chip.
+func (r Region) Spans(chipSizes []uint32) []Span {
+	spans := []Span{}
+	start, end := uint64(r.Offset), uint64(r.Offset)+uint64(r.Size)
+	chipStart := uint64(0)
+	for chip, size := range chipSizes {
+		chipEnd := chipStart + uint64(size)
+		if start < chipEnd && end > chipStart {
+			spanStart, spanEnd := start, end
+			if spanStart < chipStart {
+				spanStart = chipStart
+			}
+			if spanEnd > chipEnd {
+				spanEnd = chipEnd
+			}
+			spans = append(spans, Span{
+				Chip:   chip,
+				Offset: uint32(spanStart - chipStart),
+				Size:   uint32(spanEnd - spanStart),
+			})
+		}
+		chipStart = chipEnd
+	}
+	return spans
+}
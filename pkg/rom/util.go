@@ -1,6 +1,9 @@
 package rom
 
-import "fmt"
+import (
+	"encoding/binary"
+	"fmt"
+)
 
 func GuidString(guid [16]uint8) string {
 	return fmt.Sprintf("%02x%02x%02x%02x-%02x%02x-%02x%02x-%02x%02x-%02x%02x%02x%02x%02x%02x",
@@ -25,3 +28,22 @@ func Size24(len3 [3]uint8) uint32 {
 		(uint32(len3[1]) << 8) +
 		(uint32(len3[2]) << 16)
 }
+
+// ParseGuid is the inverse of GuidString.
+func ParseGuid(s string) ([16]uint8, error) {
+	var guid [16]uint8
+	var fields [11]uint64
+	n, err := fmt.Sscanf(s, "%08x-%04x-%04x-%02x%02x-%02x%02x%02x%02x%02x%02x",
+		&fields[0], &fields[1], &fields[2], &fields[3], &fields[4],
+		&fields[5], &fields[6], &fields[7], &fields[8], &fields[9], &fields[10])
+	if err != nil || n != len(fields) {
+		return guid, fmt.Errorf("guid: invalid guid '%v'", s)
+	}
+	binary.LittleEndian.PutUint32(guid[0:], uint32(fields[0]))
+	binary.LittleEndian.PutUint16(guid[4:], uint16(fields[1]))
+	binary.LittleEndian.PutUint16(guid[6:], uint16(fields[2]))
+	for i, field := range fields[3:] {
+		guid[8+i] = uint8(field)
+	}
+	return guid, nil
+}
@@ -7,6 +7,7 @@ import (
 	"io"
 	"log"
 
+	"github.com/flammit/fwtools/pkg/acm"
 	"github.com/flammit/fwtools/pkg/rom"
 )
 
@@ -28,6 +29,8 @@ type SectionHeader struct {
 
 var (
 	fileGuidEmpty = "ffffffff-ffff-ffff-ffff-ffffffffffff"
+	// the raw file holding the microcode updates of a firmware volume
+	MicrocodeFileGuid = "197db236-f856-4924-90f8-cdf12fb875f3"
 	/*
 		EFI_FIRMWARE_FILE_SYSTEM_GUID = "7A9354D9-0468-444A-81CE-0BF617D890DF"
 		EFI_FIRMWARE_FILE_SYSTEM2_GUID = "8C8CE578-8A3D-4F1C-9935-896185C32DD3"
@@ -36,9 +39,10 @@ var (
 	*/
 )
 
-func detectEFIFiles(unknownRegion *rom.Region) []*rom.Region {
+func detectEFIFiles(unknownRegion *rom.Region) ([]*rom.Region, rom.Diagnostics) {
 	bs := bytes.NewReader(unknownRegion.Raw)
 	baseOffset := unknownRegion.Offset
+	var diags rom.Diagnostics
 
 	files := []*rom.Region{}
 	offset, end := uint32(0), uint32(unknownRegion.Size)
@@ -49,7 +53,9 @@ func detectEFIFiles(unknownRegion *rom.Region) []*rom.Region {
 		bs.Seek(int64(offset), io.SeekStart)
 
 		var fileHeader FileHeader
-		binary.Read(bs, binary.LittleEndian, &fileHeader)
+		if err := binary.Read(bs, binary.LittleEndian, &fileHeader); err != nil {
+			break
+		}
 
 		size := rom.Size24(fileHeader.Len24)
 		headerLen := uint32(0x18)
@@ -60,6 +66,11 @@ func detectEFIFiles(unknownRegion *rom.Region) []*rom.Region {
 		if size >= end {
 			break
 		}
+		if size < headerLen || offset+uint32(rom.AlignUp(uint64(size), 8)) > end {
+			diags.Errorf(detectorName, baseOffset+offset,
+				"bad file header: len=0x%08x", size)
+			break
+		}
 
 		guid := rom.GuidString(fileHeader.GUID)
 		inc := uint32(rom.AlignUp(uint64(size), 8))
@@ -69,7 +80,7 @@ func detectEFIFiles(unknownRegion *rom.Region) []*rom.Region {
 		region := unknownRegion.Child(baseOffset+offset, inc, "container", name)
 
 		headerRegion := region.Child(baseOffset+offset, headerLen,
-			"raw", "header."+guid)
+			"ffs_header", "header."+guid)
 		region.Children = append(region.Children, headerRegion)
 
 		dataRegion := region.Child(baseOffset+offset+headerLen, inc-headerLen,
@@ -77,8 +88,9 @@ func detectEFIFiles(unknownRegion *rom.Region) []*rom.Region {
 		if guid == fileGuidEmpty {
 			dataRegion.Type = "raw"
 		} else {
+			// raw files hold no sections, ACMs are stored in them
 			dataRegion = rom.DetectRegions(
-				[]rom.Detector{detectEFISections},
+				[]rom.Detector{detectEFISections, acm.DetectACM},
 				dataRegion,
 			)
 		}
@@ -89,19 +101,27 @@ func detectEFIFiles(unknownRegion *rom.Region) []*rom.Region {
 		files = append(files, region)
 		offset += inc
 	}
-	return files
+	return files, diags
 }
 
-func detectEFISections(unknownRegion *rom.Region) []*rom.Region {
+// EFI_SECTION_RAW, e.g. SINIT ACMs in freeform files
+const sectionTypeRaw = 0x19
+
+func detectEFISections(unknownRegion *rom.Region) ([]*rom.Region, rom.Diagnostics) {
 	bs := bytes.NewReader(unknownRegion.Raw)
 	baseOffset := unknownRegion.Offset
+	var diags rom.Diagnostics
 
 	sections := []*rom.Region{}
 	var header SectionHeader
 	var offset uint32
 	for offset = uint32(0); offset < unknownRegion.Size; {
 		bs.Seek(int64(offset), io.SeekStart)
-		binary.Read(bs, binary.LittleEndian, &header)
+		if err := binary.Read(bs, binary.LittleEndian, &header); err != nil {
+			diags.Errorf(detectorName, baseOffset+offset,
+				"truncated section header: err=%v", err)
+			return nil, diags
+		}
 		sectionLen := rom.Size24(header.Len24)
 		dataOffset := uint32(0x4)
 		if sectionLen == 0 {
@@ -109,17 +129,22 @@ func detectEFISections(unknownRegion *rom.Region) []*rom.Region {
 		}
 		if sectionLen == 0xFFFFFF {
 			var len64 uint64
-			binary.Read(bs, binary.LittleEndian, &len64)
+			if err := binary.Read(bs, binary.LittleEndian, &len64); err != nil {
+				diags.Errorf(detectorName, baseOffset+offset,
+					"truncated extended section header: err=%v", err)
+				return nil, diags
+			}
 			dataOffset += 0x8
 			sectionLen = uint32(len64)
 		}
 
 		// TODO: this needs to be zero padded! but we're just including this in the data
 		sectionLen = uint32(rom.AlignUp(uint64(sectionLen), 4))
-		if offset+sectionLen > unknownRegion.Size {
-			log.Printf("    !!!Bad UEFI Section - using raw section: off=0x%08x len=0x%08x size=0x%08x",
-				offset, sectionLen, unknownRegion.Size)
-			return nil
+		if uint64(offset)+uint64(sectionLen) > uint64(unknownRegion.Size) {
+			diags.Warnf(detectorName, baseOffset+offset,
+				"bad section - using raw section: len=0x%08x size=0x%08x",
+				sectionLen, unknownRegion.Size)
+			return nil, diags
 		}
 
 		if sectionLen == 0 {
@@ -130,6 +155,10 @@ func detectEFISections(unknownRegion *rom.Region) []*rom.Region {
 			len(sections), header.Type, baseOffset+offset, sectionLen)
 
 		region := unknownRegion.Child(baseOffset+offset, sectionLen, "raw", name)
+		if header.Type == sectionTypeRaw {
+			region.Type = "unknown"
+			region = rom.DetectRegions([]rom.Detector{acm.DetectACM}, region)
+		}
 		sections = append(sections, region)
 
 		offset += sectionLen
@@ -138,8 +167,46 @@ func detectEFISections(unknownRegion *rom.Region) []*rom.Region {
 	// region can be ff padded at end
 	offset = uint32(rom.AlignUp(uint64(offset), 8))
 	if offset != unknownRegion.Size {
-		return nil
+		return nil, diags
 	}
 
-	return sections
+	return sections, diags
+}
+
+const (
+	fileSumOffset    = 0x11
+	fileChecksumAttr = 0x40
+	// FileSum of files without the checksum attribute
+	fileChecksumNone = 0xaa
+)
+
+func fileChecksum(attr uint8, data []byte) uint8 {
+	if attr&fileChecksumAttr == 0 {
+		return fileChecksumNone
+	}
+	sum := uint8(0)
+	for _, b := range data {
+		sum += b
+	}
+	return -sum
+}
+
+// UpdateFileChecksum recomputes the FileSum of the FFS file at the start of
+// file after its data was changed.  The header checksum doesn't cover
+// FileSum and stays valid.
+func UpdateFileChecksum(file []byte) error {
+	var header FileHeader
+	bs := make([]byte, largeFileHeaderLen)
+	copy(bs, file)
+	binary.Read(bytes.NewReader(bs), binary.LittleEndian, &header)
+
+	size, headerLen := rom.Size24(header.Len24), uint32(fileHeaderLen)
+	if size == 0xffffff {
+		size, headerLen = uint32(header.Len64), largeFileHeaderLen
+	}
+	if size < headerLen || uint64(size) > uint64(len(file)) {
+		return fmt.Errorf("ffs: bad file size 0x%x", size)
+	}
+	file[fileSumOffset] = fileChecksum(header.Attr, file[headerLen:size])
+	return nil
 }
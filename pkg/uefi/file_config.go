@@ -0,0 +1,146 @@
+package uefi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/flammit/fwtools/pkg/rom"
+)
+
+func init() {
+	rom.RegisterHandler("ffs_header", rom.StructHandler{
+		New: func() interface{} { return &FileHeaderConfig{} },
+		Decode: func(r *rom.Region) (interface{}, error) {
+			return DecodeFileHeaderConfig(r.Raw)
+		},
+		Encode: func(r *rom.Region, v interface{}) ([]byte, error) {
+			return v.(*FileHeaderConfig).Encode(r.Size)
+		},
+	})
+}
+
+const (
+	fileHeaderLen      = 0x18
+	largeFileHeaderLen = 0x20
+	headerSumOffset    = 0x10
+	fileStateOffset    = 0x17
+)
+
+// FileHeaderConfig is the editable form of an FFS file header.  Size is the
+// full file size including the header and Large selects the 64-bit size
+// header.  The header checksum is recomputed on encode, a stored checksum
+// that didn't match is kept in BadHeaderSum and written back only while the
+// header is unchanged.  HeaderSum pins the checksum byte, it is never set
+// when decoding.
+type FileHeaderConfig struct {
+	GUID         string
+	HeaderSum    *rom.Hex8    `json:",omitempty"`
+	BadHeaderSum *BadChecksum `json:",omitempty"`
+	FileSum      rom.Hex8
+	Type         rom.Hex8
+	Attr         rom.Hex8
+	State        rom.Hex8
+	Size         rom.Hex64
+	Large        bool `json:",omitempty"`
+}
+
+// BadChecksum is a stored checksum and the one the header sums to
+type BadChecksum struct {
+	Stored   rom.Hex8
+	Expected rom.Hex8
+}
+
+// headerChecksum is the HeaderSum that makes the header sum to zero, with
+// FileSum and State taken as zero.
+func headerChecksum(header []byte) uint8 {
+	sum := uint8(0)
+	for n, b := range header {
+		switch n {
+		case headerSumOffset, fileSumOffset, fileStateOffset:
+		default:
+			sum += b
+		}
+	}
+	return -sum
+}
+
+func DecodeFileHeaderConfig(raw []byte) (*FileHeaderConfig, error) {
+	if len(raw) != fileHeaderLen && len(raw) != largeFileHeaderLen {
+		return nil, fmt.Errorf("ffs: bad header length 0x%x", len(raw))
+	}
+	var header FileHeader
+	bs := make([]byte, largeFileHeaderLen)
+	copy(bs, raw)
+	binary.Read(bytes.NewReader(bs), binary.LittleEndian, &header)
+
+	c := &FileHeaderConfig{
+		GUID:    rom.GuidString(header.GUID),
+		FileSum: rom.Hex8(header.FileSum),
+		Type:    rom.Hex8(header.Type),
+		Attr:    rom.Hex8(header.Attr),
+		State:   rom.Hex8(header.State),
+		Size:    rom.Hex64(rom.Size24(header.Len24)),
+		Large:   len(raw) == largeFileHeaderLen,
+	}
+	if expected := headerChecksum(raw); header.HeaderSum != expected {
+		c.BadHeaderSum = &BadChecksum{
+			Stored:   rom.Hex8(header.HeaderSum),
+			Expected: rom.Hex8(expected),
+		}
+	}
+	if c.Large {
+		if rom.Size24(header.Len24) != 0xffffff {
+			return nil, fmt.Errorf("ffs: large header with 24-bit size")
+		}
+		c.Size = rom.Hex64(header.Len64)
+	}
+	return c, nil
+}
+
+func (c FileHeaderConfig) Encode(size uint32) ([]byte, error) {
+	headerLen := uint32(fileHeaderLen)
+	if c.Large {
+		headerLen = largeFileHeaderLen
+	}
+	if headerLen != size {
+		return nil, fmt.Errorf("ffs: header length 0x%x doesn't match region size 0x%x",
+			headerLen, size)
+	}
+	guid, err := rom.ParseGuid(c.GUID)
+	if err != nil {
+		return nil, err
+	}
+
+	header := FileHeader{
+		GUID:    guid,
+		FileSum: uint8(c.FileSum),
+		Type:    uint8(c.Type),
+		Attr:    uint8(c.Attr),
+		State:   uint8(c.State),
+	}
+	if c.Large {
+		header.Len24 = [3]uint8{0xff, 0xff, 0xff}
+		header.Len64 = uint64(c.Size)
+	} else {
+		if c.Size > 0xffffff {
+			return nil, fmt.Errorf("ffs: size 0x%x needs a large header", uint64(c.Size))
+		}
+		header.Len24 = [3]uint8{uint8(c.Size), uint8(c.Size >> 8), uint8(c.Size >> 16)}
+	}
+
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, header)
+	raw := b.Bytes()[:headerLen]
+	switch {
+	case c.HeaderSum != nil:
+		raw[headerSumOffset] = uint8(*c.HeaderSum)
+	default:
+		sum := headerChecksum(raw)
+		if c.BadHeaderSum != nil && uint8(c.BadHeaderSum.Expected) == sum {
+			sum = uint8(c.BadHeaderSum.Stored)
+		}
+		raw[headerSumOffset] = sum
+	}
+	return raw, nil
+}
@@ -0,0 +1,93 @@
+package uefi
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/flammit/fwtools/pkg/rom"
+)
+
+func TestFileHeaderConfigRoundTrip(t *testing.T) {
+	guid := []byte{
+		0x78, 0xe5, 0x8c, 0x8c, 0x3d, 0x8a, 0x1c, 0x4f,
+		0x99, 0x35, 0x89, 0x61, 0x85, 0xc3, 0x2d, 0xd3,
+	}
+	header := append(guid, 0x5a, 0xaa, 0x07, 0x00, 0x00, 0x10, 0x02, 0xf8)
+	large := append(append(guid, 0x5a, 0xaa, 0x07, 0x01, 0xff, 0xff, 0xff, 0xf8),
+		0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00)
+
+	for _, raw := range [][]byte{header, large} {
+		c, err := DecodeFileHeaderConfig(raw)
+		if err != nil {
+			t.Fatalf("DecodeFileHeaderConfig() err=%v", err)
+		}
+		encoded, err := c.Encode(uint32(len(raw)))
+		if err != nil {
+			t.Fatalf("Encode() err=%v", err)
+		}
+		if !bytes.Equal(encoded, raw) {
+			t.Errorf("Encode(DecodeFileHeaderConfig()) = %x, want %x", encoded, raw)
+		}
+	}
+
+	c, _ := DecodeFileHeaderConfig(header)
+	if c.Size != 0x21000 || c.Large || c.BadHeaderSum == nil {
+		t.Errorf("DecodeFileHeaderConfig() = %+v", c)
+	}
+	c.Size = 0x1000000
+	if _, err := c.Encode(fileHeaderLen); err == nil {
+		t.Errorf("Encode() of a 16MiB file with a 24-bit size succeeded")
+	}
+}
+
+func TestFileHeaderChecksum(t *testing.T) {
+	raw := []byte{
+		0x78, 0xe5, 0x8c, 0x8c, 0x3d, 0x8a, 0x1c, 0x4f,
+		0x99, 0x35, 0x89, 0x61, 0x85, 0xc3, 0x2d, 0xd3,
+		0x00, 0xaa, 0x07, 0x00, 0x00, 0x10, 0x02, 0xf8,
+	}
+	raw[headerSumOffset] = headerChecksum(raw)
+	bad := append([]byte{}, raw...)
+	bad[headerSumOffset]++
+
+	valid := func(header []byte) bool {
+		sum := header[headerSumOffset]
+		return headerChecksum(header) == sum
+	}
+	pin := rom.Hex8(0x5a)
+	for _, tt := range []struct {
+		name string
+		raw  []byte
+		edit func(c *FileHeaderConfig)
+		want func(encoded []byte) bool
+	}{
+		{"valid", raw, nil, valid},
+		{"valid edited", raw, func(c *FileHeaderConfig) { c.Size += 8 }, valid},
+		{"state and file sum aren't covered", raw, func(c *FileHeaderConfig) { c.State, c.FileSum = 0xf0, 0x12 }, valid},
+		{"bad", bad, nil, func(encoded []byte) bool { return bytes.Equal(encoded, bad) }},
+		{"bad edited", bad, func(c *FileHeaderConfig) { c.Type = 0x06 }, valid},
+		{"pinned", raw, func(c *FileHeaderConfig) { c.Type, c.HeaderSum = 0x06, &pin }, func(encoded []byte) bool {
+			return encoded[headerSumOffset] == 0x5a
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := DecodeFileHeaderConfig(tt.raw)
+			if err != nil {
+				t.Fatalf("DecodeFileHeaderConfig() err=%v", err)
+			}
+			if (c.BadHeaderSum != nil) != (tt.raw[headerSumOffset] != raw[headerSumOffset]) || c.HeaderSum != nil {
+				t.Errorf("DecodeFileHeaderConfig() = %+v", c)
+			}
+			if tt.edit != nil {
+				tt.edit(c)
+			}
+			encoded, err := c.Encode(fileHeaderLen)
+			if err != nil {
+				t.Fatalf("Encode() err=%v", err)
+			}
+			if !tt.want(encoded) {
+				t.Errorf("Encode() = %x", encoded)
+			}
+		})
+	}
+}
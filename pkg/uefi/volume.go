@@ -35,16 +35,21 @@ func (h VolumeHeader) Valid() bool {
 	return h.Sig == volumeSignature && h.TerminateBlock == 0
 }
 
-func DetectEFIVolume(unknownRegion *rom.Region) []*rom.Region {
+const detectorName = "uefi"
+
+func DetectEFIVolume(unknownRegion *rom.Region) ([]*rom.Region, rom.Diagnostics) {
 	bs := bytes.NewReader(unknownRegion.Raw)
 	baseOffset := unknownRegion.Offset
+	var diags rom.Diagnostics
 
 	// scan for signature
 	var header VolumeHeader
 	volumes := []*rom.Region{}
 	for offset := uint32(0); offset < unknownRegion.Size; {
 		bs.Seek(int64(offset), io.SeekStart)
-		binary.Read(bs, binary.LittleEndian, &header)
+		if err := binary.Read(bs, binary.LittleEndian, &header); err != nil {
+			break
+		}
 		if !header.Valid() {
 			offset += pageSize
 			continue
@@ -57,10 +62,18 @@ func DetectEFIVolume(unknownRegion *rom.Region) []*rom.Region {
 		// setup new region for the full volume
 		name := fmt.Sprintf("fv_%08x", baseOffset+offset)
 		size := uint32(header.Len)
+		headerLen := uint32(header.HeaderLen)
+		if header.Len > uint64(unknownRegion.Size-offset) || headerLen > size ||
+			headerLen < 0x48 {
+			diags.Errorf(detectorName, baseOffset+offset,
+				"bad volume header: len=0x%08x header_len=0x%04x",
+				header.Len, header.HeaderLen)
+			offset += pageSize
+			continue
+		}
 		region := unknownRegion.Child(baseOffset+offset, size, "container", name)
 
 		// generate headers and scan for files
-		headerLen := uint32(header.HeaderLen)
 		headerRegion := region.Child(baseOffset+offset, headerLen, "raw", "header")
 		region.Children = append(region.Children, headerRegion)
 		dataRegion := region.Child(baseOffset+offset+headerLen, size-headerLen, "unknown", "data")
@@ -74,5 +87,5 @@ func DetectEFIVolume(unknownRegion *rom.Region) []*rom.Region {
 		offset += size
 	}
 
-	return volumes
+	return volumes, diags
 }